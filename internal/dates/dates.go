@@ -1,5 +1,8 @@
+// Package dates helps to work with dates in organisation's timezone.
 package dates
 
+import "time"
+
 var WeekDaysRu = []string{
 	"Вс",
 	"Пн",
@@ -9,3 +12,31 @@ var WeekDaysRu = []string{
 	"Пт",
 	"Сб",
 }
+
+// location is organisation's timezone. All trip dates and timestamps are in this timezone.
+var location = time.Local
+
+// SetLocation sets organisation's timezone by IANA name, e.g. "Europe/Moscow".
+// Empty name keeps local timezone of the server.
+func SetLocation(name string) error {
+	if name == "" {
+		location = time.Local
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+	location = loc
+	return nil
+}
+
+// Location returns organisation's timezone.
+func Location() *time.Location {
+	return location
+}
+
+// Now returns current time in organisation's timezone.
+func Now() time.Time {
+	return time.Now().In(location)
+}
@@ -0,0 +1,81 @@
+// Package dispatcher runs jobs in parallel by bounded pool of workers, jobs with the same key are run one by one in order they were added.
+package dispatcher
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// Dispatcher keeps queue of jobs for every key which has running job.
+type Dispatcher struct {
+	mutex  sync.Mutex
+	queues map[int64][]func()
+	slots  chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates dispatcher which runs at most workers jobs at the same time.
+func New(workers int) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Dispatcher{
+		queues: make(map[int64][]func()),
+		slots:  make(chan struct{}, workers),
+	}
+}
+
+// Dispatch runs job after all jobs with the same key added before it are finished.
+// It blocks while all workers are busy, so jobs are not accumulated faster than they are run.
+func (dispatcher *Dispatcher) Dispatch(key int64, job func()) {
+	dispatcher.mutex.Lock()
+	if queue, ok := dispatcher.queues[key]; ok {
+		// job with the same key is running, it runs queued jobs after itself.
+		dispatcher.queues[key] = append(queue, job)
+		dispatcher.mutex.Unlock()
+		return
+	}
+	dispatcher.queues[key] = nil
+	dispatcher.mutex.Unlock()
+
+	dispatcher.wg.Add(1)
+	dispatcher.slots <- struct{}{}
+	go dispatcher.run(key, job)
+}
+
+// Wait waits until all dispatched jobs are finished.
+func (dispatcher *Dispatcher) Wait() {
+	dispatcher.wg.Wait()
+}
+
+// run runs job and then jobs queued with the same key until queue is empty.
+func (dispatcher *Dispatcher) run(key int64, job func()) {
+	defer dispatcher.wg.Done()
+	defer func() { <-dispatcher.slots }()
+
+	for {
+		runJob(key, job)
+
+		dispatcher.mutex.Lock()
+		queue := dispatcher.queues[key]
+		if len(queue) == 0 {
+			delete(dispatcher.queues, key)
+			dispatcher.mutex.Unlock()
+			return
+		}
+		job = queue[0]
+		dispatcher.queues[key] = queue[1:]
+		dispatcher.mutex.Unlock()
+	}
+}
+
+// runJob runs job and recovers from panic, so one broken job doesn't stop jobs of other keys.
+func runJob(key int64, job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job of %d panicked: %v\n%s", key, r, debug.Stack())
+		}
+	}()
+	job()
+}
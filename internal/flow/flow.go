@@ -0,0 +1,120 @@
+// Package flow runs conversation with user as a state machine. Every step declares which input it waits for,
+// how input is validated, what user sees when input is wrong and which steps can follow it.
+package flow
+
+import (
+	"fmt"
+	"log"
+)
+
+// Input is message or poll answer sent by user.
+type Input struct {
+	Text         string
+	PollOptions  []int
+	IsPollAnswer bool
+}
+
+// Step is state of conversation. C is conversation data passed to callbacks of the step.
+type Step[C any] struct {
+	Name string
+	// PollAnswer is true if step waits for answer to the poll, otherwise it waits for text message.
+	PollAnswer bool
+	// Options is list of allowed texts of message. Any text is allowed if it's empty.
+	Options []string
+	// ErrorMessage is shown to user if text is not one of Options or text is sent instead of poll answer.
+	ErrorMessage string
+	// Validate checks input after Options, error is shown to user.
+	Validate func(conversation C, input Input) error
+	// OnError is called after error is shown to user. It asks question again and returns step to continue from.
+	// Conversation stays on the step if it's nil.
+	OnError func(conversation C) string
+	// Handle handles valid input, asks next question and returns next step. Step without Handle is final.
+	Handle func(conversation C, input Input) string
+	// Next is list of steps which can follow the step.
+	Next []string
+}
+
+// Flow is set of steps with callback which shows errors to user.
+type Flow[C any] struct {
+	steps     map[string]*Step[C]
+	showError func(conversation C, message string)
+}
+
+// New creates flow and checks that steps have unique names and all transitions lead to steps of the flow.
+func New[C any](showError func(conversation C, message string), steps ...*Step[C]) (*Flow[C], error) {
+	flow := &Flow[C]{
+		steps:     make(map[string]*Step[C]),
+		showError: showError,
+	}
+	for _, step := range steps {
+		if _, ok := flow.steps[step.Name]; ok {
+			return nil, fmt.Errorf("step %s is declared twice", step.Name)
+		}
+		flow.steps[step.Name] = step
+	}
+	for _, step := range steps {
+		for _, next := range step.Next {
+			if _, ok := flow.steps[next]; !ok {
+				return nil, fmt.Errorf("step %s leads to unknown step %s", step.Name, next)
+			}
+		}
+	}
+	return flow, nil
+}
+
+// Step returns step by name or nil if flow doesn't have it.
+func (flow *Flow[C]) Step(name string) *Step[C] {
+	return flow.steps[name]
+}
+
+// Handle handles input of user on the current step and returns step to continue from.
+// It returns false if current step isn't a step of the flow or it's final step.
+// Answers to polls on steps waiting for text are ignored, they can be answers to polls sent on previous steps.
+func (flow *Flow[C]) Handle(conversation C, current string, input Input) (string, bool) {
+	step, ok := flow.steps[current]
+	if !ok || step.Handle == nil {
+		return current, false
+	}
+
+	if input.IsPollAnswer != step.PollAnswer {
+		if !input.IsPollAnswer && step.ErrorMessage != "" {
+			flow.showError(conversation, step.ErrorMessage)
+		}
+		return current, true
+	}
+	if !input.IsPollAnswer && len(step.Options) > 0 && !contains(step.Options, input.Text) {
+		return flow.fail(conversation, step, step.ErrorMessage), true
+	}
+	if step.Validate != nil {
+		if err := step.Validate(conversation, input); err != nil {
+			return flow.fail(conversation, step, err.Error()), true
+		}
+	}
+
+	next := step.Handle(conversation, input)
+	if next != current && !contains(step.Next, next) {
+		log.Printf("[flow]: step %s leads to undeclared step %s", current, next)
+	}
+	return next, true
+}
+
+// fail shows error to user and returns step to continue from.
+func (flow *Flow[C]) fail(conversation C, step *Step[C], message string) string {
+	if message != "" {
+		flow.showError(conversation, message)
+	}
+	if step.OnError == nil {
+		return step.Name
+	}
+	return step.OnError(conversation)
+}
+
+// contains checks if list contains value.
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
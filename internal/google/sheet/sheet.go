@@ -4,6 +4,7 @@ package sheet
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,47 +12,460 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	googleoauth "golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 	"google.golang.org/api/sheets/v4"
 
+	"walkthedog/internal/dates"
 	"walkthedog/internal/interfaces"
 	"walkthedog/internal/models"
 )
 
+// Ways to authenticate in google sheets, see auth in google section of app config.
+const (
+	// AuthOAuth uses token of user, it's got by /update_google_auth command. It's used by default.
+	AuthOAuth = "oauth"
+	// AuthServiceAccount uses key file of service account which has access to the spreadsheet.
+	AuthServiceAccount = "service_account"
+)
+
+// Layouts of tabs where trips are saved, see layout in google section of app config.
+const (
+	// LayoutShelter saves trips to tab of shelter named by its short title, e.g. Хаски. It's used by default.
+	LayoutShelter = "shelter"
+	// LayoutSingle saves all trips to one tab, its name is set by sheet in google section of app config.
+	LayoutSingle = "single"
+	// LayoutTrip saves trips to tab of the trip named by date and short title of shelter, e.g. 13.08.2022Хаски.
+	LayoutTrip = "trip"
+	// LayoutMonth saves trips to tab of the month of the trip, e.g. 08.2022.
+	LayoutMonth = "month"
+)
+
+// legacyRegisteredAtHeader is header of column of registration time in tabs created before columns were set in app config.
+const legacyRegisteredAtHeader = "Дата регистрации на выезд (UTC +8)"
+
+// requestTimeout limits time of one request to google sheets, so write of trip doesn't hang when network is down.
+const requestTimeout = 30 * time.Second
+
+// defaultSingleSheet is tab of LayoutSingle if it's not set in app config.
+const defaultSingleSheet = "Выезды"
+
+// ErrTokenExpired is returned when token of user is expired and it doesn't have refresh token.
+var ErrTokenExpired = errors.New("token is expired and it can't be refreshed")
+
+// scope is access to google sheets requested by bot.
+const scope = "https://www.googleapis.com/auth/spreadsheets"
+
+// defaultCredentialsFile and defaultTokenFile are used by OAuth if files are not set in app config.
+const (
+	defaultCredentialsFile = "credentials.json"
+	defaultTokenFile       = "token.json"
+)
+
+// Fields of trip which can be written to columns of google sheet, see columns in google section of app config.
+const (
+	FieldUsername          = "username"
+	FieldDate              = "date"
+	FieldIsFirstTrip       = "is_first_trip"
+	FieldPurpose           = "purpose"
+	FieldTripBy            = "trip_by"
+	FieldHowYouKnowAboutUs = "how_you_know_about_us"
+	FieldStatus            = "status"
+	// FieldRegisteredAt is time when user finished registration, trips registered before it was kept get time when they are written to google sheet.
+	FieldRegisteredAt      = "registered_at"
+	FieldShelterID         = "shelter.id"
+	FieldShelterTitle      = "shelter.title"
+	FieldShelterShortTitle = "shelter.short_title"
+	FieldShelterLongTitle  = "shelter.long_title"
+	FieldShelterAddress    = "shelter.address"
+)
+
+// Formats of values of columns. Values are written as is if format is empty, lists are joined by comma without space.
+const (
+	// FormatDate writes only day of date, e.g. "Сб 13.08.2022 11:00" => 13.08.2022.
+	FormatDate = "date"
+	// FormatBool writes bool as "Да" or "Нет".
+	FormatBool = "bool"
+	// FormatList joins list by comma with space.
+	FormatList = "list"
+)
+
+// registeredAt returns time when user finished registration or writtenAt if trip was registered before it was kept.
+func registeredAt(tripToShelter *models.TripToShelter, writtenAt time.Time) interface{} {
+	if tripToShelter.RegisteredAt.IsZero() {
+		return writtenAt
+	}
+	return tripToShelter.RegisteredAt.In(dates.Location())
+}
+
+// fields returns value of field of trip, writtenAt is time when trip is written to google sheet.
+var fields = map[string]func(tripToShelter *models.TripToShelter, writtenAt time.Time) interface{}{
+	FieldUsername:          func(t *models.TripToShelter, _ time.Time) interface{} { return t.Username },
+	FieldDate:              func(t *models.TripToShelter, _ time.Time) interface{} { return t.Date },
+	FieldIsFirstTrip:       func(t *models.TripToShelter, _ time.Time) interface{} { return t.IsFirstTrip },
+	FieldPurpose:           func(t *models.TripToShelter, _ time.Time) interface{} { return t.Purpose },
+	FieldTripBy:            func(t *models.TripToShelter, _ time.Time) interface{} { return t.TripBy },
+	FieldHowYouKnowAboutUs: func(t *models.TripToShelter, _ time.Time) interface{} { return t.HowYouKnowAboutUs },
+	FieldStatus:            func(t *models.TripToShelter, _ time.Time) interface{} { return t.Status },
+	FieldRegisteredAt:      registeredAt,
+	FieldShelterID:         func(t *models.TripToShelter, _ time.Time) interface{} { return t.Shelter.ID },
+	FieldShelterTitle:      func(t *models.TripToShelter, _ time.Time) interface{} { return t.Shelter.Title },
+	FieldShelterShortTitle: func(t *models.TripToShelter, _ time.Time) interface{} { return t.Shelter.ShortTitle },
+	FieldShelterLongTitle:  func(t *models.TripToShelter, _ time.Time) interface{} { return t.Shelter.LongTitle },
+	FieldShelterAddress:    func(t *models.TripToShelter, _ time.Time) interface{} { return t.Shelter.Address },
+}
+
+// maxBatchGetRanges limits count of ranges read by one request, so url of request is not too long.
+const maxBatchGetRanges = 100
+
 type googleSheet struct {
 	SpreadsheetID string
 	Service       *sheets.Service
+	// columns are written to tabs of trips, systemColumns are written to System tab.
+	columns       []models.Column
+	systemColumns []models.Column
+	// headers keeps header rows of tabs read from google sheet.
+	headers *sheetHeaders
+	// checkAuth gets new token to check that bot is still authenticated. It's nil if service is created with its own client.
+	checkAuth func() error
+}
+
+// sheetHeaders keeps header rows of tabs by names of tabs.
+type sheetHeaders struct {
+	mutex sync.Mutex
+	tabs  map[string][]string
 }
 
-func NewGoogleSpreadsheet(google models.Google) (interfaces.GoogleSheetsService, error) {
+// userTokenSource gives token of user from file, refreshes it when it's expired and saves refreshed token back to file.
+type userTokenSource struct {
+	mutex  sync.Mutex
+	config *oauth2.Config
+	path   string
+	token  *oauth2.Token
+}
+
+// NewGoogleSpreadsheet creates google sheet service authenticated in the way set in app config.
+func NewGoogleSpreadsheet(google models.Google, opts ...option.ClientOption) (interfaces.GoogleSheetsService, error) {
 	//save to google sheet
-	srv, err := NewService()
+	srv, checkAuth, err := newService(google, opts...)
 	if err != nil {
 		return nil, err
 	}
 
+	googleSheetService := newGoogleSheet(google, srv)
+	googleSheetService.checkAuth = checkAuth
+	return googleSheetService, nil
+}
+
+// NewGoogleSpreadsheetWithService creates google sheet service which uses given sheets service, e.g. connected to another endpoint.
+func NewGoogleSpreadsheetWithService(google models.Google, srv *sheets.Service) interfaces.GoogleSheetsService {
+	return newGoogleSheet(google, srv)
+}
+
+// newGoogleSheet creates google sheet service with columns set in app config.
+func newGoogleSheet(google models.Google, srv *sheets.Service) *googleSheet {
 	return &googleSheet{
 		SpreadsheetID: google.SpreadsheetID,
 		Service:       srv,
-	}, nil
+		columns:       getColumns(google),
+		systemColumns: getSystemColumns(google),
+		headers:       &sheetHeaders{tabs: make(map[string][]string)},
+	}
+}
+
+// getColumns returns columns of tabs of trips set in app config or default ones.
+func getColumns(google models.Google) []models.Column {
+	if len(google.Columns) > 0 {
+		return google.Columns
+	}
+	return []models.Column{
+		{Header: "User", Field: FieldUsername},
+		{Header: "Приют", Field: FieldShelterTitle},
+		{Header: "Дата", Field: FieldDate},
+		{Header: "Первый раз", Field: FieldIsFirstTrip},
+		{Header: "Цели", Field: FieldPurpose},
+		{Header: "Как добирается", Field: FieldTripBy},
+		{Header: "Откуда узнал", Field: FieldHowYouKnowAboutUs},
+		{Header: registeredAtHeader(), Aliases: []string{legacyRegisteredAtHeader}, Field: FieldRegisteredAt},
+		{Header: "Статус", Field: FieldStatus},
+	}
+}
+
+// registeredAtHeader returns header of column of registration time with timezone of organisation, e.g. "Дата регистрации на выезд (Europe/Moscow)".
+// Offset is used if timezone isn't set, e.g. "Дата регистрации на выезд (UTC+03:00)".
+func registeredAtHeader() string {
+	timezone := dates.Location().String()
+	if dates.Location() == time.Local {
+		timezone = "UTC" + dates.Now().Format("-07:00")
+	}
+	return fmt.Sprintf("Дата регистрации на выезд (%s)", timezone)
+}
+
+// getSystemColumns returns columns of System tab set in app config or default ones. System tab doesn't have headers.
+func getSystemColumns(google models.Google) []models.Column {
+	if len(google.SystemColumns) > 0 {
+		return google.SystemColumns
+	}
+	return []models.Column{
+		{Field: FieldUsername},
+		{Field: FieldShelterShortTitle},
+		{Field: FieldDate},
+		{Field: FieldRegisteredAt},
+	}
+}
+
+// CheckColumns checks that columns set in app config have known fields and formats and unique headers.
+// Tabs of trips should have columns of date and status, they are read to sync trips changed by coordinators.
+func CheckColumns(google models.Google) error {
+	headers := make(map[string]bool)
+	hasFields := make(map[string]bool)
+	for _, column := range google.Columns {
+		if column.Header == "" {
+			return fmt.Errorf("column of field \"%s\" doesn't have header", column.Field)
+		}
+		if headers[column.Header] {
+			return fmt.Errorf("column \"%s\" is declared twice", column.Header)
+		}
+		headers[column.Header] = true
+		hasFields[column.Field] = true
+	}
+	if len(google.Columns) > 0 && (!hasFields[FieldDate] || !hasFields[FieldStatus]) {
+		return fmt.Errorf("columns should have fields \"%s\" and \"%s\"", FieldDate, FieldStatus)
+	}
+
+	for _, column := range append(append([]models.Column{}, google.Columns...), google.SystemColumns...) {
+		if _, ok := fields[column.Field]; !ok {
+			return fmt.Errorf("column \"%s\" has unknown field \"%s\"", column.Header, column.Field)
+		}
+		switch column.Format {
+		case "", FormatDate, FormatBool, FormatList:
+		default:
+			return fmt.Errorf("column \"%s\" has unknown format \"%s\"", column.Header, column.Format)
+		}
+	}
+	return nil
+}
+
+// formatValue returns value of column for the trip.
+func formatValue(column models.Column, tripToShelter *models.TripToShelter, writtenAt time.Time) interface{} {
+	value := fields[column.Field](tripToShelter, writtenAt)
+	switch v := value.(type) {
+	case bool:
+		if column.Format == FormatBool {
+			if v {
+				return "Да"
+			}
+			return "Нет"
+		}
+		return strconv.FormatBool(v)
+	case []string:
+		if column.Format == FormatList {
+			return strings.Join(v, ", ")
+		}
+		return strings.Join(v, ",")
+	case time.Time:
+		if column.Format == FormatDate {
+			return v.Format("02.01.2006")
+		}
+		return v.Format("02.01.2006 15:04:05")
+	case string:
+		if column.Format == FormatDate {
+			if day, err := parseTripDate(v); err == nil {
+				return day.Format("02.01.2006")
+			}
+		}
+		return v
+	}
+	return value
+}
+
+// buildRow returns row of the trip where values of columns are placed under their headers.
+// Cells of headers which are not columns, e.g. added by coordinators, are skipped.
+func buildRow(columns []models.Column, header []string, tripToShelter *models.TripToShelter, writtenAt time.Time) []interface{} {
+	row := make([]interface{}, len(header))
+	for _, column := range columns {
+		if index := columnIndex(header, column); index != -1 {
+			row[index] = formatValue(column, tripToShelter, writtenAt)
+		}
+	}
+	return row
+}
+
+// columnIndex returns index of the column in header row found by its header or aliases or -1 if tab doesn't have it.
+func columnIndex(header []string, column models.Column) int {
+	if index := headerIndex(header, column.Header); index != -1 {
+		return index
+	}
+	for _, alias := range column.Aliases {
+		if index := headerIndex(header, alias); index != -1 {
+			return index
+		}
+	}
+	return -1
+}
+
+// headerIndex returns index of header in header row or -1 if tab doesn't have it.
+func headerIndex(header []string, title string) int {
+	for i, v := range header {
+		if v == title {
+			return i
+		}
+	}
+	return -1
+}
+
+// fieldIndex returns index of column of the field in header row or -1 if tab doesn't have it.
+func fieldIndex(columns []models.Column, header []string, field string) int {
+	for _, column := range columns {
+		if column.Field == field {
+			return columnIndex(header, column)
+		}
+	}
+	return -1
+}
+
+// columnHeaders returns headers of columns.
+func columnHeaders(columns []models.Column) []string {
+	var headers []string
+	for _, column := range columns {
+		headers = append(headers, column.Header)
+	}
+	return headers
+}
+
+// columnName returns name of column by its index, e.g. 0 => A, 26 => AA.
+func columnName(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
 }
 
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) (*http.Client, error) {
-	// The file token.json stores the user's access and refresh tokens, and is
+// Refreshed tokens are saved to the token file, so they are not lost after restart.
+func getClient(config *oauth2.Config, tokFile string) (*http.Client, *userTokenSource, error) {
+	// The token file stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "token.json"
 	tok, err := tokenFromFile(tokFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokenSource := &userTokenSource{
+		config: config,
+		path:   tokFile,
+		token:  tok,
+	}
+	return oauth2.NewClient(context.Background(), tokenSource), tokenSource, nil
+}
+
+// Token returns token of user. Expired token is replaced by token saved to file by authorization of user or refreshed.
+func (tokenSource *userTokenSource) Token() (*oauth2.Token, error) {
+	tokenSource.mutex.Lock()
+	defer tokenSource.mutex.Unlock()
+
+	if tokenSource.token.Valid() {
+		return tokenSource.token, nil
+	}
+	return tokenSource.refresh()
+}
+
+// Refresh gets new token by refresh token even if current token isn't expired yet,
+// so revoked or expired refresh token is found before requests to google sheets fail.
+func (tokenSource *userTokenSource) Refresh() error {
+	tokenSource.mutex.Lock()
+	defer tokenSource.mutex.Unlock()
+
+	_, err := tokenSource.refresh()
+	return err
+}
+
+// refresh reads token saved to file after authorization of user and refreshes it. It must be called with locked mutex.
+func (tokenSource *userTokenSource) refresh() (*oauth2.Token, error) {
+	if tok, err := tokenFromFile(tokenSource.path); err == nil {
+		tokenSource.token = tok
+	}
+
+	if tokenSource.token.RefreshToken == "" {
+		if tokenSource.token.Valid() {
+			return tokenSource.token, nil
+		}
+		return nil, ErrTokenExpired
+	}
+
+	// token without access token is refreshed by refresh token.
+	expired := *tokenSource.token
+	expired.AccessToken = ""
+	tok, err := tokenSource.config.TokenSource(context.Background(), &expired).Token()
 	if err != nil {
 		return nil, err
 	}
+	tokenSource.token = tok
+
+	err = saveToken(tokenSource.path, tok)
+	if err != nil {
+		log.Printf("Unable to save refreshed token: %v", err)
+	}
+	return tok, nil
+}
+
+// getServiceAccountClient reads key file of service account and returns client which gets tokens by it.
+func getServiceAccountClient(google models.Google) (*http.Client, oauth2.TokenSource, error) {
+	if google.ServiceAccountKeyFile == "" {
+		return nil, nil, errors.New("service account key file is not set")
+	}
+	b, err := ioutil.ReadFile(google.ServiceAccountKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read service account key file: %v", err)
+	}
+
+	config, err := googleoauth.JWTConfigFromJSON(b, scope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse service account key file to config: %v", err)
+	}
+	tokenSource := config.TokenSource(context.Background())
+	return oauth2.NewClient(context.Background(), tokenSource), tokenSource, nil
+}
+
+// getOAuthConfig reads credentials of OAuth client and prepares config.
+func getOAuthConfig(google models.Google) (*oauth2.Config, error) {
+	if google.Auth == AuthServiceAccount {
+		return nil, errors.New("google sheets are accessed by service account, authorization of user isn't needed")
+	}
+	b, err := ioutil.ReadFile(getCredentialsFile(google))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %v", err)
+	}
 
-	return config.Client(context.Background(), tok), nil
+	// If modifying these scopes, delete your previously saved token file.
+	config, err := googleoauth.ConfigFromJSON(b, scope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+	}
+	return config, nil
+}
+
+// getCredentialsFile returns path of file with credentials of OAuth client.
+func getCredentialsFile(google models.Google) string {
+	if google.CredentialsFile == "" {
+		return defaultCredentialsFile
+	}
+	return google.CredentialsFile
+}
+
+// getTokenFile returns path of file with token of user.
+func getTokenFile(google models.Google) string {
+	if google.TokenFile == "" {
+		return defaultTokenFile
+	}
+	return google.TokenFile
 }
 
 /* // Request a token from the web, then returns the retrieved token.
@@ -91,46 +505,58 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 	return tok
 }
 
-// NewService reads creadentials, prepares config, creates client and creates new service.
-func RequestAuthCodeURL() (string, error) {
-	b, err := ioutil.ReadFile("credentials.json")
+// RequestAuthCodeURL reads creadentials, prepares config and returns url where user gives access to google sheets.
+func RequestAuthCodeURL(google models.Google) (string, error) {
+	config, err := getOAuthConfig(google)
 	if err != nil {
-		return "", fmt.Errorf("unable to read client secret file: %v", err)
-	}
-
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets")
-	if err != nil {
-		return "", fmt.Errorf("unable to parse client secret file to config: %v", err)
+		return "", err
 	}
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	return authURL, nil
 }
 
 // AuthorizationCodeToToken gets auth code and try to exchange it into token.
-func AuthorizationCodeToToken(authCode string) error {
-	b, err := ioutil.ReadFile("credentials.json")
+func AuthorizationCodeToToken(google models.Google, authCode string) error {
+	config, err := getOAuthConfig(google)
 	if err != nil {
-		return fmt.Errorf("unable to read client secret file: %v", err)
+		return err
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets")
-	if err != nil {
-		return fmt.Errorf("unable to parse client secret file to config: %v", err)
-	}
-
-	// The file token.json stores the user's access and refresh tokens, and is
+	// The token file stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "token.json"
+	tokFile := getTokenFile(google)
 	tok, err := config.Exchange(context.TODO(), authCode)
 	if err != nil {
 		return fmt.Errorf("Unable to retrieve token from web: %v", err)
 	}
-	saveToken(tokFile, tok)
 
-	return nil
+	return saveToken(tokFile, tok)
+}
+
+// IsAuthError checks if error is returned because token or refresh token is expired or revoked, so user has to authorize bot again.
+// Other errors of token endpoint, e.g. when google is unavailable, are not auth errors, token is refreshed by the next request.
+func IsAuthError(err error) bool {
+	if errors.Is(err, ErrTokenExpired) {
+		return true
+	}
+	var retrieveError *oauth2.RetrieveError
+	if !errors.As(err, &retrieveError) {
+		return false
+	}
+	if retrieveError.Response != nil {
+		switch retrieveError.Response.StatusCode {
+		case http.StatusBadRequest, http.StatusUnauthorized:
+			return true
+		}
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(retrieveError.Body, &body) != nil {
+		return false
+	}
+	return body.Error == "invalid_grant" || body.Error == "unauthorized_client"
 }
 
 // Retrieves a token from a local file.
@@ -145,74 +571,368 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 	return tok, err
 }
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
+// Saves a token to a file path. Token is written to temporary file and then it replaces token file, so file is never half-written.
+func saveToken(path string, token *oauth2.Token) error {
 	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	data, err := json.Marshal(token)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		return fmt.Errorf("unable to cache oauth token: %v", err)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to cache oauth token: %v", err)
+	}
+	return os.Rename(tmpPath, path)
 }
 
 // NewService reads creadentials, prepares config, creates client and creates new service.
-func NewService() (*sheets.Service, error) {
+// Client is authenticated by service account or by token of user depending on auth in google section of app config.
+func NewService(google models.Google, opts ...option.ClientOption) (*sheets.Service, error) {
+	srv, _, err := newService(google, opts...)
+	return srv, err
+}
+
+// newService creates new service and returns function which checks that bot is still authenticated.
+func newService(google models.Google, opts ...option.ClientOption) (*sheets.Service, func() error, error) {
 	ctx := context.Background()
-	b, err := ioutil.ReadFile("credentials.json")
-	if err != nil {
-		return nil, fmt.Errorf("unable to read client secret file: %v", err)
-	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets")
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse client secret file to config: %v", err)
+	var client *http.Client
+	var checkAuth func() error
+	switch google.Auth {
+	case "", AuthOAuth:
+		config, err := getOAuthConfig(google)
+		if err != nil {
+			return nil, nil, err
+		}
+		var tokenSource *userTokenSource
+		client, tokenSource, err = getClient(config, getTokenFile(google))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get client: %v", err)
+		}
+		checkAuth = tokenSource.Refresh
+	case AuthServiceAccount:
+		var tokenSource oauth2.TokenSource
+		var err error
+		client, tokenSource, err = getServiceAccountClient(google)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to get client: %v", err)
+		}
+		checkAuth = func() error {
+			_, err := tokenSource.Token()
+			return err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown google auth %q, expected %q or %q", google.Auth, AuthOAuth, AuthServiceAccount)
 	}
-	client, err := getClient(config)
+
+	srv, err := sheets.NewService(ctx, append([]option.ClientOption{option.WithHTTPClient(client)}, opts...)...)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get client: %v", err)
+		return nil, nil, err
 	}
-
-	return sheets.NewService(ctx, option.WithHTTPClient(client))
+	return srv, checkAuth, nil
 }
 
 // SaveTripToShelter saves information about trip to google sheet.
 func (googleSheetService googleSheet) SaveTripToShelter(sheetName string, tripToShelter *models.TripToShelter) (*sheets.AppendValuesResponse, error) {
+	return googleSheetService.SaveTripsToShelter(sheetName, []*models.TripToShelter{tripToShelter})
+}
+
+// SaveTripsToShelter saves information about trips to google sheet by one request. Trips are saved to consecutive rows in the same order.
+// Values are placed under headers of columns in header row of the tab.
+func (googleSheetService googleSheet) SaveTripsToShelter(sheetName string, tripsToShelter []*models.TripToShelter) (*sheets.AppendValuesResponse, error) {
 	var vr sheets.ValueRange
-	now := time.Now()
-	tripToShelterInfo := []interface{}{
-		tripToShelter.Username,
-		tripToShelter.Shelter.Title,
-		tripToShelter.Date,
-		strconv.FormatBool(tripToShelter.IsFirstTrip),
-		strings.Join(tripToShelter.Purpose, ","),
-		tripToShelter.TripBy,
-		strings.Join(tripToShelter.HowYouKnowAboutUs, ","),
-		now.Format("02.01.2006 15:04:05"),
+	now := dates.Now()
+	header := googleSheetService.header(sheetName)
+	for _, tripToShelter := range tripsToShelter {
+		vr.Values = append(vr.Values, buildRow(googleSheetService.columns, header, tripToShelter, now))
 	}
-	vr.Values = append(vr.Values, tripToShelterInfo)
 
-	readRange := fmt.Sprintf("%s!A2:H", sheetName)
+	readRange := sheetRange(sheetName, "A2:"+columnName(len(header)-1))
 
-	return googleSheetService.Service.Spreadsheets.Values.Append(googleSheetService.SpreadsheetID, readRange, &vr).ValueInputOption("RAW").Do()
+	ctx, cancel := requestContext()
+	defer cancel()
+	return googleSheetService.Service.Spreadsheets.Values.Append(googleSheetService.SpreadsheetID, readRange, &vr).ValueInputOption("RAW").Context(ctx).Do()
 }
 
 // SaveTripToShelter saves information about trip in short format to System sheet to google sheet.
 func (googleSheetService googleSheet) SaveTripToShelterSystem(sheetName string, tripToShelter *models.TripToShelter) (*sheets.AppendValuesResponse, error) {
+	return googleSheetService.SaveTripsToShelterSystem(sheetName, []*models.TripToShelter{tripToShelter})
+}
+
+// SaveTripsToShelterSystem saves information about trips in short format to System sheet to google sheet by one request.
+func (googleSheetService googleSheet) SaveTripsToShelterSystem(sheetName string, tripsToShelter []*models.TripToShelter) (*sheets.AppendValuesResponse, error) {
 	var vr sheets.ValueRange
-	now := time.Now()
-	tripToShelterInfo := []interface{}{
-		tripToShelter.Username,
-		tripToShelter.Shelter.ShortTitle,
-		tripToShelter.Date,
-		now.Format("02.01.2006 15:04:05"),
+	now := dates.Now()
+	header := columnHeaders(googleSheetService.systemColumns)
+	for _, tripToShelter := range tripsToShelter {
+		tripToShelterInfo := make([]interface{}, 0, len(header))
+		for _, column := range googleSheetService.systemColumns {
+			tripToShelterInfo = append(tripToShelterInfo, formatValue(column, tripToShelter, now))
+		}
+		vr.Values = append(vr.Values, tripToShelterInfo)
 	}
-	vr.Values = append(vr.Values, tripToShelterInfo)
 
-	readRange := fmt.Sprintf("%s!A1:D", sheetName)
+	readRange := sheetRange(sheetName, "A1:"+columnName(len(header)-1))
 
-	return googleSheetService.Service.Spreadsheets.Values.Append(googleSheetService.SpreadsheetID, readRange, &vr).ValueInputOption("RAW").Do()
+	ctx, cancel := requestContext()
+	defer cancel()
+	return googleSheetService.Service.Spreadsheets.Values.Append(googleSheetService.SpreadsheetID, readRange, &vr).ValueInputOption("RAW").Context(ctx).Do()
+}
+
+// CheckLayout checks that layout of tabs set in app config is known.
+func CheckLayout(google models.Google) error {
+	switch google.Layout {
+	case "", LayoutShelter, LayoutSingle, LayoutTrip, LayoutMonth:
+		return nil
+	}
+	return fmt.Errorf("unknown layout \"%s\" of google sheet", google.Layout)
+}
+
+// SheetName returns name of tab where trip is saved by layout set in app config.
+func SheetName(google models.Google, tripToShelter *models.TripToShelter) (string, error) {
+	switch google.Layout {
+	case "", LayoutShelter:
+		return tripToShelter.Shelter.ShortTitle, nil
+	case LayoutSingle:
+		if google.Sheet == "" {
+			return defaultSingleSheet, nil
+		}
+		return google.Sheet, nil
+	case LayoutTrip, LayoutMonth:
+		date, err := parseTripDate(tripToShelter.Date)
+		if err != nil {
+			return "", err
+		}
+		if google.Layout == LayoutMonth {
+			return date.Format("01.2006"), nil
+		}
+		return date.Format("02.01.2006") + tripToShelter.Shelter.ShortTitle, nil
+	}
+	return "", CheckLayout(google)
+}
+
+// parseTripDate finds day of the trip in its date, e.g. "Сб 13.08.2022 11:00" => 13.08.2022.
+func parseTripDate(date string) (time.Time, error) {
+	for _, field := range strings.Fields(date) {
+		if day, err := time.Parse("02.01.2006", field); err == nil {
+			return day, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date of trip \"%s\" doesn't contain day", date)
+}
+
+// sheetRange returns range of cells of the tab, name of tab is quoted because it can start with digits, e.g. '13.08.2022Хаски'!A2:I.
+func sheetRange(sheetName string, cells string) string {
+	return fmt.Sprintf("'%s'!%s", strings.ReplaceAll(sheetName, "'", "''"), cells)
+}
+
+// SplitRowRanges splits range of several rows into ranges of every row, e.g. Хаски!A5:I6 => Хаски!A5:I5, Хаски!A6:I6.
+// It's used to find rows of trips saved by SaveTripsToShelter.
+func SplitRowRanges(updatedRange string) ([]string, error) {
+	exclamationPosition := strings.LastIndex(updatedRange, "!")
+	if exclamationPosition == -1 {
+		return nil, fmt.Errorf("range \"%s\" doesn't contain sheet name", updatedRange)
+	}
+	sheetName := updatedRange[:exclamationPosition]
+	cells := strings.Split(updatedRange[exclamationPosition+1:], ":")
+	if len(cells) == 1 {
+		cells = append(cells, cells[0])
+	}
+
+	firstColumn, firstRow, err := splitCell(cells[0])
+	if err != nil {
+		return nil, fmt.Errorf("range \"%s\" doesn't contain row number", updatedRange)
+	}
+	lastColumn, lastRow, err := splitCell(cells[1])
+	if err != nil || lastRow < firstRow {
+		return nil, fmt.Errorf("range \"%s\" doesn't contain row number", updatedRange)
+	}
+
+	var ranges []string
+	for row := firstRow; row <= lastRow; row++ {
+		ranges = append(ranges, fmt.Sprintf("%s!%s%d:%s%d", sheetName, firstColumn, row, lastColumn, row))
+	}
+	return ranges, nil
+}
+
+// splitCell splits cell into column and row, e.g. A5 => A, 5.
+func splitCell(cell string) (string, int, error) {
+	rowPosition := strings.IndexAny(cell, "0123456789")
+	if rowPosition == -1 {
+		return "", 0, fmt.Errorf("cell \"%s\" doesn't contain row number", cell)
+	}
+	row, err := strconv.Atoi(cell[rowPosition:])
+	if err != nil {
+		return "", 0, err
+	}
+	return cell[:rowPosition], row, nil
+}
+
+// UpdateTripStatus writes status to column of status of the row saved by SaveTripToShelter.
+// tripRange is updated range returned after saving trip, e.g. Хаски!A5:I5.
+func (googleSheetService googleSheet) UpdateTripStatus(tripRange string, status string) (*sheets.UpdateValuesResponse, error) {
+	sheetName, err := rangeSheetName(tripRange)
+	if err != nil {
+		return nil, err
+	}
+	statusIndex := fieldIndex(googleSheetService.columns, googleSheetService.header(unquoteSheetName(sheetName)), FieldStatus)
+	if statusIndex == -1 {
+		return nil, fmt.Errorf("tab %s doesn't have column of status", sheetName)
+	}
+	statusRange, err := getCellRange(tripRange, statusIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var vr sheets.ValueRange
+	vr.Values = append(vr.Values, []interface{}{status})
+
+	ctx, cancel := requestContext()
+	defer cancel()
+	return googleSheetService.Service.Spreadsheets.Values.Update(googleSheetService.SpreadsheetID, statusRange, &vr).ValueInputOption("RAW").Context(ctx).Do()
+}
+
+// GetTripStatuses reads rows saved by SaveTripToShelter and returns date and status of trips by ranges of their rows.
+// Header rows of tabs are read by the same request, so columns moved by coordinators are found.
+// Rows which are empty now are not returned.
+func (googleSheetService googleSheet) GetTripStatuses(tripRanges []string) (map[string]*models.TripSheetStatus, error) {
+	statuses := make(map[string]*models.TripSheetStatus)
+	for start := 0; start < len(tripRanges); {
+		// tabs of ranges of the request, their header rows are requested before ranges of trips.
+		var sheetNames []string
+		var ranges []string
+		for ; start < len(tripRanges); start++ {
+			sheetName, err := rangeSheetName(tripRanges[start])
+			if err != nil {
+				return nil, err
+			}
+			count := len(sheetNames) + len(ranges) + 1
+			isNewSheet := headerIndex(sheetNames, sheetName) == -1
+			if isNewSheet {
+				count++
+			}
+			if count > maxBatchGetRanges && len(ranges) > 0 {
+				break
+			}
+			if isNewSheet {
+				sheetNames = append(sheetNames, sheetName)
+			}
+			ranges = append(ranges, tripRanges[start])
+		}
+
+		var requestRanges []string
+		for _, sheetName := range sheetNames {
+			requestRanges = append(requestRanges, sheetName+"!1:1")
+		}
+		requestRanges = append(requestRanges, ranges...)
+
+		ctx, cancel := requestContext()
+		resp, err := googleSheetService.Service.Spreadsheets.Values.BatchGet(googleSheetService.SpreadsheetID).Ranges(requestRanges...).Context(ctx).Do()
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.ValueRanges) != len(requestRanges) {
+			return nil, fmt.Errorf("got %d ranges instead of %d", len(resp.ValueRanges), len(requestRanges))
+		}
+
+		// ranges in response can be formatted differently, e.g. with quoted sheet name, so they are matched by order.
+		headers := make(map[string][]string)
+		for i, sheetName := range sheetNames {
+			headers[sheetName] = googleSheetService.setHeader(unquoteSheetName(sheetName), resp.ValueRanges[i].Values)
+		}
+		for i, valueRange := range resp.ValueRanges[len(sheetNames):] {
+			if len(valueRange.Values) == 0 {
+				continue
+			}
+			sheetName, _ := rangeSheetName(ranges[i])
+			header := headers[sheetName]
+			row := valueRange.Values[0]
+			statuses[ranges[i]] = &models.TripSheetStatus{
+				Date:   getCell(row, fieldIndex(googleSheetService.columns, header, FieldDate)),
+				Status: getCell(row, fieldIndex(googleSheetService.columns, header, FieldStatus)),
+			}
+		}
+	}
+
+	return statuses, nil
+}
+
+// getCell returns trimmed value of the cell of the row or empty string if row is shorter.
+func getCell(row []interface{}, index int) string {
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprint(row[index]))
+}
+
+// rangeSheetName returns name of tab of the range as it's written in the range, e.g. 'Хаски'!A5:I5 => 'Хаски'.
+func rangeSheetName(tripRange string) (string, error) {
+	exclamationPosition := strings.LastIndex(tripRange, "!")
+	if exclamationPosition == -1 {
+		return "", fmt.Errorf("range \"%s\" doesn't contain sheet name", tripRange)
+	}
+	return tripRange[:exclamationPosition], nil
+}
+
+// unquoteSheetName returns name of tab written in range without quotes, e.g. 'Хаски' => Хаски.
+func unquoteSheetName(sheetName string) string {
+	if len(sheetName) >= 2 && strings.HasPrefix(sheetName, "'") && strings.HasSuffix(sheetName, "'") {
+		return strings.ReplaceAll(sheetName[1:len(sheetName)-1], "''", "'")
+	}
+	return sheetName
+}
+
+// getCellRange returns range of cell of the column by range of trip row, e.g. Хаски!A5:I5, 8 => Хаски!I5.
+func getCellRange(tripRange string, index int) (string, error) {
+	sheetName, err := rangeSheetName(tripRange)
+	if err != nil {
+		return "", err
+	}
+	firstCell := strings.Split(tripRange[len(sheetName)+1:], ":")[0]
+	_, row, err := splitCell(firstCell)
+	if err != nil {
+		return "", fmt.Errorf("range \"%s\" doesn't contain row number", tripRange)
+	}
+
+	return fmt.Sprintf("%s!%s%d", sheetName, columnName(index), row), nil
+}
+
+// header returns header row of the tab. It's read from google sheet once, headers of columns are used if it can't be read.
+func (googleSheetService googleSheet) header(sheetName string) []string {
+	googleSheetService.headers.mutex.Lock()
+	header, ok := googleSheetService.headers.tabs[sheetName]
+	googleSheetService.headers.mutex.Unlock()
+	if ok {
+		return header
+	}
+
+	ctx, cancel := requestContext()
+	defer cancel()
+	resp, err := googleSheetService.Service.Spreadsheets.Values.Get(googleSheetService.SpreadsheetID, sheetRange(sheetName, "1:1")).Context(ctx).Do()
+	if err != nil {
+		log.Printf("Unable to read header row of tab %s: %v", sheetName, err)
+		return columnHeaders(googleSheetService.columns)
+	}
+	return googleSheetService.setHeader(sheetName, resp.Values)
+}
+
+// setHeader remembers header row of the tab read from google sheet and returns it.
+// Tab without header row isn't remembered, headers of columns are returned for it.
+func (googleSheetService googleSheet) setHeader(sheetName string, values [][]interface{}) []string {
+	if len(values) == 0 || len(values[0]) == 0 {
+		return columnHeaders(googleSheetService.columns)
+	}
+	var header []string
+	for i := range values[0] {
+		header = append(header, getCell(values[0], i))
+	}
+
+	googleSheetService.headers.mutex.Lock()
+	googleSheetService.headers.tabs[sheetName] = header
+	googleSheetService.headers.mutex.Unlock()
+	return header
 }
 
 // CreateSheet creates sheet.
@@ -229,52 +949,106 @@ func (googleSheetService googleSheet) CreateSheet(sheetName string) (*sheets.Bat
 		Requests: []*sheets.Request{&req},
 	}
 
-	return googleSheetService.Service.Spreadsheets.BatchUpdate(googleSheetService.SpreadsheetID, rbb).Context(context.Background()).Do()
+	ctx, cancel := requestContext()
+	defer cancel()
+	return googleSheetService.Service.Spreadsheets.BatchUpdate(googleSheetService.SpreadsheetID, rbb).Context(ctx).Do()
 }
 
-// AddSheetHeaders adds headers for new sheet.
+// AddSheetHeaders adds headers of columns to new sheet.
 func (googleSheetService googleSheet) AddSheetHeaders(sheetName string) (*sheets.AppendValuesResponse, error) {
-	//User	Приют	Дата	Первый раз	Цели	Как добирается	Откуда узнал	Дата регистрации на выезд (UTC +8)	Статус
+	headers := columnHeaders(googleSheetService.columns)
+	resp, err := googleSheetService.addHeaders(sheetName, nil, headers)
+	if err != nil {
+		return nil, err
+	}
+	return &sheets.AppendValuesResponse{ServerResponse: resp.ServerResponse, Updates: resp}, nil
+}
+
+// addHeaders writes headers to header row of the tab after existing headers and remembers new header row.
+func (googleSheetService googleSheet) addHeaders(sheetName string, header []string, headers []string) (*sheets.UpdateValuesResponse, error) {
 	var vr sheets.ValueRange
-	headers := []interface{}{
-		"User",
-		"Приют",
-		"Дата",
-		"Первый раз",
-		"Цели",
-		"Как добирается",
-		"Откуда узнал",
-		"Дата регистрации на выезд (UTC +8)",
-		"Статус",
+	vr.Values = append(vr.Values, toValues(headers))
+
+	readRange := sheetRange(sheetName, fmt.Sprintf("%s1:%s1", columnName(len(header)), columnName(len(header)+len(headers)-1)))
+
+	ctx, cancel := requestContext()
+	defer cancel()
+	resp, err := googleSheetService.Service.Spreadsheets.Values.Update(googleSheetService.SpreadsheetID, readRange, &vr).ValueInputOption("RAW").Context(ctx).Do()
+	if err != nil {
+		return nil, err
 	}
-	vr.Values = append(vr.Values, headers)
+	googleSheetService.setHeader(sheetName, [][]interface{}{toValues(append(append([]string{}, header...), headers...))})
+	return resp, nil
+}
 
-	readRange := fmt.Sprintf("%s!A1:I", sheetName)
+// requestContext returns context of one request to google sheets which is canceled after requestTimeout.
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), requestTimeout)
+}
 
-	return googleSheetService.Service.Spreadsheets.Values.Append(googleSheetService.SpreadsheetID, readRange, &vr).ValueInputOption("RAW").Do()
+// toValues converts strings to values of row.
+func toValues(list []string) []interface{} {
+	values := make([]interface{}, 0, len(list))
+	for _, v := range list {
+		values = append(values, v)
+	}
+	return values
+}
+
+// CheckAuth gets new token to check that bot is still authenticated in google sheets, e.g. refresh token isn't revoked.
+func (googleSheetService googleSheet) CheckAuth() error {
+	if googleSheetService.checkAuth == nil {
+		return nil
+	}
+	return googleSheetService.checkAuth()
 }
 
 // HasSheet checks is sheet exist
 func (googleSheetService googleSheet) HasSheet(sheetName string) bool {
-	_, err := googleSheetService.Service.Spreadsheets.Values.Get(googleSheetService.SpreadsheetID, fmt.Sprintf("%s!A1:B1", sheetName)).Do()
+	ctx, cancel := requestContext()
+	defer cancel()
+	_, err := googleSheetService.Service.Spreadsheets.Values.Get(googleSheetService.SpreadsheetID, sheetRange(sheetName, "A1:B1")).Context(ctx).Do()
 
 	return err == nil
 }
 
-// PrepareSheetForSavingData check if sheet exists. If no create it and headers
+// PrepareSheetForSavingData creates sheet with headers if it doesn't exist.
+// If sheet exists it checks its header row and adds headers of columns which it doesn't have, e.g. new question.
 func (googleSheetService googleSheet) PrepareSheetForSavingData(sheetName string) error {
-	if !googleSheetService.HasSheet(sheetName) {
-		_, err := googleSheetService.CreateSheet(sheetName)
+	ctx, cancel := requestContext()
+	defer cancel()
+	resp, err := googleSheetService.Service.Spreadsheets.Values.Get(googleSheetService.SpreadsheetID, sheetRange(sheetName, "1:1")).Context(ctx).Do()
+	if err != nil {
+		_, err = googleSheetService.CreateSheet(sheetName)
 		if err != nil {
 			return err
 		}
 		_, err = googleSheetService.AddSheetHeaders(sheetName)
-		if err != nil {
-			return err
+		return err
+	}
+
+	var header []string
+	if len(resp.Values) > 0 {
+		for i := range resp.Values[0] {
+			header = append(header, getCell(resp.Values[0], i))
+		}
+	}
+	var missingHeaders []string
+	for _, column := range googleSheetService.columns {
+		if columnIndex(header, column) == -1 {
+			missingHeaders = append(missingHeaders, column.Header)
 		}
 	}
+	if len(missingHeaders) == 0 {
+		googleSheetService.setHeader(sheetName, resp.Values)
+		return nil
+	}
 
-	return nil
+	if len(header) > 0 {
+		log.Printf("Tab %s doesn't have columns %s, they are added", sheetName, strings.Join(missingHeaders, ", "))
+	}
+	_, err = googleSheetService.addHeaders(sheetName, header, missingHeaders)
+	return err
 }
 
 /* func readSheet() {
@@ -0,0 +1,89 @@
+// Package ics builds calendars in iCalendar format (RFC 5545).
+package ics
+
+import (
+	"strings"
+	"time"
+)
+
+// maxLineLength is max length of content line in octets, longer lines are folded.
+const maxLineLength = 75
+
+// dateTimeFormat is format of date with time in UTC.
+const dateTimeFormat = "20060102T150405Z"
+
+// Event represents calendar event.
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	URL         string
+	Start       time.Time
+	End         time.Time
+}
+
+// Calendar builds calendar with given name and events. now is used as creation time of events.
+func Calendar(name string, events []Event, now time.Time) []byte {
+	var builder strings.Builder
+
+	writeLine(&builder, "BEGIN:VCALENDAR")
+	writeLine(&builder, "VERSION:2.0")
+	writeLine(&builder, "PRODID:-//walkthedog//walkthedog_bot//RU")
+	writeLine(&builder, "CALSCALE:GREGORIAN")
+	writeLine(&builder, "METHOD:PUBLISH")
+	if name != "" {
+		writeLine(&builder, "X-WR-CALNAME:"+escape(name))
+	}
+	for _, event := range events {
+		writeLine(&builder, "BEGIN:VEVENT")
+		writeLine(&builder, "UID:"+event.UID)
+		writeLine(&builder, "DTSTAMP:"+now.UTC().Format(dateTimeFormat))
+		writeLine(&builder, "DTSTART:"+event.Start.UTC().Format(dateTimeFormat))
+		if !event.End.IsZero() && event.End.After(event.Start) {
+			writeLine(&builder, "DTEND:"+event.End.UTC().Format(dateTimeFormat))
+		}
+		writeLine(&builder, "SUMMARY:"+escape(event.Summary))
+		if event.Description != "" {
+			writeLine(&builder, "DESCRIPTION:"+escape(event.Description))
+		}
+		if event.Location != "" {
+			writeLine(&builder, "LOCATION:"+escape(event.Location))
+		}
+		if event.URL != "" {
+			writeLine(&builder, "URL:"+event.URL)
+		}
+		writeLine(&builder, "END:VEVENT")
+	}
+	writeLine(&builder, "END:VCALENDAR")
+
+	return []byte(builder.String())
+}
+
+// escape escapes special characters of text value.
+func escape(text string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	)
+	return replacer.Replace(text)
+}
+
+// writeLine writes content line folding it by maxLineLength octets without splitting multibyte characters.
+func writeLine(builder *strings.Builder, line string) {
+	lineLength := 0
+	for _, r := range line {
+		runeLength := len(string(r))
+		if lineLength+runeLength > maxLineLength {
+			builder.WriteString("\r\n ")
+			// folded line starts with space which is counted too.
+			lineLength = 1
+		}
+		builder.WriteRune(r)
+		lineLength += runeLength
+	}
+	builder.WriteString("\r\n")
+}
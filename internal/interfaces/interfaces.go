@@ -12,6 +12,7 @@ import (
 type TelegramBot interface {
 	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
 	GetUpdatesChan(config tgbotapi.UpdateConfig) tgbotapi.UpdatesChannel
+	StopReceivingUpdates()
 	GetMe() (tgbotapi.User, error)
 }
 
@@ -19,8 +20,22 @@ type TelegramBot interface {
 type GoogleSheetsService interface {
 	SaveTripToShelter(sheetName string, tripToShelter *models.TripToShelter) (*sheets.AppendValuesResponse, error)
 	SaveTripToShelterSystem(sheetName string, tripToShelter *models.TripToShelter) (*sheets.AppendValuesResponse, error)
+	SaveTripsToShelter(sheetName string, tripsToShelter []*models.TripToShelter) (*sheets.AppendValuesResponse, error)
+	SaveTripsToShelterSystem(sheetName string, tripsToShelter []*models.TripToShelter) (*sheets.AppendValuesResponse, error)
+	UpdateTripStatus(tripRange string, status string) (*sheets.UpdateValuesResponse, error)
+	GetTripStatuses(tripRanges []string) (map[string]*models.TripSheetStatus, error)
 	CreateSheet(sheetName string) (*sheets.BatchUpdateSpreadsheetResponse, error)
 	AddSheetHeaders(sheetName string) (*sheets.AppendValuesResponse, error)
 	HasSheet(sheetName string) bool
 	PrepareSheetForSavingData(sheetName string) error
+	CheckAuth() error
+}
+
+// TripRepository stores registrations to shelters and history of their changes.
+// Registration is identified by its ID, so cancelled registration and new one to the same trip are kept apart.
+type TripRepository interface {
+	Save(tripToShelter *models.TripToShelter) error
+	List() ([]*models.TripToShelter, error)
+	ListByChat(chatId int64) ([]*models.TripToShelter, error)
+	History(tripToShelter *models.TripToShelter) ([]*models.TripEvent, error)
 }
@@ -3,6 +3,7 @@ package mocks
 
 import (
 	"fmt"
+	"sync"
 	"walkthedog/internal/models"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -12,6 +13,7 @@ import (
 
 // MockTelegramBot implements TelegramBot interface for testing
 type MockTelegramBot struct {
+	mutex        sync.Mutex
 	SentMessages []tgbotapi.Chattable
 	SendError    error
 	UpdatesChan  chan tgbotapi.Update
@@ -29,11 +31,14 @@ func (m *MockTelegramBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
 		return tgbotapi.Message{}, m.SendError
 	}
 
+	// updates of different chats are sent in parallel.
+	m.mutex.Lock()
 	m.SentMessages = append(m.SentMessages, c)
+	var messageID int = len(m.SentMessages)
+	m.mutex.Unlock()
 
 	// Return a mock message based on the input type
 	var chatID int64 = 12345
-	var messageID int = len(m.SentMessages)
 
 	if msg, ok := c.(tgbotapi.MessageConfig); ok {
 		chatID = msg.ChatID
@@ -64,6 +69,11 @@ func (m *MockTelegramBot) GetUpdatesChan(config tgbotapi.UpdateConfig) tgbotapi.
 	return tgbotapi.UpdatesChannel(m.UpdatesChan)
 }
 
+// StopReceivingUpdates closes updates channel like real bot does after shutdown
+func (m *MockTelegramBot) StopReceivingUpdates() {
+	close(m.UpdatesChan)
+}
+
 func (m *MockTelegramBot) GetMe() (tgbotapi.User, error) {
 	return tgbotapi.User{
 		ID:        123456789,
@@ -79,17 +89,30 @@ func (m *MockTelegramBot) AddUpdate(update tgbotapi.Update) {
 
 // Helper method to get the number of sent messages
 func (m *MockTelegramBot) GetSentMessageCount() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return len(m.SentMessages)
 }
 
 // MockGoogleSheetsService implements GoogleSheetsService interface for testing
 type MockGoogleSheetsService struct {
 	SaveError         error
+	SystemSaveError   error
 	CreateSheetError  error
 	HasSheetResponse  bool
 	SavedTrips        []*models.TripToShelter
 	CreatedSheets     []string
 	SheetsWithHeaders []string
+	UpdatedStatuses   map[string]string
+	SheetStatuses     map[string]*models.TripSheetStatus
+	GetStatusesError  error
+	// SheetSaveErrors are errors of saving to particular sheets.
+	SheetSaveErrors map[string]error
+	// AppendRequests is count of requests appending rows.
+	AppendRequests int
+	AuthError      error
+	// SaveGate blocks saving of trips to tabs until it's closed if it's set.
+	SaveGate chan struct{}
 }
 
 func NewMockGoogleSheetsService() *MockGoogleSheetsService {
@@ -98,13 +121,20 @@ func NewMockGoogleSheetsService() *MockGoogleSheetsService {
 		SavedTrips:        make([]*models.TripToShelter, 0),
 		CreatedSheets:     make([]string, 0),
 		SheetsWithHeaders: make([]string, 0),
+		UpdatedStatuses:   make(map[string]string),
+		SheetStatuses:     make(map[string]*models.TripSheetStatus),
+		SheetSaveErrors:   make(map[string]error),
 	}
 }
 
 func (m *MockGoogleSheetsService) SaveTripToShelter(sheetName string, tripToShelter *models.TripToShelter) (*sheets.AppendValuesResponse, error) {
+	m.AppendRequests++
 	if m.SaveError != nil {
 		return nil, m.SaveError
 	}
+	if m.SheetSaveErrors[sheetName] != nil {
+		return nil, m.SheetSaveErrors[sheetName]
+	}
 
 	m.SavedTrips = append(m.SavedTrips, tripToShelter)
 
@@ -112,13 +142,20 @@ func (m *MockGoogleSheetsService) SaveTripToShelter(sheetName string, tripToShel
 		ServerResponse: googleapi.ServerResponse{
 			HTTPStatusCode: 200,
 		},
+		Updates: &sheets.UpdateValuesResponse{
+			UpdatedRange: fmt.Sprintf("%s!A%d:I%d", sheetName, len(m.SavedTrips)+1, len(m.SavedTrips)+1),
+		},
 	}, nil
 }
 
 func (m *MockGoogleSheetsService) SaveTripToShelterSystem(sheetName string, tripToShelter *models.TripToShelter) (*sheets.AppendValuesResponse, error) {
+	m.AppendRequests++
 	if m.SaveError != nil {
 		return nil, m.SaveError
 	}
+	if m.SystemSaveError != nil {
+		return nil, m.SystemSaveError
+	}
 
 	m.SavedTrips = append(m.SavedTrips, tripToShelter)
 
@@ -129,6 +166,77 @@ func (m *MockGoogleSheetsService) SaveTripToShelterSystem(sheetName string, trip
 	}, nil
 }
 
+func (m *MockGoogleSheetsService) SaveTripsToShelter(sheetName string, tripsToShelter []*models.TripToShelter) (*sheets.AppendValuesResponse, error) {
+	if m.SaveGate != nil {
+		<-m.SaveGate
+	}
+	m.AppendRequests++
+	if m.SaveError != nil {
+		return nil, m.SaveError
+	}
+	if m.SheetSaveErrors[sheetName] != nil {
+		return nil, m.SheetSaveErrors[sheetName]
+	}
+
+	firstRow := len(m.SavedTrips) + 2
+	m.SavedTrips = append(m.SavedTrips, tripsToShelter...)
+
+	return &sheets.AppendValuesResponse{
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: 200,
+		},
+		Updates: &sheets.UpdateValuesResponse{
+			UpdatedRange: fmt.Sprintf("%s!A%d:I%d", sheetName, firstRow, len(m.SavedTrips)+1),
+		},
+	}, nil
+}
+
+func (m *MockGoogleSheetsService) SaveTripsToShelterSystem(sheetName string, tripsToShelter []*models.TripToShelter) (*sheets.AppendValuesResponse, error) {
+	m.AppendRequests++
+	if m.SaveError != nil {
+		return nil, m.SaveError
+	}
+	if m.SystemSaveError != nil {
+		return nil, m.SystemSaveError
+	}
+
+	m.SavedTrips = append(m.SavedTrips, tripsToShelter...)
+
+	return &sheets.AppendValuesResponse{
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: 200,
+		},
+	}, nil
+}
+
+func (m *MockGoogleSheetsService) UpdateTripStatus(tripRange string, status string) (*sheets.UpdateValuesResponse, error) {
+	if m.SaveError != nil {
+		return nil, m.SaveError
+	}
+
+	m.UpdatedStatuses[tripRange] = status
+
+	return &sheets.UpdateValuesResponse{
+		ServerResponse: googleapi.ServerResponse{
+			HTTPStatusCode: 200,
+		},
+	}, nil
+}
+
+func (m *MockGoogleSheetsService) GetTripStatuses(tripRanges []string) (map[string]*models.TripSheetStatus, error) {
+	if m.GetStatusesError != nil {
+		return nil, m.GetStatusesError
+	}
+
+	statuses := make(map[string]*models.TripSheetStatus)
+	for _, tripRange := range tripRanges {
+		if status, ok := m.SheetStatuses[tripRange]; ok {
+			statuses[tripRange] = status
+		}
+	}
+	return statuses, nil
+}
+
 func (m *MockGoogleSheetsService) CreateSheet(sheetName string) (*sheets.BatchUpdateSpreadsheetResponse, error) {
 	if m.CreateSheetError != nil {
 		return nil, m.CreateSheetError
@@ -167,6 +275,10 @@ func (m *MockGoogleSheetsService) PrepareSheetForSavingData(sheetName string) er
 	return nil
 }
 
+func (m *MockGoogleSheetsService) CheckAuth() error {
+	return m.AuthError
+}
+
 // Helper methods for testing
 func (m *MockGoogleSheetsService) GetSavedTripsCount() int {
 	return len(m.SavedTrips)
@@ -180,6 +292,10 @@ func (m *MockGoogleSheetsService) SetSaveError(err error) {
 	m.SaveError = err
 }
 
+func (m *MockGoogleSheetsService) SetSystemSaveError(err error) {
+	m.SystemSaveError = err
+}
+
 func (m *MockGoogleSheetsService) SetCreateSheetError(err error) {
 	m.CreateSheetError = err
 }
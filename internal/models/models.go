@@ -1,6 +1,8 @@
 // Package models contains models are used in project
 package models
 
+import "time"
+
 // Shelter represent shelter information
 type Shelter struct {
 	ID          string          `yaml:"id"`
@@ -11,22 +13,51 @@ type Shelter struct {
 	ShortTitle  string          `yaml:"short_title"`
 	Link        string          `yaml:"link"`
 	Guide       string          `yaml:"guide"`
+	Description string          `yaml:"description"`
 	PeopleLimit int32           `yaml:"people_limit"`
 	Schedule    ShelterSchedule `yaml:"schedule"`
 }
 
-// ShelterSchedule represents trips shedule to shelters
+// ShelterSchedule represents trips shedule to shelters.
+// Details is used by "regularly" type and contains pairs of week number (-1 means the last week) and day of week.
+// Weekdays and DaysAhead are used by "everyday" type: Weekdays limits available days of week
+// (1 - Monday ... 7 - Sunday, empty means every day) and DaysAhead sets how many days starting from today are open for booking.
+// StartDate and Every are used by "weekly" type: trips are every N weeks starting from the date, DaysAhead sets booking horizon.
+// Dates is used by "dates" type and contains list of concrete trip dates agreed with shelter.
+// ValidFrom and ValidTo limit period of trips for all types, e.g. "01.05" and "30.09" for trips from May till September every year.
+// RegistrationCutoff sets how long before start of the trip registration closes, e.g. "24h". Empty means global default.
 type ShelterSchedule struct {
-	Type            string   `yaml:"type"`
-	Details         [][]int  `yaml:"details"`
-	DatesExceptions []string `yaml:"dates_exceptions"`
-	TimeStart       string   `yaml:"time_start"`
-	TimeEnd         string   `yaml:"time_end"`
+	Type               string        `yaml:"type"`
+	Details            [][]int       `yaml:"details"`
+	Weekdays           []int         `yaml:"weekdays"`
+	DaysAhead          int           `yaml:"days_ahead"`
+	StartDate          string        `yaml:"start_date"`
+	Every              int           `yaml:"every"`
+	Dates              []ShelterDate `yaml:"dates"`
+	DatesExceptions    []string      `yaml:"dates_exceptions"`
+	ValidFrom          string        `yaml:"valid_from"`
+	ValidTo            string        `yaml:"valid_to"`
+	TimeStart          string        `yaml:"time_start"`
+	TimeEnd            string        `yaml:"time_end"`
+	RegistrationCutoff string        `yaml:"registration_cutoff"`
+}
+
+// ShelterDate represents one-off trip date. Empty time and zero people limit mean that values of shelter are used.
+type ShelterDate struct {
+	Date        string `yaml:"date"`
+	TimeStart   string `yaml:"time_start"`
+	TimeEnd     string `yaml:"time_end"`
+	PeopleLimit int32  `yaml:"people_limit"`
 }
 
 // TripToShelter represents all important information about user's trip to shelter.
+// SheetRange stores range of the row where trip was saved in google sheet, it's used to update trip status.
+// RegisteredAt is time when user finished registration, it's written to google sheet.
+// Waitlisted is true while trip is in the waitlist, its status can be changed by coordinator meanwhile.
 type TripToShelter struct {
 	ID                string
+	TripKey           string
+	ChatId            int64
 	Username          string
 	Shelter           *Shelter
 	Date              string
@@ -34,13 +65,59 @@ type TripToShelter struct {
 	Purpose           []string
 	TripBy            string
 	HowYouKnowAboutUs []string
+	Status            string
+	Waitlisted        bool
+	SheetRange        string
+	RegisteredAt      time.Time
+}
+
+// TripSheetStatus represents date and status of trip in google sheet, they can be changed there by coordinators.
+type TripSheetStatus struct {
+	Date   string
+	Status string
+}
+
+// Reminder represents message about upcoming trip which should be sent to user at SendAt time.
+type Reminder struct {
+	TripToShelter TripToShelter
+	DaysBefore    int
+	SendAt        time.Time
 }
 
 // State represents state of chat with user
 type State struct {
-	ChatId        int64
-	LastMessage   string
-	TripToShelter *TripToShelter
+	ChatId         int64
+	LastMessage    string
+	TripToShelter  *TripToShelter
+	CreatedAt      time.Time
+	LastActivityAt time.Time
+}
+
+// Poll represents poll sent to the chat, answer to the poll doesn't contain chat id.
+type Poll struct {
+	ChatId    int64
+	CreatedAt time.Time
+}
+
+// OutboxEntry represents pending write of trip to google sheet.
+// MainSaved and SystemSaved are set when trip is saved to shelter's and system tab, so they are not written twice.
+type OutboxEntry struct {
+	ID            string
+	Kind          string
+	TripToShelter TripToShelter
+	MainSaved     bool
+	SystemSaved   bool
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// TripEvent represents change of registration to shelter: registration, status change or update of other fields.
+// Trip contains registration as it was after the change.
+type TripEvent struct {
+	Type string
+	Time time.Time
+	Trip TripToShelter
 }
 
 type TelegramConfig struct {
@@ -55,10 +132,45 @@ type Administration struct {
 	Admin string `yaml:"admin"`
 }
 type Google struct {
-	SpreadsheetID string `yaml:"spreadsheet_id"`
+	SpreadsheetID         string   `yaml:"spreadsheet_id"`
+	SyncInterval          string   `yaml:"sync_interval"`
+	Auth                  string   `yaml:"auth"`
+	CredentialsFile       string   `yaml:"credentials_file"`
+	TokenFile             string   `yaml:"token_file"`
+	ServiceAccountKeyFile string   `yaml:"service_account_key_file"`
+	Layout                string   `yaml:"layout"`
+	Sheet                 string   `yaml:"sheet"`
+	Columns               []Column `yaml:"columns"`
+	SystemColumns         []Column `yaml:"system_columns"`
+}
+
+// Column is column of google sheet: its header, field of trip which is written to it and how value of field is formatted.
+// Aliases are other headers of the column in existing tabs, e.g. header before it was renamed.
+type Column struct {
+	Header  string   `yaml:"header"`
+	Aliases []string `yaml:"aliases"`
+	Field   string   `yaml:"field"`
+	Format  string   `yaml:"format"`
+}
+type Reminders struct {
+	DaysBefore []int `yaml:"days_before"`
+}
+type Calendar struct {
+	Address string `yaml:"address"`
+}
+type Registration struct {
+	Cutoff string `yaml:"cutoff"`
+}
+type Sessions struct {
+	Timeout string `yaml:"timeout"`
 }
 type ConfigFile struct {
+	Timezone            string               `yaml:"timezone"`
 	TelegramEnvironment *TelegramEnvironment `yaml:"telegram"`
 	Administration      *Administration      `yaml:"administration"`
 	Google              *Google              `yaml:"google"`
+	Reminders           *Reminders           `yaml:"reminders"`
+	Calendar            *Calendar            `yaml:"calendar"`
+	Registration        *Registration        `yaml:"registration"`
+	Sessions            *Sessions            `yaml:"sessions"`
 }
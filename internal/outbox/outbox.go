@@ -0,0 +1,176 @@
+// Package outbox stores pending writes to Google Sheets in a file, so they are retried until they succeed.
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"walkthedog/internal/models"
+)
+
+// Kinds of outbox entries.
+const (
+	// KindAppend appends trip to shelter's and system tab.
+	KindAppend = "append"
+	// KindStatus updates status of trip in the row where trip was saved.
+	KindStatus = "status"
+)
+
+// minBackoff and maxBackoff limit delay before the next attempt to write entry.
+const (
+	minBackoff = time.Minute
+	maxBackoff = time.Hour
+)
+
+// Store keeps pending entries in memory and saves them to file after every change.
+type Store struct {
+	mutex   sync.Mutex
+	path    string
+	entries []*models.OutboxEntry
+}
+
+// NewStore creates store and loads pending entries from file if it exists.
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+	if err := json.Unmarshal(data, &store.entries); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Add adds entry to the end of the queue and saves queue to file.
+func (store *Store) Add(entry *models.OutboxEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if entry.ID == "" {
+		entry.ID = fmt.Sprintf("%d_%d", time.Now().UnixNano(), entry.TripToShelter.ChatId)
+	}
+	store.entries = append(store.entries, entry)
+	return store.save()
+}
+
+// Due returns entries which should be written at given time in order they were added.
+func (store *Store) Due(now time.Time) []*models.OutboxEntry {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var due []*models.OutboxEntry
+	for _, v := range store.entries {
+		if !v.NextAttemptAt.After(now) {
+			due = append(due, v)
+		}
+	}
+	return due
+}
+
+// All returns all pending entries in order they were added.
+func (store *Store) All() []*models.OutboxEntry {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return append([]*models.OutboxEntry(nil), store.entries...)
+}
+
+// Find returns the first pending entry of given kind which satisfies the condition or nil.
+func (store *Store) Find(kind string, match func(tripToShelter *models.TripToShelter) bool) *models.OutboxEntry {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for _, v := range store.entries {
+		if v.Kind == kind && match(&v.TripToShelter) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Update saves changes of entry to file, e.g. when part of it was written.
+func (store *Store) Update(entry *models.OutboxEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.save()
+}
+
+// Fail increases count of attempts of entry, postpones the next attempt and saves changes to file.
+func (store *Store) Fail(entry *models.OutboxEntry, now time.Time, err error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	entry.Attempts++
+	entry.NextAttemptAt = now.Add(Backoff(entry.Attempts))
+	entry.LastError = err.Error()
+	return store.save()
+}
+
+// Remove removes written entry and saves changes to file.
+func (store *Store) Remove(entry *models.OutboxEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for i, v := range store.entries {
+		if v == entry {
+			store.entries = append(store.entries[:i], store.entries[i+1:]...)
+			return store.save()
+		}
+	}
+	return nil
+}
+
+// Len returns count of pending entries.
+func (store *Store) Len() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return len(store.entries)
+}
+
+// Backoff returns delay before the next attempt after given count of failed attempts.
+// Delay is doubled after every attempt starting from one minute up to one hour.
+func Backoff(attempts int) time.Duration {
+	backoff := minBackoff
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+// save writes entries to temporary file and then replaces store file by it, so file is never half-written.
+func (store *Store) save() error {
+	data, err := json.Marshal(store.entries)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(store.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := store.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, store.path)
+}
@@ -0,0 +1,125 @@
+// Package reminder stores reminders about trips to shelters in a file, so they survive restarts.
+package reminder
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"walkthedog/internal/models"
+)
+
+// Store keeps scheduled reminders in memory and saves them to file after every change.
+type Store struct {
+	mutex     sync.Mutex
+	path      string
+	reminders []*models.Reminder
+}
+
+// NewStore creates store and loads reminders from file if it exists.
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+	if err := json.Unmarshal(data, &store.reminders); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Add adds reminders and saves them to file.
+func (store *Store) Add(reminders ...*models.Reminder) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.reminders = append(store.reminders, reminders...)
+	return store.save()
+}
+
+// Due returns reminders which should be sent at given time sorted by sending time.
+func (store *Store) Due(now time.Time) []*models.Reminder {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var due []*models.Reminder
+	for _, v := range store.reminders {
+		if !v.SendAt.After(now) {
+			due = append(due, v)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].SendAt.Before(due[j].SendAt)
+	})
+	return due
+}
+
+// Remove removes sent reminder and saves changes to file.
+func (store *Store) Remove(reminder *models.Reminder) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for i, v := range store.reminders {
+		if v == reminder {
+			store.reminders = append(store.reminders[:i], store.reminders[i+1:]...)
+			return store.save()
+		}
+	}
+	return nil
+}
+
+// RemoveByTrip removes all reminders about trip of the chat to shelter on the date and saves changes to file.
+func (store *Store) RemoveByTrip(chatId int64, shelterId string, date string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var reminders []*models.Reminder
+	for _, v := range store.reminders {
+		if v.TripToShelter.ChatId == chatId && v.TripToShelter.Shelter.ID == shelterId && v.TripToShelter.Date == date {
+			continue
+		}
+		reminders = append(reminders, v)
+	}
+	store.reminders = reminders
+	return store.save()
+}
+
+// Len returns count of scheduled reminders.
+func (store *Store) Len() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return len(store.reminders)
+}
+
+// save writes reminders to temporary file and then replaces store file by it, so file is never half-written.
+func (store *Store) save() error {
+	data, err := json.Marshal(store.reminders)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(store.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := store.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, store.path)
+}
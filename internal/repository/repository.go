@@ -0,0 +1,200 @@
+// Package repository stores registrations to shelters in a local file which is the system of record for them.
+package repository
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"walkthedog/internal/interfaces"
+	"walkthedog/internal/models"
+)
+
+// Types of trip events.
+const (
+	EventRegistered    = "registered"
+	EventStatusChanged = "status_changed"
+	EventUpdated       = "updated"
+)
+
+// fileTripRepository keeps registrations in memory and appends every change to the file as a line of JSON,
+// so file contains full history of registrations and it's never rewritten.
+type fileTripRepository struct {
+	mutex   sync.Mutex
+	path    string
+	keys    []string
+	trips   map[string]*models.TripToShelter
+	history map[string][]*models.TripEvent
+}
+
+// NewFileTripRepository creates repository and loads history of registrations from file if it exists.
+func NewFileTripRepository(path string) (interfaces.TripRepository, error) {
+	repository := &fileTripRepository{
+		path:    path,
+		trips:   make(map[string]*models.TripToShelter),
+		history: make(map[string][]*models.TripEvent),
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return repository, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var event models.TripEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("line %d of %s: %v", line, path, err)
+		}
+		repository.apply(&event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return repository, nil
+}
+
+// Save creates registration or updates existing registration with the same ID.
+// Every change is appended to the history.
+func (repository *fileTripRepository) Save(tripToShelter *models.TripToShelter) error {
+	if tripToShelter.Shelter == nil {
+		return errors.New("trip doesn't have shelter")
+	}
+
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	event := &models.TripEvent{
+		Type: EventUpdated,
+		Time: time.Now(),
+		Trip: *tripToShelter,
+	}
+	previous, ok := repository.trips[getKey(tripToShelter)]
+	if !ok {
+		event.Type = EventRegistered
+	} else if previous.Status != tripToShelter.Status {
+		event.Type = EventStatusChanged
+	}
+
+	if err := repository.append(event); err != nil {
+		return err
+	}
+	repository.apply(event)
+	return nil
+}
+
+// List returns copies of all registrations in order of creation.
+func (repository *fileTripRepository) List() ([]*models.TripToShelter, error) {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	var trips []*models.TripToShelter
+	for _, key := range repository.keys {
+		trip := *repository.trips[key]
+		trips = append(trips, &trip)
+	}
+	return trips, nil
+}
+
+// ListByChat returns copies of registrations of the chat in order of creation.
+func (repository *fileTripRepository) ListByChat(chatId int64) ([]*models.TripToShelter, error) {
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	var trips []*models.TripToShelter
+	for _, key := range repository.keys {
+		if repository.trips[key].ChatId != chatId {
+			continue
+		}
+		trip := *repository.trips[key]
+		trips = append(trips, &trip)
+	}
+	return trips, nil
+}
+
+// History returns all changes of registration with the same ID.
+func (repository *fileTripRepository) History(tripToShelter *models.TripToShelter) ([]*models.TripEvent, error) {
+	if tripToShelter.Shelter == nil {
+		return nil, errors.New("trip doesn't have shelter")
+	}
+
+	repository.mutex.Lock()
+	defer repository.mutex.Unlock()
+
+	var history []*models.TripEvent
+	for _, event := range repository.history[getKey(tripToShelter)] {
+		eventCopy := *event
+		history = append(history, &eventCopy)
+	}
+	return history, nil
+}
+
+// apply updates registrations in memory by event.
+func (repository *fileTripRepository) apply(event *models.TripEvent) {
+	if event.Trip.Shelter == nil {
+		return
+	}
+	key := getKey(&event.Trip)
+	if _, ok := repository.trips[key]; !ok {
+		repository.keys = append(repository.keys, key)
+	}
+	trip := event.Trip
+	repository.trips[key] = &trip
+	repository.history[key] = append(repository.history[key], event)
+}
+
+// append writes event to the end of the file and flushes it to disk.
+func (repository *fileTripRepository) append(event *models.TripEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(repository.path), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(repository.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// getKey returns key of registration which is same for all changes of registration, it's ID of registration.
+// Registrations saved without ID are keyed by chat, shelter and date of the trip.
+func getKey(tripToShelter *models.TripToShelter) string {
+	if tripToShelter.ID != "" {
+		return tripToShelter.ID
+	}
+	date := tripToShelter.Date
+	for _, field := range strings.Fields(tripToShelter.Date) {
+		if _, err := time.Parse("02.01.2006", field); err == nil {
+			date = field
+			break
+		}
+	}
+	return fmt.Sprintf("%d_%s_%s", tripToShelter.ChatId, tripToShelter.Shelter.ID, date)
+}
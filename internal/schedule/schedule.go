@@ -0,0 +1,510 @@
+// Package schedule calculates dates of trips to shelters by their schedules.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"walkthedog/internal/models"
+)
+
+// Schedule types.
+const (
+	TypeRegularly = "regularly"
+	TypeEveryday  = "everyday"
+	TypeWeekly    = "weekly"
+	TypeDates     = "dates"
+	TypeNone      = "none"
+)
+
+// LastWeek is week number in schedule details which means the last week of the month.
+const LastWeek = -1
+
+// DefaultDaysAhead is booking horizon in days for "everyday" schedule if days_ahead is not set.
+const DefaultDaysAhead = 30
+
+// DefaultWeeklyDaysAhead is booking horizon in days for "weekly" schedule if days_ahead is not set.
+const DefaultWeeklyDaysAhead = 180
+
+// regularMonthsAhead is booking horizon in months for "regularly" schedule including current month.
+const regularMonthsAhead = 6
+
+const dateLayout = "02.01.2006"
+
+// Occurrence represents one trip to shelter.
+// End is zero if end time is not set and Capacity is zero if count of people isn't limited.
+type Occurrence struct {
+	Shelter  *models.Shelter
+	Start    time.Time
+	End      time.Time
+	Capacity int32
+}
+
+// Date returns date of the trip in format 02.01.2006.
+func (o Occurrence) Date() string {
+	return o.Start.Format(dateLayout)
+}
+
+// Upcoming returns sorted list of trips to shelter from today till booking horizon of shelter's schedule.
+// Dates are calculated in location of now.
+func Upcoming(shelter *models.Shelter, now time.Time) []Occurrence {
+	return Occurrences(shelter, now, Horizon(&shelter.Schedule, now))
+}
+
+// Occurrences returns sorted list of trips to shelter on days from day of "from" till "to" exclusive.
+// Dates are calculated in location of "from". Exceptions and valid period of shelter's schedule are taken into account.
+func Occurrences(shelter *models.Shelter, from time.Time, to time.Time) []Occurrence {
+	from = startOfDay(from)
+	loc := from.Location()
+
+	var days []time.Time
+	switch shelter.Schedule.Type {
+	case TypeRegularly:
+		days = regularDays(&shelter.Schedule, from, to)
+	case TypeEveryday:
+		days = everydayDays(&shelter.Schedule, from, to)
+	case TypeWeekly:
+		days = weeklyDays(&shelter.Schedule, from, to)
+	case TypeDates:
+		days = oneOffDays(&shelter.Schedule, loc)
+	}
+
+	sort.Slice(days, func(i, j int) bool {
+		return days[i].Before(days[j])
+	})
+
+	var occurrences []Occurrence
+	for i, day := range days {
+		// few rules can give the same day.
+		if i > 0 && day.Equal(days[i-1]) {
+			continue
+		}
+		if day.Before(from) || !day.Before(to) {
+			continue
+		}
+		if isDateException(&shelter.Schedule, day.Format(dateLayout)) {
+			continue
+		}
+		if !IsInValidPeriod(&shelter.Schedule, day) {
+			continue
+		}
+		occurrences = append(occurrences, newOccurrence(shelter, day))
+	}
+
+	return occurrences
+}
+
+// At returns trip to shelter on given date in format 02.01.2006 without checking that schedule has trip on this date.
+func At(shelter *models.Shelter, date string, loc *time.Location) (Occurrence, error) {
+	day, err := time.ParseInLocation(dateLayout, date, loc)
+	if err != nil {
+		return Occurrence{}, err
+	}
+	return newOccurrence(shelter, day), nil
+}
+
+// Horizon returns the first day which is out of booking horizon of schedule.
+func Horizon(schedule *models.ShelterSchedule, now time.Time) time.Time {
+	today := startOfDay(now)
+	switch schedule.Type {
+	case TypeRegularly:
+		return time.Date(today.Year(), today.Month()+regularMonthsAhead, 1, 0, 0, 0, 0, today.Location())
+	case TypeEveryday:
+		if schedule.DaysAhead > 0 {
+			return today.AddDate(0, 0, schedule.DaysAhead)
+		}
+		return today.AddDate(0, 0, DefaultDaysAhead)
+	case TypeWeekly:
+		if schedule.DaysAhead > 0 {
+			return today.AddDate(0, 0, schedule.DaysAhead)
+		}
+		return today.AddDate(0, 0, DefaultWeeklyDaysAhead)
+	case TypeDates:
+		horizon := today
+		for _, day := range oneOffDays(schedule, today.Location()) {
+			if !day.Before(horizon) {
+				horizon = day.AddDate(0, 0, 1)
+			}
+		}
+		return horizon
+	}
+	return today
+}
+
+// TripTime returns start and end time of trip to shelter on given date in format 02.01.2006.
+func TripTime(shelter *models.Shelter, date string) (string, string) {
+	timeStart := shelter.Schedule.TimeStart
+	timeEnd := shelter.Schedule.TimeEnd
+	if shelterDate := getShelterDate(&shelter.Schedule, date); shelterDate != nil {
+		if shelterDate.TimeStart != "" {
+			timeStart = shelterDate.TimeStart
+		}
+		if shelterDate.TimeEnd != "" {
+			timeEnd = shelterDate.TimeEnd
+		}
+	}
+	return timeStart, timeEnd
+}
+
+// PeopleLimit returns max count of people on the trip to shelter on given date in format 02.01.2006. Zero means no limit.
+func PeopleLimit(shelter *models.Shelter, date string) int32 {
+	if shelterDate := getShelterDate(&shelter.Schedule, date); shelterDate != nil && shelterDate.PeopleLimit > 0 {
+		return shelterDate.PeopleLimit
+	}
+	return shelter.PeopleLimit
+}
+
+// DayOfMonth returns the date by given year, month, week number and day of week (1 - Monday ... 7 - Sunday).
+// Week number -1 means the last week of the month.
+// It returns zero time if month doesn't have such a week, e.g. 5th Sunday.
+func DayOfMonth(year int, month time.Month, week int, dayOfWeek int, loc *time.Location) time.Time {
+	firstDayOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+
+	if week == LastWeek {
+		lastDayOfMonth := firstDayOfMonth.AddDate(0, 1, -1)
+		lastWeekday := isoWeekday(lastDayOfMonth.Weekday())
+		return lastDayOfMonth.AddDate(0, 0, -((lastWeekday - dayOfWeek + 7) % 7))
+	}
+
+	firstWeekday := isoWeekday(firstDayOfMonth.Weekday())
+	day := firstDayOfMonth.AddDate(0, 0, (dayOfWeek-firstWeekday+7)%7+(week-1)*7)
+	if day.Month() != firstDayOfMonth.Month() {
+		return time.Time{}
+	}
+	return day
+}
+
+// IsInValidPeriod returns true if day is within valid_from and valid_to of schedule.
+// Dates in format 02.01.2006 set absolute period, dates in format 02.01 set period which repeats every year.
+func IsInValidPeriod(schedule *models.ShelterSchedule, day time.Time) bool {
+	validFrom := schedule.ValidFrom
+	validTo := schedule.ValidTo
+
+	if len(validFrom) == len("02.01") || len(validTo) == len("02.01") {
+		// compare only month and day.
+		dayOfYear := int(day.Month())*100 + day.Day()
+		from, to := 101, 1231
+		if validFrom != "" {
+			fromDate, _ := time.Parse("02.01", validFrom)
+			from = int(fromDate.Month())*100 + fromDate.Day()
+		}
+		if validTo != "" {
+			toDate, _ := time.Parse("02.01", validTo)
+			to = int(toDate.Month())*100 + toDate.Day()
+		}
+		if from <= to {
+			return dayOfYear >= from && dayOfYear <= to
+		}
+		// period goes through new year, e.g. from November till February.
+		return dayOfYear >= from || dayOfYear <= to
+	}
+
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	if validFrom != "" {
+		fromDate, err := time.Parse(dateLayout, validFrom)
+		if err == nil && date.Before(fromDate) {
+			return false
+		}
+	}
+	if validTo != "" {
+		toDate, err := time.Parse(dateLayout, validTo)
+		if err == nil && date.After(toDate) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseCutoff returns registration cut-off parsed from string like "24h" or "30m".
+func ParseCutoff(value string) (time.Duration, error) {
+	cutoff, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("registration cutoff \"%s\" should be duration like \"24h\"", value)
+	}
+	if cutoff < 0 {
+		return 0, fmt.Errorf("registration cutoff %s should not be negative", value)
+	}
+	return cutoff, nil
+}
+
+// Validate returns error if schedule can't be used to calculate trip dates.
+func Validate(schedule *models.ShelterSchedule) error {
+	switch schedule.Type {
+	case TypeRegularly:
+		if len(schedule.Details) == 0 {
+			return errors.New("details are empty")
+		}
+		for _, tripDate := range schedule.Details {
+			if len(tripDate) != 2 {
+				return fmt.Errorf("details %v should contain week number and day of week", tripDate)
+			}
+			if (tripDate[0] < 1 || tripDate[0] > 5) && tripDate[0] != LastWeek {
+				return fmt.Errorf("week number %d should be from 1 to 5 or %d for the last week", tripDate[0], LastWeek)
+			}
+			if tripDate[1] < 1 || tripDate[1] > 7 {
+				return fmt.Errorf("day of week %d should be from 1 to 7", tripDate[1])
+			}
+		}
+	case TypeEveryday:
+		for _, weekday := range schedule.Weekdays {
+			if weekday < 1 || weekday > 7 {
+				return fmt.Errorf("day of week %d should be from 1 to 7", weekday)
+			}
+		}
+	case TypeWeekly:
+		if _, err := time.Parse(dateLayout, schedule.StartDate); err != nil {
+			return fmt.Errorf("start date \"%s\" should be in format 02.01.2006", schedule.StartDate)
+		}
+		if schedule.Every < 1 {
+			return fmt.Errorf("every %d should be at least 1", schedule.Every)
+		}
+	case TypeDates:
+		if len(schedule.Dates) == 0 {
+			return errors.New("dates are empty")
+		}
+		for _, shelterDate := range schedule.Dates {
+			if _, err := time.Parse(dateLayout, shelterDate.Date); err != nil {
+				return fmt.Errorf("date \"%s\" should be in format 02.01.2006", shelterDate.Date)
+			}
+			if err := validateTimePeriod(shelterDate.TimeStart, shelterDate.TimeEnd); err != nil {
+				return fmt.Errorf("date %s: %v", shelterDate.Date, err)
+			}
+			if shelterDate.PeopleLimit < 0 {
+				return fmt.Errorf("date %s: people limit should not be negative", shelterDate.Date)
+			}
+		}
+	case TypeNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown type \"%s\"", schedule.Type)
+	}
+
+	if schedule.DaysAhead < 0 {
+		return errors.New("days ahead should not be negative")
+	}
+	for _, v := range schedule.DatesExceptions {
+		if _, err := time.Parse(dateLayout, v); err != nil {
+			return fmt.Errorf("exception \"%s\" should be in format 02.01.2006", v)
+		}
+	}
+	if err := validateTimePeriod(schedule.TimeStart, schedule.TimeEnd); err != nil {
+		return err
+	}
+	if schedule.RegistrationCutoff != "" {
+		if _, err := ParseCutoff(schedule.RegistrationCutoff); err != nil {
+			return err
+		}
+	}
+
+	return validateValidPeriod(schedule.ValidFrom, schedule.ValidTo)
+}
+
+// validateTimePeriod returns error if start or end time is not in format 15:04 or trip ends before start.
+func validateTimePeriod(timeStart string, timeEnd string) error {
+	var start, end time.Time
+	var err error
+	if timeStart != "" {
+		if start, err = time.Parse("15:04", timeStart); err != nil {
+			return fmt.Errorf("start time \"%s\" should be in format 15:04", timeStart)
+		}
+	}
+	if timeEnd != "" {
+		if end, err = time.Parse("15:04", timeEnd); err != nil {
+			return fmt.Errorf("end time \"%s\" should be in format 15:04", timeEnd)
+		}
+	}
+	if timeStart != "" && timeEnd != "" && !end.After(start) {
+		return fmt.Errorf("end time %s should be after start time %s", timeEnd, timeStart)
+	}
+	return nil
+}
+
+// validateValidPeriod returns error if valid_from or valid_to has wrong format or period is empty.
+func validateValidPeriod(validFrom string, validTo string) error {
+	if validFrom == "" && validTo == "" {
+		return nil
+	}
+	// both dates should be in the same format.
+	layout := dateLayout
+	if len(validFrom) == len("02.01") || len(validTo) == len("02.01") {
+		layout = "02.01"
+	}
+
+	var from, to time.Time
+	var err error
+	if validFrom != "" {
+		if from, err = time.Parse(layout, validFrom); err != nil {
+			return fmt.Errorf("valid from \"%s\" should be in format %s", validFrom, layout)
+		}
+	}
+	if validTo != "" {
+		if to, err = time.Parse(layout, validTo); err != nil {
+			return fmt.Errorf("valid to \"%s\" should be in format %s", validTo, layout)
+		}
+	}
+	// yearly period can go through new year, so only absolute period is checked.
+	if layout == dateLayout && validFrom != "" && validTo != "" && to.Before(from) {
+		return fmt.Errorf("valid to %s should not be before valid from %s", validTo, validFrom)
+	}
+	return nil
+}
+
+// newOccurrence returns trip to shelter on given day with start and end time and capacity of this day.
+func newOccurrence(shelter *models.Shelter, day time.Time) Occurrence {
+	date := day.Format(dateLayout)
+	timeStart, timeEnd := TripTime(shelter, date)
+	occurrence := Occurrence{
+		Shelter:  shelter,
+		Start:    day,
+		Capacity: PeopleLimit(shelter, date),
+	}
+	if start, ok := atTime(day, timeStart); ok {
+		occurrence.Start = start
+	}
+	if end, ok := atTime(day, timeEnd); ok {
+		occurrence.End = end
+	}
+	return occurrence
+}
+
+// atTime returns day with time in format 15:04. It returns false if time is empty or has wrong format.
+func atTime(day time.Time, clock string) (time.Time, bool) {
+	if clock == "" {
+		return time.Time{}, false
+	}
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), parsed.Hour(), parsed.Minute(), 0, 0, day.Location()), true
+}
+
+// regularDays returns list of days for "regularly" schedule type in months from "from" till "to".
+func regularDays(schedule *models.ShelterSchedule, from time.Time, to time.Time) []time.Time {
+	var days []time.Time
+
+	for _, tripDate := range schedule.Details {
+		if len(tripDate) < 2 {
+			continue
+		}
+		scheduleWeek := tripDate[0]
+		scheduleDay := tripDate[1]
+		for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, from.Location()); month.Before(to); month = month.AddDate(0, 1, 0) {
+			day := DayOfMonth(month.Year(), month.Month(), scheduleWeek, scheduleDay, from.Location())
+			if day.IsZero() {
+				continue
+			}
+			days = append(days, day)
+		}
+	}
+
+	return days
+}
+
+// everydayDays returns list of days from "from" till "to" for "everyday" schedule type limited by allowed days of week.
+func everydayDays(schedule *models.ShelterSchedule, from time.Time, to time.Time) []time.Time {
+	var days []time.Time
+
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if !isWeekdayAllowed(schedule.Weekdays, day.Weekday()) {
+			continue
+		}
+		days = append(days, day)
+	}
+
+	return days
+}
+
+// weeklyDays returns list of days for "weekly" schedule type: every N weeks starting from start date.
+func weeklyDays(schedule *models.ShelterSchedule, from time.Time, to time.Time) []time.Time {
+	var days []time.Time
+
+	startDate, err := time.ParseInLocation(dateLayout, schedule.StartDate, from.Location())
+	if err != nil {
+		log.Printf("Can't parse start date %s", schedule.StartDate)
+		return days
+	}
+	every := schedule.Every
+	if every <= 0 {
+		every = 1
+	}
+
+	for day := startDate; day.Before(to); day = day.AddDate(0, 0, 7*every) {
+		if day.Before(from) {
+			continue
+		}
+		days = append(days, day)
+	}
+
+	return days
+}
+
+// oneOffDays returns list of days for "dates" schedule type.
+func oneOffDays(schedule *models.ShelterSchedule, loc *time.Location) []time.Time {
+	var days []time.Time
+
+	for _, shelterDate := range schedule.Dates {
+		day, err := time.ParseInLocation(dateLayout, shelterDate.Date, loc)
+		if err != nil {
+			log.Printf("Can't parse date %s", shelterDate.Date)
+			continue
+		}
+		days = append(days, day)
+	}
+
+	return days
+}
+
+// getShelterDate returns one-off date settings by given date or nil if schedule doesn't have such a date.
+func getShelterDate(schedule *models.ShelterSchedule, date string) *models.ShelterDate {
+	if schedule.Type != TypeDates {
+		return nil
+	}
+	for i, v := range schedule.Dates {
+		if v.Date == date {
+			return &schedule.Dates[i]
+		}
+	}
+	return nil
+}
+
+// isWeekdayAllowed returns true if weekday is in list of allowed days of week (1 - Monday ... 7 - Sunday).
+// Empty list means that all days are allowed.
+func isWeekdayAllowed(weekdays []int, weekday time.Weekday) bool {
+	if len(weekdays) == 0 {
+		return true
+	}
+	day := isoWeekday(weekday)
+	for _, v := range weekdays {
+		if v == day {
+			return true
+		}
+	}
+	return false
+}
+
+// isDateException returns true if given date in format 02.01.2006 is in schedule's exceptions list.
+func isDateException(schedule *models.ShelterSchedule, date string) bool {
+	for _, v := range schedule.DatesExceptions {
+		if v == date {
+			return true
+		}
+	}
+	return false
+}
+
+// isoWeekday returns number of day of week where 1 is Monday and 7 is Sunday.
+func isoWeekday(weekday time.Weekday) int {
+	if weekday == time.Sunday {
+		return 7
+	}
+	return int(weekday)
+}
+
+// startOfDay returns midnight of the day of given time.
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,75 @@
+// Package session stores in-progress conversations with users in a file, so they survive restarts.
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"walkthedog/internal/models"
+)
+
+// Snapshot represents chat states and poll_id => poll mapping at some moment.
+type Snapshot struct {
+	States map[int64]*models.State `json:"states"`
+	Polls  map[string]*models.Poll `json:"polls"`
+}
+
+// Store saves snapshots of conversations to file.
+type Store struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewStore creates store which saves conversations to file by given path.
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Load returns snapshot saved to file. It returns empty snapshot if nothing was saved yet.
+func (store *Store) Load() (*Snapshot, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	snapshot := &Snapshot{}
+	data, err := os.ReadFile(store.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return nil, err
+		}
+	}
+	if snapshot.States == nil {
+		snapshot.States = make(map[int64]*models.State)
+	}
+	if snapshot.Polls == nil {
+		snapshot.Polls = make(map[string]*models.Poll)
+	}
+	return snapshot, nil
+}
+
+// Save writes snapshot to temporary file and then replaces store file by it, so file is never half-written.
+func (store *Store) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err = os.MkdirAll(filepath.Dir(store.path), 0755)
+	if err != nil {
+		return err
+	}
+	tmpPath := store.path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, store.path)
+}
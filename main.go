@@ -1,35 +1,56 @@
 package main
 
 import (
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	// embedded timezone database, so organisation's timezone can be loaded in any container.
+	_ "time/tzdata"
 
 	"walkthedog/internal/dates"
+	"walkthedog/internal/dispatcher"
+	"walkthedog/internal/flow"
 	sheet "walkthedog/internal/google/sheet"
+	"walkthedog/internal/ics"
 	"walkthedog/internal/interfaces"
 	"walkthedog/internal/models"
+	"walkthedog/internal/outbox"
+	"walkthedog/internal/reminder"
+	"walkthedog/internal/repository"
+	"walkthedog/internal/schedule"
+	"walkthedog/internal/session"
 
 	"github.com/davecgh/go-spew/spew"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/patrickmn/go-cache"
+	"google.golang.org/api/googleapi"
 	"gopkg.in/yaml.v3"
 )
 
 type AppConfig struct {
-	Environment   string
-	AdminChatId   int64
-	Google        *models.Google
-	Cache         *cache.Cache
-	Bot           interfaces.TelegramBot
-	SheetsService interfaces.GoogleSheetsService
+	Environment        string
+	AdminChatId        int64
+	Google             *models.Google
+	Cache              *cache.Cache
+	Bot                interfaces.TelegramBot
+	SheetsService      interfaces.GoogleSheetsService
+	Reminders          *reminder.Store
+	ReminderDaysBefore []int
+	Sessions           *session.Store
+	Trips              interfaces.TripRepository
+	Outbox             *outbox.Store
 }
 
 // Environments
@@ -61,30 +82,130 @@ const (
 	commandHowYouKnowAboutUs      = "/how_you_know_about_us"
 	commandSendUserContact        = "/provide_user_contact"
 	commandSummaryShelterTrip     = "/summary_shelter_trip"
+	commandDuplicateRegistration  = "/duplicate_registration"
+
+	// Related to user's registrations
+	commandMyTrips = "/my_trips"
 
 	// System
 	commandRereadShelters   = "/reread_shelters"
 	commandRereadConfigFile = "/reread_app_config"
 	commandUpdateGoogleAuth = "/update_google_auth"
 	commandClearCache       = "/clear_cache"
+	commandFreeSeat         = "/free_seat"
+	commandOutbox           = "/outbox"
 )
 
 // Answers
 const (
 	chooseByShelter = "Выбор по приюту"
 	chooseByDate    = "Выбор по дате"
+
+	keepEarlierAnswers    = "Оставить прежние ответы"
+	replaceEarlierAnswers = "Заменить новыми ответами"
 )
 
 // Phrases
 const (
 	errorWrongShelterName = "не похоже на название приюта"
+	errorWrongDate        = "не похоже на дату выезда"
+	errorWrongFreeSeat    = "Отправьте дату и номер приюта, например: 05.11.2022 1"
+
+	messageWaitlistOffer      = "На эту дату все места уже заняты 😔 Вы можете продолжить регистрацию и встать в лист ожидания — если место освободится, мы сразу вам напишем."
+	messageWaitlisted         = "Все места на этот выезд заняты, поэтому мы записали вас в лист ожидания 📝 Как только место освободится, мы пришлем сообщение."
+	messagePromoted           = "🎉 На выезде освободилось место, и вы переведены из листа ожидания в список участников!"
+	messageNoTrips            = "У вас нет предстоящих выездов в приют. Записаться можно с помощью команды /go_shelter"
+	messageTripCancelled      = "Запись на выезд отменена. Будем рады видеть вас на других выездах 🐶"
+	messageRegistrationClosed = "Запись на этот выезд уже закрыта ⏰"
+	messageAnswersKept        = "Хорошо, оставили вашу прежнюю запись на выезд 👍"
+	messageSessionExpired     = "Вы долго не отвечали, поэтому регистрация прервана ⏰ Чтобы начать заново, отправьте " + commandStart
+	messageTripConfirmed      = "✅ Ваша запись на выезд в приют %s %s подтверждена. До встречи!"
+	messageTripRejected       = "😔 К сожалению, ваша запись на выезд в приют %s %s отклонена. Вы можете выбрать другую дату: " + commandGoShelter
+	messageTripMoved          = "📅 Ваш выезд в приют %s перенесен с %s на %s."
+	messageTripStatusChanged  = "ℹ️ Статус вашей записи на выезд в приют %s %s изменен: %s"
+)
+
+// cancelTripPrefix is prefix of button to cancel trip.
+const cancelTripPrefix = "❌ "
+
+// Trip statuses
+const (
+	tripStatusWaitlist  = "Лист ожидания"
+	tripStatusPromoted  = "Переведен из листа ожидания"
+	tripStatusCancelled = "Отменен"
+	tripStatusReplaced  = "Заменен новой записью"
+	tripStatusMoved     = "Перенесен на"
+)
+
+// Statuses set by coordinators in google sheet. They are compared by prefix ignoring case, e.g. "подтверждена" is confirmed.
+const (
+	sheetStatusConfirmed = "Подтвержден"
+	sheetStatusRejected  = "Отклонен"
 )
 
+// seatsInfoSeparator separates date from information about free seats on date buttons.
+const seatsInfoSeparator = " — "
+
 const (
-	cacheDir      = "cache/"
-	cacheFileName = "cache.dat"
+	cacheDir          = "cache/"
+	cacheFileName     = "cache.dat"
+	remindersFileName = "reminders.json"
+	sessionsFileName  = "sessions.json"
+	tripsFileName     = "trips.jsonl"
+	outboxFileName    = "outbox.json"
 )
 
+// updateWorkers is how many updates of different chats are handled at the same time.
+const updateWorkers = 16
+
+// outboxInterval is how often outbox worker checks for writes to google sheet which should be retried.
+const outboxInterval = 30 * time.Second
+
+// statusSyncInterval is how often statuses of trips are read from google sheet.
+// It's set from app config, by default it's defaultStatusSyncInterval.
+var statusSyncInterval = defaultStatusSyncInterval
+
+// defaultStatusSyncInterval is how often statuses of trips are read from google sheet if it's not set in app config.
+const defaultStatusSyncInterval = 5 * time.Minute
+
+// sessionsSaveInterval is how often changed chat states and polls are saved to file.
+const sessionsSaveInterval = time.Minute
+
+// authCheckInterval is how often bot checks that it's still authenticated in google sheets.
+const authCheckInterval = time.Hour
+
+// calendarPath is path of http server with ics feeds of shelters.
+const calendarPath = "/calendar/"
+
+// registrationCutoff is how long before start of the trip registration closes if it's not set in shelter schedule.
+// It's set from app config, by default registration closes when trip starts.
+var registrationCutoff time.Duration
+
+// sessionTimeout is how long conversation with user is kept without answers.
+// It's set from app config, by default it's defaultSessionTimeout.
+var sessionTimeout = defaultSessionTimeout
+
+// defaultSessionTimeout is how long conversation with user is kept without answers if it's not set in app config.
+const defaultSessionTimeout = 24 * time.Hour
+
+// registrationSteps is list of commands after which user is in the middle of registration to shelter.
+var registrationSteps = []string{
+	commandGoShelter,
+	commandChooseShelter,
+	commandTripDates,
+	commandChooseDateAfterShelter,
+	commandChooseDateAfterMonth,
+	commandIsFirstTrip,
+	commandTripPurpose,
+	commandTripBy,
+	commandHowYouKnowAboutUs,
+	commandSendUserContact,
+	commandDuplicateRegistration,
+}
+
+// defaultReminderDaysBefore is list of days before trip when reminders are sent if it's not set in app config.
+var defaultReminderDaysBefore = []int{5, 1}
+
 // purposes represents list of available purposes user can choose to going to shelter.
 var purposes = []string{
 	"Погулять с собаками",
@@ -139,10 +260,56 @@ var statePool = make(map[int64]*models.State)
 var statePoolMutex sync.RWMutex
 
 // TODO: remove poll_id after answer.
-// polls stores poll_id => chat_id with mutex protection
-var polls = make(map[string]int64)
+// polls stores poll_id => poll with chat where it was sent with mutex protection
+var polls = make(map[string]*models.Poll)
 var pollsMutex sync.RWMutex
 
+// tripSeats stores trip key => count of registrations with mutex protection
+var tripSeats = make(map[string]int)
+var tripSeatsMutex sync.RWMutex
+
+// waitlist stores trip key => queue of trips waiting for free seat with mutex protection
+var waitlist = make(map[string][]*models.TripToShelter)
+var waitlistMutex sync.Mutex
+
+// registrations stores chat_id => trips registered from this chat with mutex protection
+var registrations = make(map[int64][]*models.TripToShelter)
+var registrationsMutex sync.RWMutex
+
+// outboxMutex protects outbox entries which are changed by worker and user's updates. It's not held while entries are written to google sheet.
+var outboxMutex sync.Mutex
+
+// writingOutboxEntries keeps outbox entries which are being written to google sheet, so entry isn't written by worker and user's update at the same time.
+// Copies of entries are written, so entries can be changed meanwhile. It's protected by outboxMutex.
+var writingOutboxEntries = make(map[*models.OutboxEntry]bool)
+
+// outboxWritten is signaled when writing of outbox entries is finished, so shutdown can wait for writes in progress.
+var outboxWritten = sync.NewCond(&outboxMutex)
+
+// configMutex protects app config and chat id of admin which are read by update handlers and workers while config is reread by admin command
+var configMutex sync.RWMutex
+
+// googleAuthWarningSent is true if admin is warned about expired G.Sheet auth, so warning isn't repeated until auth is updated
+var googleAuthWarningSent bool
+var googleAuthWarningMutex sync.Mutex
+
+// preparedSheets keeps tabs of google sheet which exist or were created with headers
+var preparedSheets = make(map[string]bool)
+var preparedSheetsMutex sync.Mutex
+
+// saveSessionsMutex makes sure that snapshots of sessions are written in order they are taken, so newer one isn't overwritten
+var saveSessionsMutex sync.Mutex
+
+// sessionsChanged is true if chat states or polls were changed since they were saved last time
+var sessionsChanged bool
+var sessionsChangedMutex sync.Mutex
+
+// shutdownOnce makes sure that state is saved only once on exit
+var shutdownOnce sync.Once
+
+// sheltersMutex protects shelters list which is read by calendar server while it's reread by admin command
+var sheltersMutex sync.RWMutex
+
 // SheltersList represents list of Shelters
 type SheltersList map[int]*models.Shelter
 
@@ -153,10 +320,24 @@ func NewTripToShelter(userName string) *models.TripToShelter {
 	}
 }
 
+// copyTrip returns copy of the trip with its own lists of answers or nil if trip is nil.
+func copyTrip(tripToShelter *models.TripToShelter) *models.TripToShelter {
+	if tripToShelter == nil {
+		return nil
+	}
+	tripCopy := *tripToShelter
+	tripCopy.Purpose = append([]string(nil), tripToShelter.Purpose...)
+	tripCopy.HowYouKnowAboutUs = append([]string(nil), tripToShelter.HowYouKnowAboutUs...)
+	return &tripCopy
+}
+
 // var tempCacheFileName string
 var app AppConfig
 
 func main() {
+	// save state on exit, also when bot exits by panic.
+	defer app.shutdown()
+
 	c, err := initCache()
 	if err != nil {
 		log.Panic(err)
@@ -165,6 +346,9 @@ func main() {
 
 	// Start cleanup goroutine to prevent memory leaks
 	go startCleanupWorker()
+
+	// Start saving changed conversations, so they can be continued after restart
+	go app.startSessionsWorker()
 	/* trip := models.TripToShelter{
 		Username: "sdfsd908",
 		Shelter: &models.Shelter{
@@ -191,7 +375,6 @@ func main() {
 		HowYouKnowAboutUs: "dfdfdf",
 	} */
 	//c.Set("test", &trip, cache.NoExpiration)
-	/* saveTripToCache(c, &trip, 3453453453453) */
 	/* spew.Dump(c.Get("chats_have_trips"))
 	spew.Dump(c.Get("3453453453453")) */
 
@@ -209,10 +392,68 @@ func main() {
 	app.Environment = config.TelegramEnvironment.Environment
 	telegramConfig := config.TelegramEnvironment.TelegramConfig[app.Environment]
 
+	app.AdminChatId = getAdminChatId(config)
+
 	/* app.Environment = curEnvironment */
 	//app.Administration = config.Administration
 	app.Google = config.Google
 
+	err = dates.SetLocation(config.Timezone)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Printf("Organisation timezone is %s", dates.Location())
+
+	if config.Registration != nil && config.Registration.Cutoff != "" {
+		registrationCutoff, err = schedule.ParseCutoff(config.Registration.Cutoff)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if config.Sessions != nil && config.Sessions.Timeout != "" {
+		sessionTimeout, err = time.ParseDuration(config.Sessions.Timeout)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if app.Google != nil {
+		err = sheet.CheckLayout(*app.Google)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = sheet.CheckColumns(*app.Google)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	if app.Google != nil && app.Google.SyncInterval != "" {
+		statusSyncInterval, err = time.ParseDuration(app.Google.SyncInterval)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	app.ReminderDaysBefore = defaultReminderDaysBefore
+	if config.Reminders != nil && config.Reminders.DaysBefore != nil {
+		app.ReminderDaysBefore = config.Reminders.DaysBefore
+	}
+	app.Reminders, err = reminder.NewStore(cacheDir + remindersFileName)
+	if err != nil {
+		log.Panic(err)
+	}
+	app.Sessions = session.NewStore(cacheDir + sessionsFileName)
+	app.Trips, err = repository.NewFileTripRepository(cacheDir + tripsFileName)
+	if err != nil {
+		log.Panic(err)
+	}
+	app.Outbox, err = outbox.NewStore(cacheDir + outboxFileName)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	// bot init
 	bot, err := tgbotapi.NewBotAPI(telegramConfig.APIToken)
 	if err != nil {
@@ -229,9 +470,24 @@ func main() {
 	app.SheetsService, err = sheet.NewGoogleSpreadsheet(*app.Google)
 	if err != nil {
 		log.Printf("Unable to initialize Google Sheets service: %v", err)
+		if sheet.IsAuthError(err) {
+			app.warnGoogleAuthExpired(err)
+		}
 		// Continue without sheets service for now
 	}
 
+	// Start sending reminders about upcoming trips
+	go app.startReminderWorker()
+
+	// Start retrying writes to google sheet which failed
+	go app.startOutboxWorker()
+
+	// Start reading statuses of trips changed by coordinators in google sheet
+	go app.startStatusSync()
+
+	// Start checking that G.Sheet auth isn't expired
+	go app.startGoogleAuthCheck()
+
 	user, err := app.Bot.GetMe()
 	if err != nil {
 		log.Printf("Unable to get bot info: %v", err)
@@ -245,7 +501,9 @@ func main() {
 
 	updates := app.Bot.GetUpdatesChan(u)
 
-	var lastMessage string
+	// stop receiving updates on SIGINT/SIGTERM, loop below finishes without waiting for long poll in progress
+	stopped := make(chan struct{})
+	go app.stopOnSignal(stopped, syscall.SIGINT, syscall.SIGTERM)
 
 	// getting shelters
 	shelters, err := getShelters()
@@ -253,362 +511,568 @@ func main() {
 		log.Panic(err)
 	}
 
-	var newTripToShelter *models.TripToShelter
+	// restore seats, waitlists and registrations of upcoming trips
+	err = app.restoreTrips(shelters)
+	if err != nil {
+		log.Printf("Unable to restore trips: %v", err)
+	}
+
+	// restore conversations which were in progress before restart
+	err = app.restoreSessions(shelters)
+	if err != nil {
+		log.Printf("Unable to restore sessions: %v", err)
+	}
+
+	if config.Calendar != nil && config.Calendar.Address != "" {
+		go startCalendarServer(config.Calendar.Address, &shelters)
+	}
+
+	updatesDispatcher := dispatcher.New(updateWorkers)
 
 	// getting message
-	for update := range updates {
+	for {
+		update, ok := nextUpdate(updates, stopped)
+		if !ok {
+			break
+		}
 		var chatId int64
 		// extract chat id for different cases
 		if update.Message != nil {
 			chatId = update.Message.Chat.ID
 		} else if update.PollAnswer != nil {
-			pollsMutex.RLock()
-			chatId = polls[update.PollAnswer.PollID]
-			pollsMutex.RUnlock()
-		}
-
-		// fetching state or init new
-		statePoolMutex.RLock()
-		state, ok := statePool[chatId]
-		statePoolMutex.RUnlock()
-		log.Printf("**state**: %+v", state)
-		if !ok {
-			state = &models.State{
-				ChatId:      chatId,
-				LastMessage: "",
+			chatId, ok = getPollChatId(update.PollAnswer.PollID)
+			if !ok {
+				log.Printf("[walkthedog_bot]: Unknown poll %s, answer is skipped", update.PollAnswer.PollID)
+				continue
 			}
-			statePoolMutex.Lock()
-			statePool[chatId] = state
-			statePoolMutex.Unlock()
 		}
-		// initilize last message and trip to shelter
+
+		// updates of one chat are handled in order they were received, updates of different chats are handled in parallel.
+		updatesDispatcher.Dispatch(chatId, func() {
+			app.handleUpdate(update, chatId, config, &shelters)
+		})
+	}
+	// shutdown signal is received, wait for updates in progress, state is saved by deferred shutdown.
+	updatesDispatcher.Wait()
+}
+
+// nextUpdate waits for the next update from telegram.
+// It returns false after stop signal without waiting for long poll to finish or if updates channel is closed.
+func nextUpdate(updates tgbotapi.UpdatesChannel, stopped <-chan struct{}) (tgbotapi.Update, bool) {
+	select {
+	case <-stopped:
+		return tgbotapi.Update{}, false
+	default:
+	}
+	select {
+	case <-stopped:
+		return tgbotapi.Update{}, false
+	case update, ok := <-updates:
+		return update, ok
+	}
+}
+
+// handleUpdate handles message or poll answer from the chat and saves chat state.
+// config and shelters can be reread by admin commands.
+func (app *AppConfig) handleUpdate(update tgbotapi.Update, chatId int64, config *models.ConfigFile, sheltersList *SheltersList) {
+	sheltersMutex.RLock()
+	shelters := *sheltersList
+	sheltersMutex.RUnlock()
+
+	// fetching state or init new. States in pool are not changed, handler changes its own copy and puts new state to pool,
+	// so states can be read by other chats' handlers and workers.
+	now := dates.Now()
+	statePoolMutex.RLock()
+	state, ok := statePool[chatId]
+	statePoolMutex.RUnlock()
+	log.Printf("**state**: %+v", state)
+	if ok && isSessionExpired(state, now) {
+		// user returned after long pause, so start conversation from the beginning.
+		app.expireSession(state)
+		ok = false
+	}
+	createdAt := now
+	if ok {
+		createdAt = state.CreatedAt
+	}
+	// initilize last message and trip to shelter
+	var lastMessage string
+	var newTripToShelter *models.TripToShelter
+	if ok {
 		lastMessage = state.LastMessage
-		newTripToShelter = state.TripToShelter
-		var isAdmin bool
+		newTripToShelter = copyTrip(state.TripToShelter)
+	}
+	var isAdmin bool
+	conversation := &registration{
+		app:      app,
+		update:   &update,
+		chatId:   chatId,
+		trip:     newTripToShelter,
+		shelters: &shelters,
+	}
 
-		var adminChatId int64 = 0
-		if config.Administration.Admin == "" {
-			log.Println("config.Administration.Admin is empty!")
-		} else {
-			adminChatIdTmp, err := strconv.Atoi(config.Administration.Admin)
-			if err != nil {
-				log.Println(err)
+	configMutex.RLock()
+	admin := config.Administration.Admin
+	// @TODO remove adminChatId
+	adminChatId := app.AdminChatId
+	configMutex.RUnlock()
+
+	// If we got a message
+	if update.Message != nil {
+		isAdmin = update.Message.Chat.ID == adminChatId
+		log.Printf("[%s]: %s", update.Message.From.UserName, update.Message.Text)
+		log.Printf("lastMessage: %s", lastMessage)
+
+		var msgObj tgbotapi.MessageConfig
+		//check for commands
+		switch update.Message.Text {
+		case "/sh":
+			//for testing
+			spew.Dump("start")
+
+			spew.Dump("end")
+		case commandStart:
+			log.Println("[walkthedog_bot]: Send start message")
+			msgObj = startMessage(chatId)
+			msgObj.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+			app.Bot.Send(msgObj)
+			lastMessage = commandStart
+		case commandGoShelter:
+			log.Println("[walkthedog_bot]: Send appointmentOptionsMessage message")
+			// new registration starts without answers of the previous one.
+			newTripToShelter = nil
+			lastMessage = app.goShelterCommand(&update)
+		case commandChooseShelter:
+			lastMessage = app.chooseShelterCommand(&update, &shelters)
+		case commandTripDates:
+			lastMessage = app.tripDatesCommand(&update, newTripToShelter, &shelters, lastMessage)
+		case commandMasterclass:
+			log.Println("[walkthedog_bot]: Send masterclass")
+			msgObj = masterclass(chatId)
+			app.Bot.Send(msgObj)
+			lastMessage = commandMasterclass
+		case commandMyTrips:
+			log.Println("[walkthedog_bot]: Send myTrips")
+			lastMessage = app.myTripsCommand(chatId)
+		case commandDonation:
+			log.Println("[walkthedog_bot]: Send donation")
+			lastMessage = app.donationCommand(chatId)
+		case commandDonationShelterList:
+			log.Println("[walkthedog_bot]: Send donationShelterList")
+			msgObj = donationShelterList(chatId, &shelters)
+			app.Bot.Send(msgObj)
+			lastMessage = commandDonationShelterList
+		//system commands
+		case commandRereadShelters:
+			if isAdmin {
+				// getting shelters again
+				newShelters, err := getShelters()
+				if err != nil {
+					// keep working with previous shelters list.
+					log.Println(err)
+					app.sendTextMessage(chatId, "Список приютов не обновлен: "+err.Error())
+					break
+				}
+				sheltersMutex.Lock()
+				*sheltersList = newShelters
+				sheltersMutex.Unlock()
+				shelters = newShelters
+				log.Println("[walkthedog_bot]: Shelters list was reread")
+				lastMessage = commandRereadShelters
 			}
-			// @TODO remove adminChatId
-			adminChatId = int64(adminChatIdTmp)
-			app.AdminChatId = int64(adminChatIdTmp)
-		}
+		case commandRereadConfigFile:
+			if isAdmin {
+				newConfig, err := getConfig()
+				if err != nil {
+					// keep working with previous config.
+					log.Println(err)
+					app.sendTextMessage(chatId, "Конфиг не обновлен: "+err.Error())
+					break
+				}
+				configMutex.Lock()
+				*config = *newConfig
+				app.AdminChatId = getAdminChatId(newConfig)
+				configMutex.Unlock()
+				// tabs could be changed by coordinators, so they are checked again before next write.
+				forgetPreparedSheets()
+				log.Println("[walkthedog_bot]: App config was reread")
+				lastMessage = commandRereadConfigFile
+			}
+		case commandUpdateGoogleAuth:
+			if isAdmin {
+				//googleSpreadsheet := sheet.NewGoogleSpreadsheet(*config.Google)
 
-		// If we got a message
-		if update.Message != nil {
-			isAdmin = update.Message.Chat.ID == adminChatId
-			log.Printf("[%s]: %s", update.Message.From.UserName, update.Message.Text)
-			log.Printf("lastMessage: %s", lastMessage)
-
-			var msgObj tgbotapi.MessageConfig
-			//check for commands
-			switch update.Message.Text {
-			case "/sh":
-				//for testing
-				spew.Dump("start")
-
-				spew.Dump("end")
-			case commandStart:
-				log.Println("[walkthedog_bot]: Send start message")
-				msgObj = startMessage(chatId)
-				msgObj.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-				app.Bot.Send(msgObj)
-				lastMessage = commandStart
-			case commandGoShelter:
-				log.Println("[walkthedog_bot]: Send appointmentOptionsMessage message")
-				lastMessage = app.goShelterCommand(&update)
-			case commandChooseShelter:
-				lastMessage = app.chooseShelterCommand(&update, &shelters)
-			case commandTripDates:
-				lastMessage = app.tripDatesCommand(&update, newTripToShelter, &shelters, lastMessage)
-			case commandMasterclass:
-				log.Println("[walkthedog_bot]: Send masterclass")
-				msgObj = masterclass(chatId)
-				app.Bot.Send(msgObj)
-				lastMessage = commandMasterclass
-			case commandDonation:
-				log.Println("[walkthedog_bot]: Send donation")
-				lastMessage = app.donationCommand(chatId)
-			case commandDonationShelterList:
-				log.Println("[walkthedog_bot]: Send donationShelterList")
-				msgObj = donationShelterList(chatId, &shelters)
+				var message string
+				authURL, err := sheet.RequestAuthCodeURL(*app.Google)
+				if err != nil {
+					message = err.Error()
+				} else {
+					message = authURL + " \r\n Необходимо перейти по ссылке дать разрешения в гугле, после редиректа скопировать ссылку и отправить боту"
+				}
+				msgObj := tgbotapi.NewMessage(adminChatId, message)
 				app.Bot.Send(msgObj)
-				lastMessage = commandDonationShelterList
-			//system commands
-			case commandRereadShelters:
+				lastMessage = commandUpdateGoogleAuth
+			}
+		case commandFreeSeat:
+			if isAdmin {
+				app.sendTextMessage(chatId, errorWrongFreeSeat)
+				lastMessage = commandFreeSeat
+			}
+		case commandOutbox:
+			if isAdmin {
+				app.sendTextMessage(chatId, app.outboxSummary())
+				lastMessage = commandOutbox
+			}
+		case commandClearCache:
+			if isAdmin {
+				// send cached trips and outbox first
+				app.sendCachedTripsToGSheet()
+				app.processOutbox(dates.Now(), true)
+				// clear cache
+				app.Cache.Flush()
+				log.Println("[walkthedog_bot]: Cache was cleared")
+				lastMessage = commandClearCache
+			}
+		default:
+			if next, ok := registrationFlow.Handle(conversation, lastMessage, flow.Input{Text: update.Message.Text}); ok {
+				lastMessage = next
+				newTripToShelter = conversation.trip
+				break
+			}
+			switch lastMessage {
+			case commandMyTrips:
+				lastMessage = app.cancelTripCommand(&update, &shelters)
+			case commandFreeSeat:
 				if isAdmin {
-					// getting shelters again
-					shelters, err = getShelters()
-					if err != nil {
-						log.Panic(err)
+					fields := strings.Fields(update.Message.Text)
+					if len(fields) != 2 {
+						lastMessage = app.ErrorFrontend(&update, errorWrongFreeSeat)
+						break
 					}
-					log.Println("[walkthedog_bot]: Shelters list was reread")
-					lastMessage = commandRereadShelters
-				}
-			case commandRereadConfigFile:
-				if isAdmin {
-					config, err = getConfig()
+					shelterId, err := strconv.Atoi(fields[1])
 					if err != nil {
-						log.Panic(err)
+						lastMessage = app.ErrorFrontend(&update, errorWrongFreeSeat)
+						break
+					}
+					shelter, ok := shelters[shelterId]
+					if !ok {
+						lastMessage = app.ErrorFrontend(&update, errorWrongShelterName)
+						break
 					}
-					log.Println("[walkthedog_bot]: App config was reread")
-					lastMessage = commandRereadConfigFile
+					app.freeSeat(shelter, fields[0])
+					app.sendTextMessage(chatId, fmt.Sprintf("Место на выезд %s %s освобождено", fields[0], shelter.Title))
+					lastMessage = commandFreeSeat
 				}
 			case commandUpdateGoogleAuth:
 				if isAdmin {
-					//googleSpreadsheet := sheet.NewGoogleSpreadsheet(*config.Google)
-
-					var message string
-					authURL, err := sheet.RequestAuthCodeURL()
+					//extract code from url
+					u, err := url.Parse(update.Message.Text)
 					if err != nil {
-						message = err.Error()
-					} else {
-						message = authURL + " \r\n Необходимо перейти по ссылке дать разрешения в гугле, после редиректа скопировать ссылку и отправить боту"
-					}
-					msgObj := tgbotapi.NewMessage(adminChatId, message)
-					app.Bot.Send(msgObj)
-					lastMessage = commandUpdateGoogleAuth
-				}
-			case commandClearCache:
-				if isAdmin {
-					// send cached trips first
-					app.sendCachedTripsToGSheet()
-					// clear cache
-					app.Cache.Flush()
-					log.Println("[walkthedog_bot]: Cache was cleared")
-					lastMessage = commandClearCache
-				}
-			default:
-				switch lastMessage {
-				case commandGoShelter:
-					if update.Message.Text == chooseByShelter {
-						lastMessage = app.chooseShelterCommand(&update, &shelters)
-					} else if update.Message.Text == chooseByDate {
-						lastMessage = app.tripByDateAvailableMonthesCommand(&update, newTripToShelter, &shelters, lastMessage)
-						break
-					} else {
-						itsMonth := false
-						//check if it's month
-						for i, v := range months {
-							if update.Message.Text == v {
-								lastMessage = app.tripByDateAvailableDatesByMonthCommand(&update, newTripToShelter, &shelters, lastMessage, i)
-								itsMonth = true
-							}
-						}
-						if itsMonth {
-							break
-						}
-
-						app.ErrorFrontend(&update, "Кажется вы ошиблись с месяцем 🤔 Давайте попробуем заново")
-						lastMessage = app.goShelterCommand(&update)
+						lastMessage = app.ErrorFrontend(&update, err.Error())
 						break
 					}
-				// when shelter was chosen next step to chose date
-				case commandChooseShelter:
-					if newTripToShelter == nil {
-						newTripToShelter = NewTripToShelter(update.Message.From.UserName)
-					}
-					shelter, err := shelters.getShelterByNameID(update.Message.Text)
-
+					m, err := url.ParseQuery(u.RawQuery)
 					if err != nil {
-						app.ErrorFrontend(&update, err.Error())
-						app.chooseShelterCommand(&update, &shelters)
+						lastMessage = app.ErrorFrontend(&update, err.Error())
 						break
 					}
-					newTripToShelter.Shelter = shelter
-					if shelter.ID == "10" {
-						message := `<b>Зоотель "Лемур" находится в г. Воскресенск на юго-востоке от Москвы (80 км от МКАД по Новорязанское шоссе).</b>
-В этом районе нет приютов, а только стационары двух ветклиник. Здесь содержатся до 30 бездомных кошек и до 8 собак. Большинство имеют те или иные заболевания и травмы. В зоотеле животные проходят полный курс лечения и стерилизации. Вот примерная точка (https://yandex.ru/maps/-/CCUNFHxqCB) на город Воскресенск.
-						
-Мы сейчас не организуем групповые выезды туда, так как на передержке обычно немного собак, с которыми могло бы погулять большое количество людей. 
-						
-При этом любой человек может самостоятельно приехать в Лемур. Также в Лемуре стоит «Корзина добра» для сбора помощи бездомным животным Воскресенского района. 
-						 
-Приехать в Лемур можно в любой день с 10 до 18. 
-Перед тем как поехать - напишите нам в чат @walkthedog_lemur c датой когда хотите приехать (в ответ мы пришлем все детали).
-						
-Подробнее про Лемур: walkthedog.ru/lemur`
-						msgObj := tgbotapi.NewMessage(chatId, message)
-
-						msgObj.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-						msgObj.ParseMode = tgbotapi.ModeHTML
-						app.Bot.Send(msgObj)
+					/* // @TODO send request for auth again (probably need to remove token.json first)
+					e := os.Remove("token.json")
+					if e != nil {
+						log.Fatal(e)
+					} */
+					// save new token by parsed auth code
+					err = sheet.AuthorizationCodeToToken(*app.Google, m["code"][0])
+					if err != nil {
+						lastMessage = app.ErrorFrontend(&update, err.Error())
 						break
 					}
-					/* 					// check if no trips dates
-					   					if !isShelterHasTripDates(shelter) {
-					   						message := `Прию`
-					   												msgObj := tgbotapi.NewMessage(chatId, message)
-
-					   												msgObj.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-					   												msgObj.ParseMode = tgbotapi.ModeHTML
-					   												app.Bot.Send(msgObj)
-					   												break
-					   					} */
-
-					log.Println("[walkthedog_bot]: Send whichDate question")
-					msgObj = whichDate(chatId, shelter)
+					message := "G.Sheet токен авторизации обновлен"
+					msgObj := tgbotapi.NewMessage(adminChatId, message)
 					app.Bot.Send(msgObj)
-					lastMessage = commandChooseDateAfterShelter
-				case commandChooseDateAfterShelter:
-					if isTripDateValid(update.Message.Text, newTripToShelter) {
-						lastMessage = app.isFirstTripCommand(update.Message.Text, update.Message.Chat.ID, newTripToShelter)
-					} else {
-						app.ErrorFrontend(&update, "Кажется вы ошиблись с датой 🤔")
-						lastMessage = app.tripDatesCommand(&update, newTripToShelter, &shelters, lastMessage)
-					}
-				case commandChooseDateAfterMonth:
-					splitString := strings.Split(update.Message.Text, ",")
-					if len(splitString) < 2 {
-						app.ErrorFrontend(&update, "Кажется вы ошиблись с датой 🤔 Давайте попробуем заново")
-						lastMessage = app.goShelterCommand(&update)
-					} else {
-						// Safe access after bounds check
-						shelter := strings.TrimSpace(splitString[1])
-						date := strings.TrimSpace(splitString[0])
-
-						if newTripToShelter == nil {
-							newTripToShelter = NewTripToShelter(update.Message.From.UserName)
-						}
-
-						for _, v := range shelters {
-							//spew.Dump(v.Title, dateAndShelter[1])
-							if v.Title == shelter {
-								newTripToShelter.Shelter = v
-								break
-							}
-						}
-						//spew.Dump(newTripToShelter)
-						if isTripDateValid(date, newTripToShelter) {
-							lastMessage = app.isFirstTripCommand(date, update.Message.Chat.ID, newTripToShelter)
-						} else {
-							app.ErrorFrontend(&update, "Кажется вы ошиблись с датой 🤔 Давайте попробуем заново")
-							lastMessage = app.goShelterCommand(&update)
-						}
-					}
-				case commandIsFirstTrip:
-					lastMessage, err = app.tripPurposeCommand(&update, newTripToShelter)
-					if err != nil {
-						app.ErrorFrontend(&update, err.Error())
-						if isTripDateValid(update.Message.Text, newTripToShelter) {
-							lastMessage = app.isFirstTripCommand(update.Message.Text, update.Message.Chat.ID, newTripToShelter)
-						} else {
-							lastMessage = app.tripDatesCommand(&update, newTripToShelter, &shelters, lastMessage)
-						}
-					}
-				case commandSendUserContact:
-					// set username.
-					newTripToShelter.Username = update.Message.Text
-					app.registrationFinished(chatId, newTripToShelter)
-				case commandTripPurpose:
-					app.ErrorFrontend(&update, "Выберите цели поездки и нажмите кнопку голосовать")
-				case commandTripBy:
-					app.ErrorFrontend(&update, "Расскажите как добираетесь до приюта")
-				case commandHowYouKnowAboutUs:
-					app.ErrorFrontend(&update, "Расскажите как вы о нас узнали")
-				case commandUpdateGoogleAuth:
-					if isAdmin {
-						//extract code from url
-						u, err := url.Parse(update.Message.Text)
-						if err != nil {
-							lastMessage = app.ErrorFrontend(&update, err.Error())
-							break
-						}
-						m, err := url.ParseQuery(u.RawQuery)
-						if err != nil {
-							lastMessage = app.ErrorFrontend(&update, err.Error())
-							break
-						}
-						/* // @TODO send request for auth again (probably need to remove token.json first)
-						e := os.Remove("token.json")
-						if e != nil {
-							log.Fatal(e)
-						} */
-						// save new token by parsed auth code
-						err = sheet.AuthorizationCodeToToken(m["code"][0])
-						if err != nil {
-							lastMessage = app.ErrorFrontend(&update, err.Error())
-							break
-						}
-						message := "G.Sheet токен авторизации обновлен"
-						msgObj := tgbotapi.NewMessage(adminChatId, message)
-						app.Bot.Send(msgObj)
-
-						//@TODO try to send cached trips
-						app.sendCachedTripsToGSheet()
-					}
-				default:
-					log.Println("[walkthedog_bot]: Unknown command")
 
-					message := "Не понимаю 🐶 Попробуй " + commandStart
-					msgObj := tgbotapi.NewMessage(chatId, message)
-					app.Bot.Send(msgObj)
-					lastMessage = commandChooseDateAfterShelter
+					// new token is read from file, so next expiration of auth is reported again.
+					app.checkGoogleAuth()
+
+					// send trips which were not saved while token was expired
+					app.sendCachedTripsToGSheet()
+					app.processOutbox(dates.Now(), true)
 				}
+			default:
+				log.Println("[walkthedog_bot]: Unknown command")
+
+				message := "Не понимаю 🐶 Попробуй " + commandStart
+				msgObj := tgbotapi.NewMessage(chatId, message)
+				app.Bot.Send(msgObj)
 			}
-		} else if update.Poll != nil {
-			//log.Printf("[%s]: %s", update.FromChat().FirstName, "save poll id")
-			//polls[update.Poll.ID] = update.FromChat().ID
-		} else if update.PollAnswer != nil {
-			isAdmin = update.PollAnswer.User.UserName == config.Administration.Admin
-			log.Printf("[%s]: %v", update.PollAnswer.User.UserName, update.PollAnswer.OptionIDs)
-			log.Printf("lastMessage: %s", lastMessage)
+		}
+	} else if update.Poll != nil {
+		//log.Printf("[%s]: %s", update.FromChat().FirstName, "save poll id")
+		//polls[update.Poll.ID] = update.FromChat().ID
+	} else if update.PollAnswer != nil {
+		isAdmin = update.PollAnswer.User.UserName == admin
+		log.Printf("[%s]: %v", update.PollAnswer.User.UserName, update.PollAnswer.OptionIDs)
+		log.Printf("lastMessage: %s", lastMessage)
+
+		input := flow.Input{PollOptions: update.PollAnswer.OptionIDs, IsPollAnswer: true}
+		if next, ok := registrationFlow.Handle(conversation, lastMessage, input); ok {
+			lastMessage = next
+			newTripToShelter = conversation.trip
+		} else {
+			log.Printf("[walkthedog_bot]: Poll answer is not expected after %s", lastMessage)
+		}
+	}
+	// save state to pool
+	statePoolMutex.Lock()
+	statePool[chatId] = &models.State{
+		ChatId:         chatId,
+		LastMessage:    lastMessage,
+		TripToShelter:  newTripToShelter,
+		CreatedAt:      createdAt,
+		LastActivityAt: now,
+	}
+	statePoolMutex.Unlock()
+	markSessionsChanged()
+	log.Println("[trip_state]: ", newTripToShelter)
+}
 
-			switch lastMessage {
-			case commandTripPurpose:
-				for _, option := range update.PollAnswer.OptionIDs {
+// registration is conversation with user about trip to shelter, it's passed to steps of registration flow.
+type registration struct {
+	app      *AppConfig
+	update   *tgbotapi.Update
+	chatId   int64
+	trip     *models.TripToShelter
+	shelters *SheltersList
+}
+
+// registrationFlow is registration to shelter started by /go_shelter command, steps are named by last command sent to user.
+var registrationFlow = newRegistrationFlow()
+
+// registrationFinishedSteps is list of steps which can follow registrationFinished.
+var registrationFinishedSteps = []string{
+	commandDonation,
+	commandSummaryShelterTrip,
+	commandChooseDateAfterShelter,
+	commandDuplicateRegistration,
+}
+
+// newRegistrationFlow returns steps of registration to shelter from choosing of shelter or date till summary.
+func newRegistrationFlow() *flow.Flow[*registration] {
+	registrationFlow, err := flow.New(
+		func(conversation *registration, message string) {
+			log.Println("[walkthedog_bot]: Send ERROR")
+			conversation.app.Bot.Send(errorMessage(conversation.chatId, message))
+		},
+		&flow.Step[*registration]{
+			Name:         commandGoShelter,
+			Options:      append([]string{chooseByShelter, chooseByDate}, months...),
+			ErrorMessage: "Кажется вы ошиблись с месяцем 🤔 Давайте попробуем заново",
+			OnError: func(conversation *registration) string {
+				return conversation.app.goShelterCommand(conversation.update)
+			},
+			Handle: func(conversation *registration, input flow.Input) string {
+				switch input.Text {
+				case chooseByShelter:
+					return conversation.app.chooseShelterCommand(conversation.update, conversation.shelters)
+				case chooseByDate:
+					return conversation.app.tripByDateAvailableMonthesCommand(conversation.update, conversation.trip, conversation.shelters, commandGoShelter)
+				}
+				for i, v := range months {
+					if input.Text == v {
+						return conversation.app.tripByDateAvailableDatesByMonthCommand(conversation.update, conversation.trip, conversation.shelters, commandGoShelter, i)
+					}
+				}
+				return commandGoShelter
+			},
+			Next: []string{commandChooseShelter, commandChooseDateAfterMonth},
+		},
+		&flow.Step[*registration]{
+			Name: commandChooseShelter,
+			Validate: func(conversation *registration, input flow.Input) error {
+				_, err := conversation.shelters.getShelterByNameID(input.Text)
+				return err
+			},
+			OnError: func(conversation *registration) string {
+				return conversation.app.chooseShelterCommand(conversation.update, conversation.shelters)
+			},
+			Handle: func(conversation *registration, input flow.Input) string {
+				shelter, _ := conversation.shelters.getShelterByNameID(input.Text)
+				// answers of previous registration in the same session are not kept.
+				conversation.trip = NewTripToShelter(conversation.update.Message.From.UserName)
+				conversation.trip.Shelter = shelter
+				if shelter.Description != "" {
+					msgObj := tgbotapi.NewMessage(conversation.chatId, shelter.Description)
+					msgObj.ParseMode = tgbotapi.ModeHTML
+					msgObj.DisableWebPagePreview = true
+					conversation.app.Bot.Send(msgObj)
+				}
+
+				log.Println("[walkthedog_bot]: Send whichDate question")
+				msgObj := whichDate(conversation.chatId, shelter)
+				conversation.app.Bot.Send(msgObj)
+				return commandChooseDateAfterShelter
+			},
+			Next: []string{commandChooseDateAfterShelter},
+		},
+		&flow.Step[*registration]{
+			Name: commandChooseDateAfterShelter,
+			Validate: func(conversation *registration, input flow.Input) error {
+				var shelter *models.Shelter
+				if conversation.trip != nil {
+					shelter = conversation.trip.Shelter
+				}
+				return validateTripDate(trimSeatsInfo(input.Text), shelter, "Кажется вы ошиблись с датой 🤔")
+			},
+			OnError: func(conversation *registration) string {
+				return conversation.app.tripDatesCommand(conversation.update, conversation.trip, conversation.shelters, commandChooseDateAfterShelter)
+			},
+			Handle: func(conversation *registration, input flow.Input) string {
+				return conversation.app.tripDateChosen(conversation.chatId, trimSeatsInfo(input.Text), conversation.trip)
+			},
+			Next: []string{commandIsFirstTrip},
+		},
+		&flow.Step[*registration]{
+			Name: commandChooseDateAfterMonth,
+			Validate: func(conversation *registration, input flow.Input) error {
+				date, shelter, err := conversation.shelters.getDateAndShelter(input.Text)
+				if err != nil {
+					shelter = nil
+				}
+				return validateTripDate(date, shelter, "Кажется вы ошиблись с датой 🤔 Давайте попробуем заново")
+			},
+			OnError: func(conversation *registration) string {
+				return conversation.app.goShelterCommand(conversation.update)
+			},
+			Handle: func(conversation *registration, input flow.Input) string {
+				date, shelter, _ := conversation.shelters.getDateAndShelter(input.Text)
+				// answers of previous registration in the same session are not kept.
+				conversation.trip = NewTripToShelter(conversation.update.Message.From.UserName)
+				conversation.trip.Shelter = shelter
+				return conversation.app.tripDateChosen(conversation.chatId, date, conversation.trip)
+			},
+			Next: []string{commandIsFirstTrip},
+		},
+		&flow.Step[*registration]{
+			Name: commandIsFirstTrip,
+			Validate: func(conversation *registration, input flow.Input) error {
+				// user can change date of the trip before answering.
+				if input.Text == "Да" || input.Text == "Нет" || isTripDateValid(trimSeatsInfo(input.Text), conversation.trip) {
+					return nil
+				}
+				return errors.New("доступные ответы \"Да\" и \"Нет\"")
+			},
+			OnError: func(conversation *registration) string {
+				return conversation.app.isFirstTripCommand(conversation.trip.Date, conversation.chatId, conversation.trip)
+			},
+			Handle: func(conversation *registration, input flow.Input) string {
+				if date := trimSeatsInfo(input.Text); isTripDateValid(date, conversation.trip) {
+					return conversation.app.tripDateChosen(conversation.chatId, date, conversation.trip)
+				}
+				lastMessage, _ := conversation.app.tripPurposeCommand(conversation.update, conversation.trip)
+				return lastMessage
+			},
+			Next: []string{commandTripPurpose},
+		},
+		&flow.Step[*registration]{
+			Name:         commandTripPurpose,
+			PollAnswer:   true,
+			ErrorMessage: "Выберите цели поездки и нажмите кнопку голосовать",
+			Handle: func(conversation *registration, input flow.Input) string {
+				// user votes again if next poll wasn't sent.
+				conversation.trip.Purpose = nil
+				for _, option := range input.PollOptions {
 					if option >= 0 && option < len(purposes) {
-						newTripToShelter.Purpose = append(newTripToShelter.Purpose, purposes[option])
+						conversation.trip.Purpose = append(conversation.trip.Purpose, purposes[option])
 					} else {
 						log.Printf("Invalid purpose option ID: %d", option)
 					}
 				}
-
-				lastMessage = app.tripByCommand(&update, newTripToShelter)
-			case commandTripBy:
-				for _, option := range update.PollAnswer.OptionIDs {
+				return conversation.app.tripByCommand(conversation.update, conversation.trip)
+			},
+			Next: []string{commandTripBy},
+		},
+		&flow.Step[*registration]{
+			Name:         commandTripBy,
+			PollAnswer:   true,
+			ErrorMessage: "Расскажите как добираетесь до приюта",
+			Handle: func(conversation *registration, input flow.Input) string {
+				for _, option := range input.PollOptions {
 					if option >= 0 && option < len(tripByOptions) {
-						newTripToShelter.TripBy = tripByOptions[option]
+						conversation.trip.TripBy = tripByOptions[option]
 					} else {
 						log.Printf("Invalid tripBy option ID: %d", option)
 					}
 					break
 				}
-				lastMessage = app.howYouKnowAboutUsCommand(&update, newTripToShelter)
-			case commandHowYouKnowAboutUs:
-				for _, option := range update.PollAnswer.OptionIDs {
+				return conversation.app.howYouKnowAboutUsCommand(conversation.update, conversation.trip)
+			},
+			Next: []string{commandHowYouKnowAboutUs},
+		},
+		&flow.Step[*registration]{
+			Name:         commandHowYouKnowAboutUs,
+			PollAnswer:   true,
+			ErrorMessage: "Расскажите как вы о нас узнали",
+			Handle: func(conversation *registration, input flow.Input) string {
+				for _, option := range input.PollOptions {
 					if option >= 0 && option < len(sources) {
-						newTripToShelter.HowYouKnowAboutUs = append(newTripToShelter.HowYouKnowAboutUs, sources[option])
+						conversation.trip.HowYouKnowAboutUs = append(conversation.trip.HowYouKnowAboutUs, sources[option])
 					} else {
 						log.Printf("Invalid source option ID: %d", option)
 					}
 				}
 
 				// if user dont set username
-				if update.PollAnswer.User.UserName == "" {
-					pollsMutex.RLock()
-					chatIdFromPoll := polls[update.PollAnswer.PollID]
-					pollsMutex.RUnlock()
-					lastMessage = app.askForContactCommand(chatIdFromPoll)
-					break
+				if conversation.update.PollAnswer.User.UserName == "" {
+					return conversation.app.askForContactCommand(conversation.chatId)
 				}
+				return conversation.app.registrationFinished(conversation.chatId, conversation.trip)
+			},
+			Next: append([]string{commandSendUserContact}, registrationFinishedSteps...),
+		},
+		&flow.Step[*registration]{
+			Name: commandSendUserContact,
+			Handle: func(conversation *registration, input flow.Input) string {
+				// set username.
+				conversation.trip.Username = input.Text
+				return conversation.app.registrationFinished(conversation.chatId, conversation.trip)
+			},
+			Next: registrationFinishedSteps,
+		},
+		&flow.Step[*registration]{
+			Name:         commandDuplicateRegistration,
+			Options:      []string{keepEarlierAnswers, replaceEarlierAnswers},
+			ErrorMessage: "Выберите один из вариантов ответа",
+			OnError: func(conversation *registration) string {
+				msgObj := duplicateRegistration(conversation.chatId, conversation.trip)
+				conversation.app.Bot.Send(msgObj)
+				return commandDuplicateRegistration
+			},
+			Handle: func(conversation *registration, input flow.Input) string {
+				return conversation.app.duplicateRegistrationCommand(conversation.update, conversation.trip)
+			},
+			Next: registrationFinishedSteps,
+		},
+		// registration is finished, next messages are not part of registration.
+		&flow.Step[*registration]{Name: commandDonation},
+		&flow.Step[*registration]{Name: commandSummaryShelterTrip},
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+	return registrationFlow
+}
 
-				app.registrationFinished(chatId, newTripToShelter)
-			}
-		}
-		// save state to pool
-		state.LastMessage = lastMessage
-		state.TripToShelter = newTripToShelter
-		statePoolMutex.Lock()
-		statePool[chatId] = state
-		statePoolMutex.Unlock()
-		log.Println("[trip_state]: ", newTripToShelter)
+// getAdminChatId returns chat id of admin from config or 0 if it's not set.
+func getAdminChatId(config *models.ConfigFile) int64 {
+	if config.Administration.Admin == "" {
+		log.Println("config.Administration.Admin is empty!")
+		return 0
 	}
+	adminChatId, err := strconv.Atoi(config.Administration.Admin)
+	if err != nil {
+		log.Println(err)
+	}
+	return int64(adminChatId)
 }
 
 // goShelterCommand prepares message about available options to start appointment to shelter and then sends it and returns last command.
@@ -650,7 +1114,26 @@ func (app *AppConfig) isFirstTripCommand(message string, chatID int64, newTripTo
 	return commandIsFirstTrip
 }
 
-// isTripDateValid return true if it's one of the available dates of shelter trip.
+// tripDateChosen saves date of the trip chosen by user, warns if there are no free seats and asks if it's first trip. It returns last command.
+func (app *AppConfig) tripDateChosen(chatId int64, date string, newTripToShelter *models.TripToShelter) string {
+	if !hasFreeSeats(newTripToShelter.Shelter, date) {
+		app.sendTextMessage(chatId, messageWaitlistOffer)
+	}
+	return app.isFirstTripCommand(date, chatId, newTripToShelter)
+}
+
+// validateTripDate returns error with message for user if date is not one of the available dates of shelter trip.
+func validateTripDate(date string, shelter *models.Shelter, wrongDateMessage string) error {
+	if isTripDateValid(date, &models.TripToShelter{Shelter: shelter}) {
+		return nil
+	}
+	if isRegistrationClosed(date, shelter) {
+		return errors.New(registrationClosedMessage(shelter))
+	}
+	return errors.New(wrongDateMessage)
+}
+
+// isTripDateValid return true if it's one of the available dates of shelter trip and registration for it is still open.
 func isTripDateValid(date string, newTripToShelter *models.TripToShelter) bool {
 	isCorrectDate := false
 
@@ -671,6 +1154,29 @@ func isTripDateValid(date string, newTripToShelter *models.TripToShelter) bool {
 	return isCorrectDate
 }
 
+// isRegistrationClosed returns true if date is one of the upcoming dates of shelter trip but registration for it is already closed.
+func isRegistrationClosed(date string, shelter *models.Shelter) bool {
+	if shelter == nil {
+		return false
+	}
+	now := dates.Now()
+	for _, occurrence := range schedule.Upcoming(shelter, now) {
+		if formatTripDate(occurrence) == date {
+			return !isRegistrationOpen(occurrence, now)
+		}
+	}
+	return false
+}
+
+// registrationClosedMessage returns message for user who tries to register for the trip with closed registration.
+func registrationClosedMessage(shelter *models.Shelter) string {
+	message := messageRegistrationClosed
+	if cutoff := getRegistrationCutoff(shelter); cutoff > 0 {
+		message += fmt.Sprintf(" Регистрация закрывается за %s до начала выезда.", formatCutoff(cutoff))
+	}
+	return message + " Пожалуйста, выберите другую дату."
+}
+
 // isShelterHasTripDates return true if shelter has available dates of trips.
 func isShelterHasTripDates(shelter *models.Shelter) bool {
 	return shelter.Schedule.Type != "none"
@@ -690,49 +1196,41 @@ func (app *AppConfig) tripPurposeCommand(update *tgbotapi.Update, newTripToShelt
 
 	responseMessage, err := app.Bot.Send(msgObj)
 	if err != nil {
-		log.Fatalln(err)
+		// poll is sent again when user answers again.
+		log.Printf("Unable to send poll about trip purpose to chat %d: %v", update.Message.Chat.ID, err)
+		return commandIsFirstTrip, nil
 	}
-	pollsMutex.Lock()
-	polls[responseMessage.Poll.ID] = responseMessage.Chat.ID
-	pollsMutex.Unlock()
+	addPoll(responseMessage.Poll.ID, responseMessage.Chat.ID)
 
 	return commandTripPurpose, nil
 }
 
 // tripByCommand prepares poll with question about how he going to come to shelter and then sends it and returns last command.
 func (app *AppConfig) tripByCommand(update *tgbotapi.Update, newTripToShelter *models.TripToShelter) string {
-	pollsMutex.RLock()
-	chatId := polls[update.PollAnswer.PollID]
-	pollsMutex.RUnlock()
+	chatId, _ := getPollChatId(update.PollAnswer.PollID)
 	msgObj := tripBy(chatId)
 	responseMessage, err := app.Bot.Send(msgObj)
 	if err != nil {
-		log.Fatalln(err)
+		// poll is sent again when user votes again.
+		log.Printf("Unable to send poll about trip by to chat %d: %v", chatId, err)
+		return commandTripPurpose
 	}
-	pollsMutex.Lock()
-	polls[responseMessage.Poll.ID] = responseMessage.Chat.ID
-	pollsMutex.Unlock()
+	addPoll(responseMessage.Poll.ID, responseMessage.Chat.ID)
 	return commandTripBy
 }
 
 // howYouKnowAboutUsCommand prepares poll with question about where did you know about us and then sends it and returns last command.
 func (app *AppConfig) howYouKnowAboutUsCommand(update *tgbotapi.Update, newTripToShelter *models.TripToShelter) string {
-	pollsMutex.RLock()
-	chatId := polls[update.PollAnswer.PollID]
-	pollsMutex.RUnlock()
+	chatId, _ := getPollChatId(update.PollAnswer.PollID)
 	msgObj := howYouKnowAboutUs(chatId)
 	responseMessage, err := app.Bot.Send(msgObj)
-
 	if err != nil {
-		//@TODO if i got error here I don't have chat id in response(but have PollAnswer.PollID and PollAnswer.User). So need to get chat id and display error that bot is broken.
-		log.Fatalln(err)
-		/* app.ErrorFrontend(update, newTripToShelter, "У бота временные проблемы 😥")
-		return commandError */
+		// poll is sent again when user votes again.
+		log.Printf("Unable to send poll about how you know about us to chat %d: %v", chatId, err)
+		return commandTripBy
 	}
 
-	pollsMutex.Lock()
-	polls[responseMessage.Poll.ID] = responseMessage.Chat.ID
-	pollsMutex.Unlock()
+	addPoll(responseMessage.Poll.ID, responseMessage.Chat.ID)
 	return commandHowYouKnowAboutUs
 }
 
@@ -771,6 +1269,39 @@ func (app *AppConfig) askForContactCommand(chatId int64) string {
 	return commandSendUserContact
 }
 
+// myTripsCommand prepares message with list of user's upcoming trips and then sends it and returns last command.
+func (app *AppConfig) myTripsCommand(chatId int64) string {
+	msgObj := myTrips(chatId, getUpcomingRegistrations(chatId, dates.Now()))
+	app.Bot.Send(msgObj)
+	return commandMyTrips
+}
+
+// cancelTripCommand cancels trip chosen by user and returns last command.
+func (app *AppConfig) cancelTripCommand(update *tgbotapi.Update, shelters *SheltersList) string {
+	chatId := update.Message.Chat.ID
+	if !strings.HasPrefix(update.Message.Text, cancelTripPrefix) {
+		app.ErrorFrontend(update, "Выберите выезд, который хотите отменить")
+		return app.myTripsCommand(chatId)
+	}
+	date, shelter, err := shelters.getDateAndShelter(strings.TrimPrefix(update.Message.Text, cancelTripPrefix))
+	if err != nil {
+		app.ErrorFrontend(update, err.Error())
+		return app.myTripsCommand(chatId)
+	}
+
+	tripToShelter := removeRegistration(chatId, shelter, date)
+	if tripToShelter == nil {
+		app.ErrorFrontend(update, "Не нашли такую запись 🤔")
+		return app.myTripsCommand(chatId)
+	}
+	app.cancelTrip(tripToShelter)
+
+	msgObj := tgbotapi.NewMessage(chatId, messageTripCancelled)
+	msgObj.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	app.Bot.Send(msgObj)
+	return commandSummaryShelterTrip
+}
+
 // getShelterByNameID returns Shelter and error using given shelter name in following format:
 // 1. Хаски Хелп (Истра)
 // it substr string before dot and try to find shelter by ID.
@@ -795,6 +1326,26 @@ func (shelters SheltersList) getShelterByNameID(name string) (*models.Shelter, e
 	return shelter, nil
 }
 
+// getDateAndShelter returns date and Shelter using given text in following format:
+// Сб 05.11.2022 11:00, Хаски Хелп (Истра) — осталось мест: 5
+// information about free seats is ignored.
+func (shelters SheltersList) getDateAndShelter(text string) (string, *models.Shelter, error) {
+	text = trimSeatsInfo(text)
+	commaPosition := strings.Index(text, ",")
+	if commaPosition == -1 {
+		return "", nil, errors.New(errorWrongDate)
+	}
+	date := strings.TrimSpace(text[:commaPosition])
+	title := strings.TrimSpace(text[commaPosition+1:])
+	for _, shelter := range shelters {
+		if shelter.Title == title {
+			return date, shelter, nil
+		}
+	}
+
+	return "", nil, errors.New(errorWrongShelterName)
+}
+
 // ErrorFrontend sends error message to user and returns last command.
 func (app *AppConfig) ErrorFrontend(update *tgbotapi.Update, errMessage string) string {
 	log.Println("[walkthedog_bot]: Send ERROR")
@@ -841,6 +1392,10 @@ func getShelters() (SheltersList, error) {
 			log.Println("Can't convert ID to int")
 			continue
 		}
+		err = schedule.Validate(&value.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("shelter %s has wrong schedule: %v", value.ID, err)
+		}
 		sheltersList[id] = value
 	}
 	return sheltersList, nil
@@ -878,6 +1433,8 @@ func startMessage(chatId int64) tgbotapi.MessageConfig {
 	//ask about what shelter are you going
 	message := `🐕 /go_shelter Записаться на выезд в приют
 
+🗓 /my_trips Мои записи на выезды
+
 📐 /masterclass Записаться на мастер-класс по изготовлению будок и котодомиков для приютов
 
 ❤️ /donation Сделать пожертвование
@@ -936,7 +1493,7 @@ func whichMonth(chatId int64) tgbotapi.MessageConfig {
 	msgObj := tgbotapi.NewMessage(chatId, message)
 
 	howManyMonthsDisplay := 6
-	curMonth := time.Now().Month()
+	curMonth := dates.Now().Month()
 	monthIndex := int(curMonth) - 1
 
 	var sheltersButtons [][]tgbotapi.KeyboardButton
@@ -973,6 +1530,10 @@ func whichDateByMonth(chatId int64, shelters *SheltersList, monthIndex int) tgbo
 
 	shelterDates := getDatesByMonth(monthIndex, shelters)
 	for _, value := range shelterDates {
+		date, shelter, err := shelters.getDateAndShelter(value)
+		if err == nil {
+			value += seatsInfo(shelter, date)
+		}
 		buttonRow := tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton(value),
 		)
@@ -1002,7 +1563,7 @@ func whichDate(chatId int64, shelter *models.Shelter) tgbotapi.MessageConfig {
 	shelterDates := getDatesByShelter(shelter)
 	for _, value := range shelterDates {
 		buttonRow := tgbotapi.NewKeyboardButtonRow(
-			tgbotapi.NewKeyboardButton(value),
+			tgbotapi.NewKeyboardButton(value + seatsInfo(shelter, value)),
 		)
 		dateButtons = append(dateButtons, buttonRow)
 	}
@@ -1014,58 +1575,9 @@ func whichDate(chatId int64, shelter *models.Shelter) tgbotapi.MessageConfig {
 
 // getDatesByShelter return list of dates.
 func getDatesByShelter(shelter *models.Shelter) []string {
-	// shedules stores shelters shedule where key is date + shelter id. It needs for temprorary store dates to sort them later.
-	var shedules = make(map[int]string)
-	// sortedKeys we need for sorting shedules by keys.
-	var sortedKeys []int
 	var shedule []string
-	now := time.Now()
-	spew.Dump(shelter)
-	if shelter.Schedule.Type == "regularly" {
-		var trips = shelter.Schedule.Details
-		for _, tripDate := range trips {
-			scheduleWeek := tripDate[0]
-			scheduleDay := tripDate[1]
-			scheduleTime := shelter.Schedule.TimeStart
-			for i := 0; i < 6; i++ {
-				month := time.Month(int(now.Month()) + i)
-				day := calculateDay(scheduleDay, scheduleWeek, month)
-				if i == 0 && now.Day() > day.Day() {
-					continue
-				}
-				formatedDate := day.Format("02.01.2006")
-				isException := false
-				//check for exceptions
-				for _, v := range shelter.Schedule.DatesExceptions {
-					if v == formatedDate {
-						isException = true
-						break
-					}
-				}
-				if isException {
-					continue
-				}
-
-				index, err := strconv.Atoi(day.Format("20060102"))
-				if err != nil {
-					log.Println("Can't convert date to int")
-					continue
-				}
-				sortedKeys = append(sortedKeys, index)
-				shedules[index] = dates.WeekDaysRu[day.Weekday()] + " " + formatedDate + " " + scheduleTime
-			}
-		}
-		// sorting dates.
-		sort.Ints(sortedKeys)
-
-		// build final slice of shedule sorted by date.
-		for _, value := range sortedKeys {
-			shedule = append(shedule, shedules[value])
-		}
-	} else if shelter.Schedule.Type == "everyday" {
-		//TODO: finish everyday type
-	} else if shelter.Schedule.Type == "none" {
-		// do nothing
+	for _, occurrence := range getShelterDays(shelter, dates.Now()) {
+		shedule = append(shedule, formatTripDate(occurrence))
 	}
 
 	return shedule
@@ -1077,49 +1589,29 @@ func getDatesByMonth(monthIndex int, shelters *SheltersList) []string {
 	var shedules = make(map[int][]string)
 	// sortedKeys we need for sorting shedules by keys.
 	var sortedKeys []int
-	now := time.Now()
+	now := dates.Now()
+	month := time.Month(monthIndex + 1)
 
 	for _, shelter := range *shelters {
-		if shelter.Schedule.Type == "regularly" {
-			var trips = shelter.Schedule.Details
-			for _, tripDate := range trips {
-				scheduleWeek := tripDate[0]
-				scheduleDay := tripDate[1]
-				scheduleTime := shelter.Schedule.TimeStart
-
-				month := time.Month(monthIndex + 1)
-				day := calculateDay(scheduleDay, scheduleWeek, month)
-				if month == now.Month() && now.Day() > day.Day() {
-					continue
-				}
-				formatedDate := day.Format("02.01.2006")
-				isException := false
-				//check for exceptions
-				for _, v := range shelter.Schedule.DatesExceptions {
-					if v == formatedDate {
-						isException = true
-						break
-					}
-				}
-				if isException {
-					continue
-				}
+		for _, occurrence := range getShelterDays(shelter, now) {
+			if occurrence.Start.Month() != month {
+				continue
+			}
 
-				// Use only date for sorting
-				index, err := strconv.Atoi(day.Format("20060102"))
-				if err != nil {
-					log.Println("Can't convert date to int")
-					continue
-				}
+			// Use only date for sorting
+			index, err := strconv.Atoi(occurrence.Start.Format("20060102"))
+			if err != nil {
+				log.Println("Can't convert date to int")
+				continue
+			}
 
-				// Store all trips for the same date in a slice
-				dateStr := dates.WeekDaysRu[day.Weekday()] + " " + formatedDate + " " + scheduleTime + ", " + shelter.Title
-				shedules[index] = append(shedules[index], dateStr)
+			// Store all trips for the same date in a slice
+			dateStr := formatTripDate(occurrence) + ", " + shelter.Title
+			shedules[index] = append(shedules[index], dateStr)
 
-				// Only add index once per date
-				if len(shedules[index]) == 1 {
-					sortedKeys = append(sortedKeys, index)
-				}
+			// Only add index once per date
+			if len(shedules[index]) == 1 {
+				sortedKeys = append(sortedKeys, index)
 			}
 		}
 	}
@@ -1136,6 +1628,65 @@ func getDatesByMonth(monthIndex int, shelters *SheltersList) []string {
 	return shedule
 }
 
+// getShelterDays returns sorted list of upcoming trips to shelter which are open for registration at given time.
+func getShelterDays(shelter *models.Shelter, now time.Time) []schedule.Occurrence {
+	var result []schedule.Occurrence
+	for _, occurrence := range schedule.Upcoming(shelter, now) {
+		if !isRegistrationOpen(occurrence, now) {
+			continue
+		}
+		result = append(result, occurrence)
+	}
+	return result
+}
+
+// isRegistrationOpen returns true if registration for the trip is still open at given time.
+func isRegistrationOpen(occurrence schedule.Occurrence, now time.Time) bool {
+	return now.Add(getRegistrationCutoff(occurrence.Shelter)).Before(occurrence.Start)
+}
+
+// getRegistrationCutoff returns how long before start of the trip registration to shelter closes.
+func getRegistrationCutoff(shelter *models.Shelter) time.Duration {
+	if shelter.Schedule.RegistrationCutoff == "" {
+		return registrationCutoff
+	}
+	cutoff, err := schedule.ParseCutoff(shelter.Schedule.RegistrationCutoff)
+	if err != nil {
+		return registrationCutoff
+	}
+	return cutoff
+}
+
+// formatCutoff returns registration cut-off in russian, e.g. "24 ч." or "1 ч. 30 мин.".
+func formatCutoff(cutoff time.Duration) string {
+	hours := int(cutoff.Hours())
+	minutes := int(cutoff.Minutes()) % 60
+	switch {
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%d ч. %d мин.", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%d ч.", hours)
+	default:
+		return fmt.Sprintf("%d мин.", minutes)
+	}
+}
+
+// getTripTime returns start and end time of trip to shelter on date from text like "Сб 05.11.2022 11:00".
+func getTripTime(shelter *models.Shelter, date string) (string, string) {
+	return schedule.TripTime(shelter, extractDate(date))
+}
+
+// getPeopleLimit returns max count of people on the trip to shelter on given date. Zero means no limit.
+func getPeopleLimit(shelter *models.Shelter, date string) int32 {
+	return schedule.PeopleLimit(shelter, extractDate(date))
+}
+
+// formatTripDate returns trip date as it's displayed to user, e.g. "Сб 05.11.2022 11:00".
+func formatTripDate(occurrence schedule.Occurrence) string {
+	timeStart, _ := schedule.TripTime(occurrence.Shelter, occurrence.Date())
+	return dates.WeekDaysRu[occurrence.Start.Weekday()] + " " + occurrence.Date() + " " + timeStart
+}
+
 // isFirstTrip returns object including message text "is your first trip" and other message config.
 func isFirstTrip(chatId int64) tgbotapi.MessageConfig {
 	message := "Это ваша первая поездка?"
@@ -1181,6 +1732,34 @@ func howYouKnowAboutUs(chatId int64) tgbotapi.SendPollConfig {
 	return msgObj
 }
 
+// myTrips returns object including message text with list of user's trips and buttons to cancel them.
+func myTrips(chatId int64, trips []*models.TripToShelter) tgbotapi.MessageConfig {
+	if len(trips) == 0 {
+		msgObj := tgbotapi.NewMessage(chatId, messageNoTrips)
+		msgObj.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+		return msgObj
+	}
+
+	message := "Ваши записи на выезды:\n"
+	var cancelButtons [][]tgbotapi.KeyboardButton
+	for _, trip := range trips {
+		message += fmt.Sprintf("\n📅 %s\n<a href=\"%s\">%s</a>\n", trip.Date, trip.Shelter.Link, trip.Shelter.Title)
+		if trip.Waitlisted {
+			message += "В листе ожидания\n"
+		}
+		cancelButtons = append(cancelButtons, tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton(cancelTripPrefix+trip.Date+", "+trip.Shelter.Title),
+		))
+	}
+	message += "\nЧтобы отменить запись, нажмите на кнопку с выездом."
+
+	msgObj := tgbotapi.NewMessage(chatId, message)
+	msgObj.ParseMode = tgbotapi.ModeHTML
+	msgObj.DisableWebPagePreview = true
+	msgObj.ReplyMarkup = tgbotapi.NewReplyKeyboard(cancelButtons...)
+	return msgObj
+}
+
 // summary returns object including message text with summary of user's answers and other message config.
 func summary(chatId int64, newTripToShelter *models.TripToShelter) tgbotapi.MessageConfig {
 	message := fmt.Sprintf(`Регистрация прошла успешно.
@@ -1203,6 +1782,33 @@ func summary(chatId int64, newTripToShelter *models.TripToShelter) tgbotapi.Mess
 	return msgObj
 }
 
+// reminderMessage returns object including message text with reminder about upcoming trip and other message config.
+func reminderMessage(tripReminder *models.Reminder) tgbotapi.MessageConfig {
+	trip := tripReminder.TripToShelter
+	timeStart, _ := getTripTime(trip.Shelter, trip.Date)
+	when := "завтра"
+	if tripReminder.DaysBefore != 1 {
+		when = fmt.Sprintf("через %d дн.", tripReminder.DaysBefore)
+	}
+	message := fmt.Sprintf(`⏰ Напоминаем, что %s выезд в приют <a href="%s">%s</a>
+
+Дата: %s
+Начало в %s`, when, trip.Shelter.Link, trip.Shelter.Title, extractDate(trip.Date), timeStart)
+	if trip.Shelter.Address != "" {
+		message += "\nАдрес: " + trip.Shelter.Address
+	}
+	if trip.Shelter.Guide != "" {
+		message += fmt.Sprintf("\n\n📄 <a href=\"%s\">Памятка волонтера</a>", trip.Shelter.Guide)
+	}
+	message += "\n\nЕсли планы изменились, отмените запись с помощью команды /my_trips"
+
+	msgObj := tgbotapi.NewMessage(trip.ChatId, message)
+	msgObj.ParseMode = tgbotapi.ModeHTML
+	msgObj.DisableWebPagePreview = true
+
+	return msgObj
+}
+
 // donation set donation text and message options and returns MessageConfig.
 func donation(chatId int64) tgbotapi.MessageConfig {
 	message :=
@@ -1239,341 +1845,1769 @@ func askContact(chatId int64) tgbotapi.MessageConfig {
 	return msgObj
 }
 
+// registrationFinished takes seat on the trip or puts user to the waitlist, sends summary and saves trip. It returns last command.
 func (app *AppConfig) registrationFinished(chatId int64, newTripToShelter *models.TripToShelter) string {
-	app.summaryCommand(chatId, newTripToShelter)
-	lastMessage := app.donationCommand(chatId)
+	var lastMessage string
+
+	// registration could be closed while user was answering the polls.
+	if isRegistrationClosed(newTripToShelter.Date, newTripToShelter.Shelter) {
+		app.sendTextMessage(chatId, registrationClosedMessage(newTripToShelter.Shelter))
+		msgObj := whichDate(chatId, newTripToShelter.Shelter)
+		app.Bot.Send(msgObj)
+		return commandChooseDateAfterShelter
+	}
+
+	// user could be already registered to this trip.
+	if registeredTrip := findRegistration(chatId, newTripToShelter.Shelter, newTripToShelter.Date); registeredTrip != nil {
+		msgObj := duplicateRegistration(chatId, registeredTrip)
+		app.Bot.Send(msgObj)
+		return commandDuplicateRegistration
+	}
 
-	// generate uniq ID for trip to shelter
-	date := newTripToShelter.Date
-	date = date[strings.Index(date, " ")+1 : strings.Index(date, " ")+10]
-	newTripToShelter.ID = date + newTripToShelter.Shelter.ShortTitle
+	newTripToShelter.ChatId = chatId
+	newTripToShelter.TripKey = getTripKey(newTripToShelter.Shelter, newTripToShelter.Date)
+	newTripToShelter.ID = newTripID(newTripToShelter)
+	newTripToShelter.Status = ""
+	newTripToShelter.RegisteredAt = dates.Now()
+
+	// trip could be filled up while user was answering the polls.
+	if reserveSeat(newTripToShelter.Shelter, newTripToShelter.Date) {
+		app.summaryCommand(chatId, newTripToShelter)
+		app.sendTripCalendar(chatId, newTripToShelter)
+		lastMessage = app.donationCommand(chatId)
+	} else {
+		newTripToShelter.Status = tripStatusWaitlist
+		newTripToShelter.Waitlisted = true
+		app.sendTextMessage(chatId, messageWaitlisted)
+		lastMessage = commandSummaryShelterTrip
+	}
 
-	app.saveTripToCache(newTripToShelter, chatId)
+	app.saveTrip(newTripToShelter)
 
-	isTripSent := app.sendTripToGSheet(chatId, newTripToShelter)
+	isTripSent := app.exportTrip(newTripToShelter)
 	if !isTripSent {
-		// send message to the admin. G.Sheet auth expired.
-		message := "G.Sheet auth expired."
-		msgObj := tgbotapi.NewMessage(app.AdminChatId, message)
-		app.Bot.Send(msgObj)
+		// trip will be saved by outbox worker later, admin is warned once if G.Sheet auth expired.
+		app.checkGoogleAuth()
+	}
+
+	// chat state keeps pointer to the trip, so registrations and waitlist store copy of it.
+	// Registration can be changed by workers as soon as it's added, so trip of the chat is used below.
+	registeredTrip := *newTripToShelter
+	addRegistration(&registeredTrip)
+	if !newTripToShelter.Waitlisted {
+		app.scheduleReminders(newTripToShelter)
+	} else {
+		addToWaitlist(&registeredTrip)
+		// seat could be freed while trip was saving.
+		app.promoteFromWaitlist(newTripToShelter.Shelter, newTripToShelter.Date)
 	}
 
 	return lastMessage
 }
 
-// calculateDay returns the date of by given day of week, week number and month.
-func calculateDay(dayOfWeek int, week int, month time.Month) time.Time {
-	year := time.Now().Year()
-	if month < time.Now().Month() {
-		year = time.Now().Year() + 1
+// duplicateRegistration returns message with question whether user wants to keep earlier answers to the same trip or replace them.
+func duplicateRegistration(chatId int64, registeredTrip *models.TripToShelter) tgbotapi.MessageConfig {
+	message := fmt.Sprintf("Вы уже записаны на выезд в приют %s %s. Оставить прежние ответы или заменить их новыми?", registeredTrip.Shelter.Title, trimSeatsInfo(registeredTrip.Date))
+	msgObj := tgbotapi.NewMessage(chatId, message)
+
+	var numericKeyboard = tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(
+		tgbotapi.NewKeyboardButton(keepEarlierAnswers),
+		tgbotapi.NewKeyboardButton(replaceEarlierAnswers),
+	))
+	msgObj.ReplyMarkup = numericKeyboard
+	return msgObj
+}
+
+// duplicateRegistrationCommand keeps earlier registration to the trip or replaces its answers by new ones and returns last command.
+func (app *AppConfig) duplicateRegistrationCommand(update *tgbotapi.Update, newTripToShelter *models.TripToShelter) string {
+	chatId := update.Message.Chat.ID
+	switch update.Message.Text {
+	case keepEarlierAnswers:
+		msgObj := tgbotapi.NewMessage(chatId, messageAnswersKept)
+		msgObj.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+		app.Bot.Send(msgObj)
+		return commandSummaryShelterTrip
+	default:
+		registeredTrip := app.replaceRegistration(chatId, newTripToShelter)
+		if registeredTrip == nil {
+			// earlier registration was cancelled meanwhile, so register as usual.
+			return app.registrationFinished(chatId, newTripToShelter)
+		}
+		app.summaryCommand(chatId, registeredTrip)
+		return commandSummaryShelterTrip
 	}
-	firstDayOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
-	//currentDay := (8 - int(firstDayOfMonth.Weekday())) % 7
+}
 
-	currentDay := int(firstDayOfMonth.Weekday())
-	if currentDay == 0 {
-		currentDay = 7
+// replaceRegistration replaces answers of chat's registration to the trip by new answers and returns updated registration.
+// Registration keeps its seat or place in the waitlist, earlier row in google sheet is marked as replaced and new row is added.
+// It returns nil if chat isn't registered to the trip.
+func (app *AppConfig) replaceRegistration(chatId int64, newTripToShelter *models.TripToShelter) *models.TripToShelter {
+	registrationsMutex.Lock()
+	registeredTrip := lookupRegistration(chatId, newTripToShelter.Shelter, newTripToShelter.Date)
+	if registeredTrip == nil {
+		registrationsMutex.Unlock()
+		return nil
 	}
-	var resultDay int
-	if dayOfWeek == currentDay {
-		resultDay = 1 + 7*(week-1)
-	} else if dayOfWeek > currentDay {
-		resultDay = 1 + (dayOfWeek - currentDay) + (week-1)*7
-	} else {
-		resultDay = 1 + (7 - currentDay + dayOfWeek) + (week-1)*7
+	replacedTrip := *registeredTrip
+	registeredTrip.ID = newTripID(registeredTrip)
+	registeredTrip.Username = newTripToShelter.Username
+	registeredTrip.IsFirstTrip = newTripToShelter.IsFirstTrip
+	registeredTrip.Purpose = newTripToShelter.Purpose
+	registeredTrip.TripBy = newTripToShelter.TripBy
+	registeredTrip.HowYouKnowAboutUs = newTripToShelter.HowYouKnowAboutUs
+	registeredTrip.SheetRange = ""
+	registeredTrip.RegisteredAt = dates.Now()
+	updatedTrip := *registeredTrip
+	registrationsMutex.Unlock()
+
+	log.Printf("[walkthedog_bot]: Trip %s of chat %d replaced by %s", replacedTrip.ID, chatId, updatedTrip.ID)
+	replacedTrip.Status = tripStatusReplaced + " " + dates.Now().Format("02.01.2006 15:04:05")
+	app.updateTripStatusInGSheet(&replacedTrip)
+	app.saveTrip(&replacedTrip)
+
+	app.saveTrip(&updatedTrip)
+	app.exportTrip(&updatedTrip)
+	return &updatedTrip
+}
+
+// newTripID returns unique ID of user's registration to the trip.
+func newTripID(tripToShelter *models.TripToShelter) string {
+	return fmt.Sprintf("%s_%d_%d", getTripKey(tripToShelter.Shelter, tripToShelter.Date), tripToShelter.ChatId, time.Now().UnixNano())
+}
+
+// extractDate returns date in format 02.01.2006 from text like "Сб 05.11.2022 11:00".
+// If text doesn't contain such a date it returns text as is.
+func extractDate(text string) string {
+	for _, field := range strings.Fields(text) {
+		if _, err := time.Parse("02.01.2006", field); err == nil {
+			return field
+		}
 	}
+	return text
+}
 
-	return time.Date(year, month, resultDay, 0, 0, 0, 0, time.UTC)
+// trimSeatsInfo removes information about free seats from text of date button.
+func trimSeatsInfo(text string) string {
+	if separatorPosition := strings.Index(text, seatsInfoSeparator); separatorPosition != -1 {
+		text = text[:separatorPosition]
+	}
+	return strings.TrimSpace(text)
 }
 
-// initCache init cache based on file or creates new.
-func initCache() (*cache.Cache, error) {
-	c := cache.New(5*time.Hour, 10*time.Hour)
+// getTripKey returns key of trip which is same for all volunteers registered to shelter on the date.
+func getTripKey(shelter *models.Shelter, date string) string {
+	return extractDate(date) + "_" + shelter.ID
+}
 
-	// Create cache directory if it doesn't exist
-	err := os.MkdirAll(cacheDir, 0755)
-	if err != nil {
-		log.Printf("Unable to create cache directory: %v", err)
-		return c, err
+// getFreeSeats returns count of free seats on the trip or -1 if shelter doesn't limit count of people.
+func getFreeSeats(shelter *models.Shelter, date string) int {
+	peopleLimit := getPeopleLimit(shelter, date)
+	if peopleLimit <= 0 {
+		return -1
 	}
+	tripSeatsMutex.RLock()
+	registered := tripSeats[getTripKey(shelter, date)]
+	tripSeatsMutex.RUnlock()
 
-	err = c.LoadFile(cacheDir + cacheFileName)
-	if err != nil {
-		if err.Error() == "EOF" {
-			log.Println("Cache file is empty.")
-		} else {
-			log.Println(err.Error())
-		}
-	} else {
-		log.Println("cache from file")
+	freeSeats := int(peopleLimit) - registered
+	if freeSeats < 0 {
+		freeSeats = 0
 	}
+	return freeSeats
+}
 
-	return c, nil
+// hasFreeSeats returns true if it's possible to register on the trip.
+func hasFreeSeats(shelter *models.Shelter, date string) bool {
+	return getFreeSeats(shelter, date) != 0
 }
 
-// startCleanupWorker runs periodic cleanup to prevent memory leaks
-func startCleanupWorker() {
-	ticker := time.NewTicker(30 * time.Minute) // Run every 30 minutes
-	defer ticker.Stop()
+// seatsInfo returns information about free seats to display it next to the date.
+func seatsInfo(shelter *models.Shelter, date string) string {
+	freeSeats := getFreeSeats(shelter, date)
+	switch {
+	case freeSeats < 0:
+		return ""
+	case freeSeats == 0:
+		return seatsInfoSeparator + "мест нет, лист ожидания"
+	default:
+		return fmt.Sprintf("%sосталось мест: %d", seatsInfoSeparator, freeSeats)
+	}
+}
 
-	for range ticker.C {
-		cleanupOldStates()
-		cleanupOldPolls()
+// reserveSeat takes one seat on the trip. It returns false if there are no free seats.
+func reserveSeat(shelter *models.Shelter, date string) bool {
+	key := getTripKey(shelter, date)
+	peopleLimit := getPeopleLimit(shelter, date)
+
+	tripSeatsMutex.Lock()
+	defer tripSeatsMutex.Unlock()
+	if peopleLimit > 0 && tripSeats[key] >= int(peopleLimit) {
+		return false
 	}
+	tripSeats[key]++
+	return true
 }
 
-// cleanupOldStates removes abandoned chat states
-func cleanupOldStates() {
-	statePoolMutex.Lock()
-	defer statePoolMutex.Unlock()
+// releaseSeat frees one seat on the trip.
+func releaseSeat(shelter *models.Shelter, date string) {
+	key := getTripKey(shelter, date)
 
-	removedCount := 0
-	for chatId, state := range statePool {
-		// Remove states with empty LastMessage (abandoned sessions)
-		if len(state.LastMessage) == 0 {
-			delete(statePool, chatId)
-			removedCount++
-		}
+	tripSeatsMutex.Lock()
+	defer tripSeatsMutex.Unlock()
+	if tripSeats[key] > 0 {
+		tripSeats[key]--
+	}
+	if tripSeats[key] == 0 {
+		delete(tripSeats, key)
 	}
-	log.Printf("Cleaned up %d abandoned states, current count: %d", removedCount, len(statePool))
 }
 
-// cleanupOldPolls removes poll mappings older than 24 hours
-func cleanupOldPolls() {
-	pollsMutex.Lock()
-	defer pollsMutex.Unlock()
+// addToWaitlist puts trip to the end of the waitlist.
+func addToWaitlist(tripToShelter *models.TripToShelter) {
+	trip := registrationSnapshot(tripToShelter)
+	key := getTripKey(trip.Shelter, trip.Date)
 
-	// Simple cleanup - remove all polls periodically
-	// In production, you'd want to track poll creation time
-	pollCount := len(polls)
-	polls = make(map[string]int64)
-	log.Printf("Cleaned up %d old polls", pollCount)
+	waitlistMutex.Lock()
+	defer waitlistMutex.Unlock()
+	waitlist[key] = append(waitlist[key], tripToShelter)
 }
 
-// saveCacheToFile saves cache to file.
-func saveCacheToFile(cache *cache.Cache) error {
-	/* f, err := ioutil.TempFile(cacheDir, cacheFileName)
-	if err != nil {
-		return err
-		//t.Fatal("Couldn't create cache file:", err)
+// popFromWaitlist takes seat for the first trip in the waitlist and removes it from the waitlist.
+// It returns nil if waitlist is empty or there are no free seats.
+func popFromWaitlist(shelter *models.Shelter, date string) *models.TripToShelter {
+	key := getTripKey(shelter, date)
+
+	waitlistMutex.Lock()
+	defer waitlistMutex.Unlock()
+	if len(waitlist[key]) == 0 {
+		return nil
 	}
-	fname := f.Name()
-	tempCacheFileName = fname
-	f.Close()
-	err = cache.SaveFile(fname) */
-	err := cache.SaveFile(cacheDir + cacheFileName)
-	if err != nil {
-		return err
+	if !reserveSeat(shelter, date) {
+		return nil
 	}
+	tripToShelter := waitlist[key][0]
+	waitlist[key] = waitlist[key][1:]
+	if len(waitlist[key]) == 0 {
+		delete(waitlist, key)
+	}
+	return tripToShelter
+}
 
-	return nil
+// freeSeat releases seat on the trip and promotes the first user from the waitlist.
+func (app *AppConfig) freeSeat(shelter *models.Shelter, date string) {
+	releaseSeat(shelter, date)
+	app.promoteFromWaitlist(shelter, date)
 }
 
-// saveTripToCache saves trip to cache.
-func (app *AppConfig) saveTripToCache(newTripToShelter *models.TripToShelter, chatId int64) {
-	//save newTripToShelter pointer to the object to the cache
-	app.Cache.Set(newTripToShelter.ID, *newTripToShelter, cache.NoExpiration)
+// promoteFromWaitlist moves the first user from the waitlist to the trip, notifies him and updates trip status in google sheet.
+func (app *AppConfig) promoteFromWaitlist(shelter *models.Shelter, date string) {
+	waitlistedTrip := popFromWaitlist(shelter, date)
+	if waitlistedTrip == nil {
+		return
+	}
+	tripToShelter := updateRegistration(waitlistedTrip, func(tripToShelter *models.TripToShelter) {
+		tripToShelter.Status = tripStatusPromoted + " " + dates.Now().Format("02.01.2006 15:04:05")
+		tripToShelter.Waitlisted = false
+	})
+	log.Printf("[walkthedog_bot]: Trip %s of chat %d promoted from waitlist", tripToShelter.ID, tripToShelter.ChatId)
+
+	app.sendTextMessage(tripToShelter.ChatId, messagePromoted)
+	app.summaryCommand(tripToShelter.ChatId, tripToShelter)
+	app.sendTripCalendar(tripToShelter.ChatId, tripToShelter)
+	app.scheduleReminders(tripToShelter)
+
+	app.saveTrip(tripToShelter)
+	app.updateTripStatusInGSheet(tripToShelter)
+}
 
-	// take all trips registrations that were not save to G.Sheets from cache
-	chatsWithTripsID := make(map[int64][]string)
-	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
-	if found {
-		if typedMap, ok := chatsWithTripsIDFromCache.(map[int64][]string); ok {
-			chatsWithTripsID = typedMap
-		} else {
-			log.Printf("Invalid type in cache for chats_have_trips, expected map[int64][]string")
+// removeFromWaitlist removes trip from the waitlist. It returns false if trip is not in the waitlist.
+func removeFromWaitlist(tripToShelter *models.TripToShelter) bool {
+	trip := registrationSnapshot(tripToShelter)
+	key := getTripKey(trip.Shelter, trip.Date)
+
+	waitlistMutex.Lock()
+	defer waitlistMutex.Unlock()
+	for i, v := range waitlist[key] {
+		if v == tripToShelter {
+			waitlist[key] = append(waitlist[key][:i], waitlist[key][i+1:]...)
+			if len(waitlist[key]) == 0 {
+				delete(waitlist, key)
+			}
+			return true
 		}
 	}
-	// add new registration chat id
-	chatsWithTripsID[chatId] = append(chatsWithTripsID[chatId], newTripToShelter.ID)
-	// save to the cache
-	app.Cache.Set("chats_have_trips", chatsWithTripsID, cache.NoExpiration)
-	/*
-		no need, i'll save to file before panic or exit
-		err := saveCacheToFile(ca)
-		if err != nil {
-			log.Printf("Unable save Cache To File: %v", err)
-		} */
+	return false
 }
 
-// removeTripFromCache removes trip from cache.
-func (app *AppConfig) removeTripFromCache(newTripToShelterId string, chatId int64) {
-	//delete newTripToShelter from cache by chatId
-	app.Cache.Delete(newTripToShelterId)
+// registrationSnapshot returns copy of registration. Registrations are shared by handlers of chats and workers,
+// so their fields are read by copies and changed by updateRegistration.
+func registrationSnapshot(tripToShelter *models.TripToShelter) *models.TripToShelter {
+	registrationsMutex.RLock()
+	defer registrationsMutex.RUnlock()
+	tripCopy := *tripToShelter
+	return &tripCopy
+}
 
-	/* // take all trips registrations that were not save to G.Sheets from cache
-	var tripIds []int64
-	var tripIdsResult []string
+// updateRegistration changes fields of registration under registrationsMutex and returns its copy.
+func updateRegistration(tripToShelter *models.TripToShelter, update func(tripToShelter *models.TripToShelter)) *models.TripToShelter {
+	registrationsMutex.Lock()
+	defer registrationsMutex.Unlock()
+	update(tripToShelter)
+	tripCopy := *tripToShelter
+	return &tripCopy
+}
 
-	tripIdsFromCache, found := app.Cache.Get("chats_have_trips")
-	if found {
-		tripIds = tripIdsFromCache.([]int64)
-	} */
+// addRegistration saves trip to the list of chat's registrations.
+func addRegistration(tripToShelter *models.TripToShelter) {
+	registrationsMutex.Lock()
+	defer registrationsMutex.Unlock()
+	registrations[tripToShelter.ChatId] = append(registrations[tripToShelter.ChatId], tripToShelter)
+}
 
-	var tripIdsResult []string
-	// remove trips from array
-	chatsWithTripsID := make(map[int64][]string)
-	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
-	if found {
-		if typedMap, ok := chatsWithTripsIDFromCache.(map[int64][]string); ok {
-			chatsWithTripsID = typedMap
-		} else {
-			log.Printf("Invalid type in cache for chats_have_trips, expected map[int64][]string")
-			return
-		}
-	}
-	tripsByChatId, ok := chatsWithTripsID[chatId]
-	// exit if don't have such a key in array
-	if !ok {
-		return
-	}
-	for i, v := range tripsByChatId {
-		if v == newTripToShelterId {
-			if len(tripsByChatId) == 1 {
-				// we need to delete trip from array by chat id and for this chat id only one trip exist. So remove chat id from map and underlying value.
-				delete(chatsWithTripsID, chatId)
-			} else {
-				tripIdsResult = append(tripIdsResult, tripsByChatId[:i]...)
-				tripIdsResult = append(tripIdsResult, tripsByChatId[i+1:]...)
-				chatsWithTripsID[chatId] = tripIdsResult
+// removeRegistration removes trip to shelter on given date from the list of chat's registrations and returns it.
+// It returns nil if there is no such a registration.
+func removeRegistration(chatId int64, shelter *models.Shelter, date string) *models.TripToShelter {
+	registrationsMutex.Lock()
+	defer registrationsMutex.Unlock()
+	for i, v := range registrations[chatId] {
+		if v.Shelter.ID == shelter.ID && extractDate(v.Date) == extractDate(date) {
+			registrations[chatId] = append(registrations[chatId][:i], registrations[chatId][i+1:]...)
+			if len(registrations[chatId]) == 0 {
+				delete(registrations, chatId)
 			}
-			break
+			return v
 		}
 	}
-	// save to the cache
-	app.Cache.Set("chats_have_trips", chatsWithTripsID, cache.NoExpiration)
+	return nil
 }
 
-// sendTextMessage sends message
-func (app *AppConfig) sendTextMessage(chatId int64, message string) (tgbotapi.Message, error) {
-	msgObj := tgbotapi.NewMessage(chatId, message)
-	return app.Bot.Send(msgObj)
+// findRegistration returns copy of chat's registration to shelter on the date or nil if there is no such a registration.
+func findRegistration(chatId int64, shelter *models.Shelter, date string) *models.TripToShelter {
+	registrationsMutex.RLock()
+	defer registrationsMutex.RUnlock()
+	registeredTrip := lookupRegistration(chatId, shelter, date)
+	if registeredTrip == nil {
+		return nil
+	}
+	tripCopy := *registeredTrip
+	return &tripCopy
 }
 
-// sendCachedTripsToGSheet
-func (app *AppConfig) sendCachedTripsToGSheet() {
-	chatsWithTripsID := make(map[int64][]string)
-	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
-	if found {
-		if typedMap, ok := chatsWithTripsIDFromCache.(map[int64][]string); ok {
-			chatsWithTripsID = typedMap
+// lookupRegistration returns chat's registration to shelter on the date or nil if there is no such a registration.
+// It must be called with locked registrationsMutex.
+func lookupRegistration(chatId int64, shelter *models.Shelter, date string) *models.TripToShelter {
+	for _, v := range registrations[chatId] {
+		if v.Shelter.ID == shelter.ID && extractDate(v.Date) == extractDate(date) {
+			return v
+		}
+	}
+	return nil
+}
+
+// getUpcomingRegistrations returns copies of chat's trips which are not passed yet sorted by date.
+func getUpcomingRegistrations(chatId int64, now time.Time) []*models.TripToShelter {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	var trips []*models.TripToShelter
+	registrationsMutex.RLock()
+	for _, v := range registrations[chatId] {
+		day, err := time.Parse("02.01.2006", extractDate(v.Date))
+		if err != nil || day.Before(today) {
+			continue
+		}
+		tripCopy := *v
+		trips = append(trips, &tripCopy)
+	}
+	registrationsMutex.RUnlock()
+
+	sort.SliceStable(trips, func(i, j int) bool {
+		dayI, _ := time.Parse("02.01.2006", extractDate(trips[i].Date))
+		dayJ, _ := time.Parse("02.01.2006", extractDate(trips[j].Date))
+		return dayI.Before(dayJ)
+	})
+	return trips
+}
+
+// cancelTrip frees seat or removes trip from the waitlist and saves cancellation status to google sheet.
+func (app *AppConfig) cancelTrip(tripToShelter *models.TripToShelter) {
+	app.releaseTrip(tripToShelter)
+	cancelledTrip := updateRegistration(tripToShelter, func(tripToShelter *models.TripToShelter) {
+		tripToShelter.Status = tripStatusCancelled + " " + dates.Now().Format("02.01.2006 15:04:05")
+	})
+	log.Printf("[walkthedog_bot]: Trip %s of chat %d cancelled", cancelledTrip.ID, cancelledTrip.ChatId)
+
+	app.saveTrip(cancelledTrip)
+	app.updateTripStatusInGSheet(cancelledTrip)
+}
+
+// releaseTrip frees seat or removes trip from the waitlist and removes reminders about it.
+func (app *AppConfig) releaseTrip(tripToShelter *models.TripToShelter) {
+	trip := registrationSnapshot(tripToShelter)
+	if !removeFromWaitlist(tripToShelter) {
+		app.freeSeat(trip.Shelter, trip.Date)
+	}
+	if app.Reminders != nil {
+		err := app.Reminders.RemoveByTrip(trip.ChatId, trip.Shelter.ID, trip.Date)
+		if err != nil {
+			log.Printf("Unable to remove reminders: %v", err)
+		}
+	}
+}
+
+// takeSeat takes seat on the trip even if there are no free seats, e.g. when coordinator confirmed trip.
+func takeSeat(shelter *models.Shelter, date string) {
+	key := getTripKey(shelter, date)
+
+	tripSeatsMutex.Lock()
+	defer tripSeatsMutex.Unlock()
+	tripSeats[key]++
+}
+
+// isTripClosed returns true if trip with the status doesn't take seat anymore: it's cancelled, rejected, replaced or moved to another date.
+func isTripClosed(status string) bool {
+	return strings.HasPrefix(status, tripStatusCancelled) ||
+		strings.HasPrefix(status, tripStatusMoved) ||
+		strings.HasPrefix(status, tripStatusReplaced) ||
+		hasSheetStatus(status, sheetStatusRejected)
+}
+
+// hasSheetStatus checks if status set by coordinator starts with sheetStatus ignoring case.
+func hasSheetStatus(status string, sheetStatus string) bool {
+	return strings.HasPrefix(strings.ToLower(status), strings.ToLower(sheetStatus))
+}
+
+// saveTrip saves registration and its changes to the trip repository.
+func (app *AppConfig) saveTrip(tripToShelter *models.TripToShelter) {
+	if app.Trips == nil {
+		return
+	}
+	err := app.Trips.Save(tripToShelter)
+	if err != nil {
+		log.Printf("Unable to save trip %s of chat %d: %v", tripToShelter.ID, tripToShelter.ChatId, err)
+	}
+}
+
+// restoreTrips restores seats, waitlists and registrations of upcoming trips from the trip repository.
+// Shelters of restored trips are replaced by shelters from the current list.
+func (app *AppConfig) restoreTrips(shelters SheltersList) error {
+	if app.Trips == nil {
+		return nil
+	}
+
+	trips, err := app.Trips.List()
+	if err != nil {
+		return err
+	}
+
+	now := dates.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, dates.Location())
+	restored := 0
+	for _, tripToShelter := range trips {
+		day, err := time.ParseInLocation("02.01.2006", extractDate(tripToShelter.Date), dates.Location())
+		if err != nil || day.Before(today) {
+			continue
+		}
+		if isTripClosed(tripToShelter.Status) {
+			continue
+		}
+		if id, err := strconv.Atoi(tripToShelter.Shelter.ID); err == nil {
+			if shelter, ok := shelters[id]; ok {
+				tripToShelter.Shelter = shelter
+			}
+		}
+
+		addRegistration(tripToShelter)
+		if tripToShelter.Waitlisted {
+			addToWaitlist(tripToShelter)
 		} else {
-			log.Printf("Invalid type in cache for chats_have_trips, expected map[int64][]string")
+			key := getTripKey(tripToShelter.Shelter, tripToShelter.Date)
+			tripSeatsMutex.Lock()
+			tripSeats[key]++
+			tripSeatsMutex.Unlock()
+		}
+		restored++
+	}
+
+	log.Printf("Restored %d registrations to upcoming trips", restored)
+	return nil
+}
+
+// updateTripStatusInGSheet writes trip status to the row where trip was saved.
+// If it fails, status is written later by outbox worker.
+func (app *AppConfig) updateTripStatusInGSheet(tripToShelter *models.TripToShelter) {
+	if app.Outbox == nil {
+		entry := &models.OutboxEntry{Kind: outbox.KindStatus, TripToShelter: *tripToShelter}
+		err := app.writeOutboxEntry(entry)
+		if err != nil {
+			log.Printf("Unable to update trip status: %v", err)
+		}
+		tripToShelter.SheetRange = entry.TripToShelter.SheetRange
+		app.updateTripSheetRange(entry)
+		return
+	}
+
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	isPendingTrip := func(pendingTrip *models.TripToShelter) bool {
+		return isSameTrip(pendingTrip, tripToShelter)
+	}
+	pending := app.Outbox.Find(outbox.KindAppend, isPendingTrip)
+	if pending == nil {
+		// previous status is not written yet, so new status is written instead of it.
+		pending = app.Outbox.Find(outbox.KindStatus, isPendingTrip)
+	}
+	var entry *models.OutboxEntry
+	if pending != nil {
+		pending.TripToShelter.Status = tripToShelter.Status
+		err := app.Outbox.Update(pending)
+		if err != nil {
+			log.Printf("Unable to update outbox entry %s: %v", pending.ID, err)
+		}
+		if writingOutboxEntries[pending] {
+			// new status is written after write in progress is finished.
+			return
+		}
+		if pending.Kind == outbox.KindAppend && !pending.MainSaved {
+			// trip is not saved yet, so it will be saved with new status.
 			return
 		}
+		if pending.Kind == outbox.KindStatus {
+			entry = pending
+		} else {
+			tripToShelter.SheetRange = pending.TripToShelter.SheetRange
+		}
 	}
-	for chatId, TripsIDs := range chatsWithTripsID {
-		for _, v := range TripsIDs {
-			var tripToShelter models.TripToShelter
-			tripFromCache, found := app.Cache.Get(v)
-			if found {
-				if typedTrip, ok := tripFromCache.(models.TripToShelter); ok {
-					tripToShelter = typedTrip
-				} else {
-					log.Printf("Invalid type in cache for trip %s, expected models.TripToShelter", v)
-					continue
-				}
+
+	if entry == nil {
+		entry = &models.OutboxEntry{Kind: outbox.KindStatus, TripToShelter: *tripToShelter}
+		err := app.Outbox.Add(entry)
+		if err != nil {
+			log.Printf("Unable to add trip status to outbox: %v", err)
+		}
+	}
+	app.processOutboxEntry(entry, dates.Now())
+	tripToShelter.SheetRange = entry.TripToShelter.SheetRange
+}
+
+// exportTrip puts trip to the outbox and tries to save it to google sheet right away.
+// It returns false if trip wasn't saved, then it's saved later by outbox worker.
+func (app *AppConfig) exportTrip(tripToShelter *models.TripToShelter) bool {
+	if tripToShelter == nil {
+		log.Printf("Trip to shelter is nil")
+		return false
+	}
+	entry := &models.OutboxEntry{Kind: outbox.KindAppend, TripToShelter: *tripToShelter}
+	if app.Outbox == nil {
+		err := app.writeOutboxEntry(entry)
+		if err != nil {
+			log.Printf("Unable to write data to sheet: %v", err)
+		}
+		tripToShelter.SheetRange = entry.TripToShelter.SheetRange
+		app.updateTripSheetRange(entry)
+		return err == nil
+	}
+
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	err := app.Outbox.Add(entry)
+	if err != nil {
+		log.Printf("Unable to add trip %s to outbox: %v", tripToShelter.ID, err)
+	}
+	isTripSent := app.processOutboxEntry(entry, dates.Now())
+	tripToShelter.SheetRange = entry.TripToShelter.SheetRange
+	return isTripSent
+}
+
+// startGoogleAuthCheck checks that bot is authenticated in google sheets on start and then periodically.
+func (app *AppConfig) startGoogleAuthCheck() {
+	runWorkerTask("google auth check", app.checkGoogleAuth)
+
+	ticker := time.NewTicker(authCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWorkerTask("google auth check", app.checkGoogleAuth)
+	}
+}
+
+// checkGoogleAuth checks that bot is still authenticated in google sheets and warns admin if refresh token is expired or revoked.
+func (app *AppConfig) checkGoogleAuth() {
+	if app.SheetsService == nil {
+		return
+	}
+
+	err := app.SheetsService.CheckAuth()
+	if err == nil {
+		// auth is updated, so the next expiration is reported again.
+		googleAuthWarningMutex.Lock()
+		googleAuthWarningSent = false
+		googleAuthWarningMutex.Unlock()
+		return
+	}
+	if !sheet.IsAuthError(err) {
+		log.Printf("Unable to check G.Sheet auth: %v", err)
+		return
+	}
+	app.warnGoogleAuthExpired(err)
+}
+
+// warnGoogleAuthExpired sends admin warning with link to authorize bot in google sheets again.
+// Warning is sent once until auth is updated.
+func (app *AppConfig) warnGoogleAuthExpired(authErr error) {
+	googleAuthWarningMutex.Lock()
+	defer googleAuthWarningMutex.Unlock()
+	if googleAuthWarningSent {
+		return
+	}
+	log.Printf("G.Sheet auth expired: %v", authErr)
+
+	message := "⚠️ G.Sheet auth expired. Регистрации сохраняются в очередь и будут записаны после обновления токена."
+	if app.Outbox != nil {
+		message += fmt.Sprintf(" Записей в очереди: %d", app.Outbox.Len())
+	}
+	var authURL string
+	if app.Google != nil {
+		authURL, _ = sheet.RequestAuthCodeURL(*app.Google)
+	}
+	if authURL != "" {
+		message += "\n\nНеобходимо перейти по ссылке и дать разрешения в гугле: " + authURL +
+			"\nПосле редиректа отправьте " + commandUpdateGoogleAuth + " и затем скопированную ссылку."
+	} else {
+		message += "\n\nЧтобы обновить токен, отправьте " + commandUpdateGoogleAuth
+	}
+
+	configMutex.RLock()
+	adminChatId := app.AdminChatId
+	configMutex.RUnlock()
+	_, err := app.sendTextMessage(adminChatId, message)
+	if err != nil {
+		log.Printf("Unable to warn admin about expired G.Sheet auth: %v", err)
+		return
+	}
+	googleAuthWarningSent = true
+}
+
+// startStatusSync periodically reads statuses of trips from google sheet and notifies volunteers about changes.
+func (app *AppConfig) startStatusSync() {
+	ticker := time.NewTicker(statusSyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWorkerTask("status sync", func() {
+			err := app.syncTripStatuses(dates.Now())
+			if err != nil {
+				log.Printf("Unable to sync trip statuses: %v", err)
 			}
-			isTripSent := app.sendTripToGSheet(chatId, &tripToShelter)
-			if isTripSent {
-				log.Printf("Trip %s from cache sent to G.Sheet", tripToShelter.ID)
-				app.removeTripFromCache(tripToShelter.ID, chatId)
-			} else {
-				log.Println("Can't send trip to GSheet, so strop loop")
-				break
+		})
+	}
+}
+
+// syncTripStatuses reads dates and statuses of upcoming trips from google sheet and applies changes made by coordinators.
+// Trips with pending writes in the outbox are skipped, because sheet doesn't have their latest status yet.
+func (app *AppConfig) syncTripStatuses(now time.Time) error {
+	if app.SheetsService == nil {
+		return nil
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, dates.Location())
+	// registrations and their copies read at the same time.
+	var trips, snapshots []*models.TripToShelter
+	registrationsMutex.RLock()
+	for _, chatRegistrations := range registrations {
+		for _, tripToShelter := range chatRegistrations {
+			day, err := time.ParseInLocation("02.01.2006", extractDate(tripToShelter.Date), dates.Location())
+			if err != nil || day.Before(today) || tripToShelter.SheetRange == "" {
+				continue
 			}
+			tripCopy := *tripToShelter
+			trips = append(trips, tripToShelter)
+			snapshots = append(snapshots, &tripCopy)
+		}
+	}
+	registrationsMutex.RUnlock()
+	// changes are applied in the same order every time, so seats freed by rejected trips are taken in predictable order.
+	order := make([]int, len(trips))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return snapshots[order[i]].ChatId < snapshots[order[j]].ChatId
+	})
+
+	var syncedTrips, syncedSnapshots []*models.TripToShelter
+	var tripRanges []string
+	for _, i := range order {
+		if app.hasPendingWrites(snapshots[i]) {
+			continue
 		}
+		syncedTrips = append(syncedTrips, trips[i])
+		syncedSnapshots = append(syncedSnapshots, snapshots[i])
+		tripRanges = append(tripRanges, snapshots[i].SheetRange)
+	}
+	if len(tripRanges) == 0 {
+		return nil
 	}
 
-	/* // try to find trip details by trip's id
-	for _, v := range tripIds {
-		//get newTripToShelter pointer
-		var tripToShelter *models.TripToShelter
-		tripToShelterFromCache, found := app.Cache.Get(fmt.Sprintf("%d", v))
-		if found {
-			tripToShelter = tripToShelterFromCache.(*models.TripToShelter)
+	statuses, err := app.SheetsService.GetTripStatuses(tripRanges)
+	if err != nil {
+		return err
+	}
+	for i, tripToShelter := range syncedTrips {
+		sheetStatus, ok := statuses[syncedSnapshots[i].SheetRange]
+		// bot could change trip while statuses were read, e.g. promote it from the waitlist, then it's synced next time.
+		if !ok || registrationSnapshot(tripToShelter).Status != syncedSnapshots[i].Status {
+			continue
 		}
+		app.applySheetStatus(tripToShelter, sheetStatus)
+	}
+	return nil
+}
 
-		isTripSent := app.sendTripToGSheet(v, tripToShelter)
-		if isTripSent {
-			app.removeTripFromCache(v)
-		} else {
-			log.Println("Can't send trip to GSheet, so strop loop")
+// hasPendingWrites checks if outbox has writes of the trip to google sheet which are not done yet.
+func (app *AppConfig) hasPendingWrites(tripToShelter *models.TripToShelter) bool {
+	if app.Outbox == nil {
+		return false
+	}
+	match := func(pendingTrip *models.TripToShelter) bool {
+		return isSameTrip(pendingTrip, tripToShelter)
+	}
+	return app.Outbox.Find(outbox.KindAppend, match) != nil || app.Outbox.Find(outbox.KindStatus, match) != nil
+}
+
+// applySheetStatus applies date and status of trip changed by coordinator in google sheet and notifies volunteer.
+// Registration is changed by updateRegistration, because it's read by handlers of chats at the same time.
+func (app *AppConfig) applySheetStatus(tripToShelter *models.TripToShelter, sheetStatus *models.TripSheetStatus) {
+	changed := false
+	trip := registrationSnapshot(tripToShelter)
+	if sheetStatus.Date != "" && extractDate(sheetStatus.Date) != extractDate(trip.Date) {
+		changed = app.moveTrip(tripToShelter, sheetStatus)
+		trip = registrationSnapshot(tripToShelter)
+	}
+
+	if sheetStatus.Status != trip.Status {
+		log.Printf("[walkthedog_bot]: Status of trip %s of chat %d changed in google sheet: %q", trip.ID, trip.ChatId, sheetStatus.Status)
+		shelter := trip.Shelter
+		date := trimSeatsInfo(trip.Date)
+		switch {
+		case hasSheetStatus(sheetStatus.Status, sheetStatusRejected):
+			removeRegistration(trip.ChatId, shelter, trip.Date)
+			app.releaseTrip(tripToShelter)
+			app.sendTextMessage(trip.ChatId, fmt.Sprintf(messageTripRejected, shelter.Title, date))
+		case hasSheetStatus(sheetStatus.Status, sheetStatusConfirmed):
+			if removeFromWaitlist(tripToShelter) {
+				// coordinator confirmed trip from the waitlist, so volunteer takes seat even if there are no free seats.
+				trip = updateRegistration(tripToShelter, func(tripToShelter *models.TripToShelter) {
+					tripToShelter.Waitlisted = false
+				})
+				takeSeat(shelter, trip.Date)
+				app.scheduleReminders(trip)
+			}
+			app.sendTextMessage(trip.ChatId, fmt.Sprintf(messageTripConfirmed, shelter.Title, date))
+		case sheetStatus.Status != "":
+			// other statuses are notes of coordinator, waitlisted trip stays in the waitlist.
+			app.sendTextMessage(trip.ChatId, fmt.Sprintf(messageTripStatusChanged, shelter.Title, date, sheetStatus.Status))
+		}
+		trip = updateRegistration(tripToShelter, func(tripToShelter *models.TripToShelter) {
+			tripToShelter.Status = sheetStatus.Status
+		})
+		changed = true
+	}
+
+	if changed {
+		app.saveTrip(trip)
+	}
+}
+
+// moveTrip moves trip to the date set by coordinator in google sheet, moves seat or place in the waitlist and reminders.
+// It returns false if date in google sheet isn't a date.
+func (app *AppConfig) moveTrip(tripToShelter *models.TripToShelter, sheetStatus *models.TripSheetStatus) bool {
+	trip := registrationSnapshot(tripToShelter)
+	newDate := extractDate(sheetStatus.Date)
+	if _, err := time.Parse("02.01.2006", newDate); err != nil {
+		log.Printf("Unable to move trip %s of chat %d to %q: %v", trip.ID, trip.ChatId, sheetStatus.Date, err)
+		return false
+	}
+	// use date in the same format as dates of the shelter schedule if possible.
+	newDate = sheetStatus.Date
+	for _, date := range getDatesByShelter(trip.Shelter) {
+		if extractDate(date) == extractDate(sheetStatus.Date) {
+			newDate = date
 			break
 		}
-	} */
+	}
+	oldDate := trip.Date
+	log.Printf("[walkthedog_bot]: Trip %s of chat %d moved from %s to %s", trip.ID, trip.ChatId, oldDate, newDate)
+
+	// registration on the old date is kept in the history as moved one.
+	movedTrip := *trip
+	movedTrip.Status = tripStatusMoved + " " + newDate
+	app.saveTrip(&movedTrip)
+
+	app.releaseTrip(tripToShelter)
+	trip = updateRegistration(tripToShelter, func(tripToShelter *models.TripToShelter) {
+		tripToShelter.Date = newDate
+		tripToShelter.TripKey = getTripKey(tripToShelter.Shelter, newDate)
+	})
+	if trip.Waitlisted {
+		addToWaitlist(tripToShelter)
+		app.promoteFromWaitlist(trip.Shelter, newDate)
+	} else {
+		takeSeat(trip.Shelter, newDate)
+		app.scheduleReminders(trip)
+	}
+
+	app.sendTextMessage(trip.ChatId, fmt.Sprintf(messageTripMoved, trip.Shelter.Title, trimSeatsInfo(oldDate), trimSeatsInfo(newDate)))
+	return true
 }
 
-// sendTripToGSheet.
-func (app *AppConfig) sendTripToGSheet(chatId int64, newTripToShelter *models.TripToShelter) bool {
-	savingError := false
+// startOutboxWorker periodically retries writes to google sheet which failed.
+func (app *AppConfig) startOutboxWorker() {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
 
-	if app.SheetsService == nil {
-		savingError = true
-		log.Printf("Sheets service not initialized")
+	for range ticker.C {
+		runWorkerTask("outbox", func() {
+			app.processOutbox(dates.Now(), false)
+		})
 	}
+}
 
-	if newTripToShelter == nil {
-		savingError = true
-		log.Printf("Trip to shelter is nil")
+// processOutbox writes outbox entries which next attempt time has come or all entries if force is true.
+// Trips are written by one request per tab, only entries which failed are left in the outbox.
+func (app *AppConfig) processOutbox(now time.Time, force bool) {
+	if app.Outbox == nil {
+		return
+	}
+
+	outboxMutex.Lock()
+	entries := app.Outbox.Due(now)
+	if force {
+		entries = app.Outbox.All()
+	}
+	entries, copies := startWritingOutboxEntries(entries)
+	outboxMutex.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	errs := app.writeOutboxEntries(copies)
+
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	for i, entry := range entries {
+		app.finishOutboxEntry(entry, copies[i], now, errs[copies[i]])
+	}
+}
+
+// processOutboxEntry writes entry to google sheet and removes it from outbox.
+// If it fails, next attempt is postponed. It must be called with locked outboxMutex, which is unlocked while entry is written.
+func (app *AppConfig) processOutboxEntry(entry *models.OutboxEntry, now time.Time) bool {
+	entries, copies := startWritingOutboxEntries([]*models.OutboxEntry{entry})
+	if len(entries) == 0 {
+		// entry is being written by worker.
 		return false
 	}
 
-	if newTripToShelter.Shelter == nil {
-		savingError = true
-		log.Printf("Trip shelter is nil")
+	outboxMutex.Unlock()
+	err := app.writeOutboxEntry(copies[0])
+	outboxMutex.Lock()
+
+	return app.finishOutboxEntry(entry, copies[0], now, err)
+}
+
+// startWritingOutboxEntries marks entries which are not being written yet as being written and returns them with their copies to write.
+// It must be called with locked outboxMutex.
+func startWritingOutboxEntries(entries []*models.OutboxEntry) ([]*models.OutboxEntry, []*models.OutboxEntry) {
+	var started, copies []*models.OutboxEntry
+	for _, entry := range entries {
+		if writingOutboxEntries[entry] {
+			continue
+		}
+		writingOutboxEntries[entry] = true
+		entryCopy := *entry
+		started = append(started, entry)
+		copies = append(copies, &entryCopy)
+	}
+	return started, copies
+}
+
+// finishOutboxEntry applies progress of written copy to entry, then removes written entry from outbox
+// or postpones next attempt if writing failed with err. It must be called with locked outboxMutex.
+func (app *AppConfig) finishOutboxEntry(entry *models.OutboxEntry, written *models.OutboxEntry, now time.Time, err error) bool {
+	delete(writingOutboxEntries, entry)
+	outboxWritten.Broadcast()
+
+	entry.Kind = written.Kind
+	entry.MainSaved = written.MainSaved
+	entry.SystemSaved = written.SystemSaved
+	entry.TripToShelter.SheetRange = written.TripToShelter.SheetRange
+	app.updateTripSheetRange(entry)
+	if err != nil {
+		log.Printf("Unable to write trip %s of chat %d to sheet (attempt %d): %v", entry.TripToShelter.ID, entry.TripToShelter.ChatId, entry.Attempts+1, err)
+		err = app.Outbox.Fail(entry, now, err)
+		if err != nil {
+			log.Printf("Unable to update outbox entry %s: %v", entry.ID, err)
+		}
 		return false
 	}
-	/*
-		@INFO this code allows to save data to separate tab with
-		name of trip with following format: 13.08.2022Ника, 14.08.2022Шанс.
-		It checks if tab exists, it save it, otherwise it creates new tab.
 
-		date := newTripToShelter.Date
+	if entry.TripToShelter.Status != written.TripToShelter.Status {
+		// status was changed while trip was written, so new status is written by the next attempt.
+		entry.Kind = outbox.KindStatus
+		err = app.Outbox.Update(entry)
+		if err != nil {
+			log.Printf("Unable to update outbox entry %s: %v", entry.ID, err)
+		}
+		return true
+	}
 
-		date = date[strings.Index(date, " ")+1 : strings.Index(date, " ")+10]
-		sheetName := date + newTripToShelter.Shelter.ShortTitle
+	err = app.Outbox.Remove(entry)
+	if err != nil {
+		log.Printf("Unable to remove outbox entry %s: %v", entry.ID, err)
+	}
+	return true
+}
 
-		if !savingError {
-			err := googleSpreadsheet.PrepareSheetForSavingData(sheetName)
-			if err != nil {
-				savingError = true
-				log.Printf("Unable to create sheet or add headers: %v", err)
-			}
+// writeOutboxEntry writes trip or its status to google sheet.
+func (app *AppConfig) writeOutboxEntry(entry *models.OutboxEntry) error {
+	return app.writeOutboxEntries([]*models.OutboxEntry{entry})[entry]
+}
+
+// writeOutboxEntries writes trips or their statuses to google sheet and returns errors of entries which failed.
+// Trips are appended to tabs of layout set in app config by one request per tab and then to system tab by one request,
+// so failure of one tab doesn't stop writing to other tabs.
+// Tabs where trip is already saved are skipped, so retry after partial failure doesn't duplicate rows.
+func (app *AppConfig) writeOutboxEntries(entries []*models.OutboxEntry) map[*models.OutboxEntry]error {
+	errs := make(map[*models.OutboxEntry]error)
+	if app.SheetsService == nil {
+		for _, entry := range entries {
+			errs[entry] = errors.New("sheets service not initialized")
 		}
-	*/
+		return errs
+	}
 
-	sheetName := newTripToShelter.Shelter.ShortTitle
+	// trips grouped by shelter's tab in order of entries.
+	var sheetNames []string
+	sheetEntries := make(map[string][]*models.OutboxEntry)
+	for _, entry := range entries {
+		tripToShelter := &entry.TripToShelter
+		if tripToShelter.Shelter == nil {
+			errs[entry] = errors.New("trip shelter is nil")
+			continue
+		}
 
-	if !savingError {
-		resp, err := app.SheetsService.SaveTripToShelter(sheetName, newTripToShelter)
+		if entry.Kind == outbox.KindStatus {
+			if tripToShelter.SheetRange != "" {
+				_, err := app.SheetsService.UpdateTripStatus(tripToShelter.SheetRange, tripToShelter.Status)
+				if err != nil {
+					errs[entry] = err
+				}
+				continue
+			}
+			// original row is unknown, so save trip again with new status.
+			entry.Kind = outbox.KindAppend
+		}
 
-		if err != nil {
-			savingError = true
-			log.Printf("Unable to write data to sheet: %v", err)
-		} else if resp != nil && resp.ServerResponse.HTTPStatusCode != 200 {
-			savingError = true
-			log.Printf("Response status code is not 200: %+v", resp)
+		if !entry.MainSaved {
+			sheetName, err := app.tripSheetName(tripToShelter)
+			if err != nil {
+				errs[entry] = err
+				continue
+			}
+			if _, ok := sheetEntries[sheetName]; !ok {
+				sheetNames = append(sheetNames, sheetName)
+			}
+			sheetEntries[sheetName] = append(sheetEntries[sheetName], entry)
 		}
+	}
 
-		sheetName := "System"
-		// save to system table
-		resp, err = app.SheetsService.SaveTripToShelterSystem(sheetName, newTripToShelter)
+	for _, sheetName := range sheetNames {
+		err := app.prepareSheet(sheetName)
+		if err == nil {
+			err = app.saveOutboxEntriesToSheet(sheetName, sheetEntries[sheetName])
+			if isMissingSheetError(err) {
+				// tab was deleted or renamed after it was checked, so it's created again by the next attempt.
+				forgetPreparedSheets(sheetName)
+			}
+		}
+		if err != nil {
+			for _, entry := range sheetEntries[sheetName] {
+				errs[entry] = err
+			}
+		}
+	}
 
+	var systemEntries []*models.OutboxEntry
+	var systemTrips []*models.TripToShelter
+	for _, entry := range entries {
+		if errs[entry] == nil && entry.Kind == outbox.KindAppend && !entry.SystemSaved {
+			systemEntries = append(systemEntries, entry)
+			systemTrips = append(systemTrips, &entry.TripToShelter)
+		}
+	}
+	if len(systemEntries) == 0 {
+		return errs
+	}
+	resp, err := app.SheetsService.SaveTripsToShelterSystem("System", systemTrips)
+	if err == nil && resp != nil && resp.ServerResponse.HTTPStatusCode != 200 {
+		err = fmt.Errorf("response status code is %d", resp.ServerResponse.HTTPStatusCode)
+	}
+	for _, entry := range systemEntries {
 		if err != nil {
-			savingError = true
-			log.Printf("Unable to write data to sheet: %v", err)
-		} else if resp != nil && resp.ServerResponse.HTTPStatusCode != 200 {
-			savingError = true
-			log.Printf("Response status code is not 200: %+v", resp)
+			errs[entry] = err
+		} else {
+			entry.SystemSaved = true
 		}
 	}
 
-	if !savingError {
-		// because trip was saved we need to remove it from cache.
-		app.removeTripFromCache(newTripToShelter.ID, chatId)
-		return true
-	} else {
-		return false
+	return errs
+}
+
+// tripSheetName returns name of tab where trip is saved by layout set in app config.
+func (app *AppConfig) tripSheetName(tripToShelter *models.TripToShelter) (string, error) {
+	if app.Google == nil {
+		return sheet.SheetName(models.Google{}, tripToShelter)
+	}
+	return sheet.SheetName(*app.Google, tripToShelter)
+}
+
+// prepareSheet creates tab with headers if it doesn't exist. Tabs which are checked once are not checked again.
+func (app *AppConfig) prepareSheet(sheetName string) error {
+	preparedSheetsMutex.Lock()
+	defer preparedSheetsMutex.Unlock()
+	if preparedSheets[sheetName] {
+		return nil
+	}
+
+	err := app.SheetsService.PrepareSheetForSavingData(sheetName)
+	if err != nil {
+		return fmt.Errorf("unable to create tab %s or add headers: %w", sheetName, err)
+	}
+	preparedSheets[sheetName] = true
+	return nil
+}
+
+// forgetPreparedSheets makes tabs to be checked again before next write to them. All tabs are checked again if names are not given.
+func forgetPreparedSheets(sheetNames ...string) {
+	preparedSheetsMutex.Lock()
+	defer preparedSheetsMutex.Unlock()
+	if len(sheetNames) == 0 {
+		preparedSheets = make(map[string]bool)
+		return
+	}
+	for _, sheetName := range sheetNames {
+		delete(preparedSheets, sheetName)
+	}
+}
+
+// isMissingSheetError returns true if google sheet can't find range of request, e.g. its tab was deleted or renamed.
+func isMissingSheetError(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest && strings.Contains(apiErr.Message, "Unable to parse range")
+}
+
+// saveOutboxEntriesToSheet appends trips of entries to the tab by one request and remembers rows where they were saved.
+func (app *AppConfig) saveOutboxEntriesToSheet(sheetName string, entries []*models.OutboxEntry) error {
+	var tripsToShelter []*models.TripToShelter
+	for _, entry := range entries {
+		tripsToShelter = append(tripsToShelter, &entry.TripToShelter)
+	}
+
+	resp, err := app.SheetsService.SaveTripsToShelter(sheetName, tripsToShelter)
+	if err != nil {
+		return err
+	}
+	if resp != nil && resp.ServerResponse.HTTPStatusCode != 200 {
+		return fmt.Errorf("response status code is %d", resp.ServerResponse.HTTPStatusCode)
+	}
+
+	var tripRanges []string
+	if resp != nil && resp.Updates != nil {
+		// rows are appended in order of trips, so every trip gets its own row.
+		tripRanges, err = sheet.SplitRowRanges(resp.Updates.UpdatedRange)
+		if err != nil || len(tripRanges) != len(entries) {
+			log.Printf("Unable to get rows of trips from range %q: %v", resp.Updates.UpdatedRange, err)
+			tripRanges = nil
+		}
+	}
+	for i, entry := range entries {
+		if tripRanges != nil {
+			// remember the row to update trip status later.
+			entry.TripToShelter.SheetRange = tripRanges[i]
+		}
+		// remember progress, so the row isn't appended again if system tab fails.
+		entry.MainSaved = true
+	}
+	return nil
+}
+
+// updateTripSheetRange saves row where trip of outbox entry was saved to user's registration and trip repository,
+// so status of the trip can be updated later.
+func (app *AppConfig) updateTripSheetRange(entry *models.OutboxEntry) {
+	sheetRange := entry.TripToShelter.SheetRange
+	if sheetRange == "" {
+		return
+	}
+
+	registrationsMutex.Lock()
+	for _, v := range registrations[entry.TripToShelter.ChatId] {
+		if isSameTrip(v, &entry.TripToShelter) {
+			v.SheetRange = sheetRange
+		}
+	}
+	registrationsMutex.Unlock()
+
+	if app.Trips == nil {
+		return
+	}
+	trips, err := app.Trips.ListByChat(entry.TripToShelter.ChatId)
+	if err != nil {
+		log.Printf("Unable to get trips of chat %d: %v", entry.TripToShelter.ChatId, err)
+		return
+	}
+	for _, tripToShelter := range trips {
+		if isSameTrip(tripToShelter, &entry.TripToShelter) && tripToShelter.SheetRange != sheetRange {
+			tripToShelter.SheetRange = sheetRange
+			app.saveTrip(tripToShelter)
+		}
+	}
+}
+
+// isSameTrip checks if trips are the same registration of the chat to the shelter on the date.
+// Registration gets new ID when its answers are replaced, so trips with different IDs are different registrations.
+func isSameTrip(a, b *models.TripToShelter) bool {
+	if a.Shelter == nil || b.Shelter == nil {
+		return false
+	}
+	return a.ID == b.ID && a.ChatId == b.ChatId && a.Shelter.ID == b.Shelter.ID && extractDate(a.Date) == extractDate(b.Date)
+}
+
+// outboxSummary returns message for admin with count of trips waiting to be saved to google sheet.
+func (app *AppConfig) outboxSummary() string {
+	if app.Outbox == nil {
+		return "Очередь записи в G.Sheet не используется"
+	}
+	// entries are changed by worker under outboxMutex.
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	entries := app.Outbox.All()
+	if len(entries) == 0 {
+		return "Очередь записи в G.Sheet пуста ✅"
+	}
+
+	message := fmt.Sprintf("Записей в очереди на сохранение в G.Sheet: %d", len(entries))
+	for _, entry := range entries {
+		if entry.LastError != "" {
+			message += fmt.Sprintf("\nПоследняя ошибка: %s\nСледующая попытка: %s", entry.LastError, entry.NextAttemptAt.In(dates.Location()).Format("02.01.2006 15:04:05"))
+			break
+		}
+	}
+	return message
+}
+
+// getTripOccurrence returns trip to shelter with start and end time on the date of user's trip.
+func getTripOccurrence(tripToShelter *models.TripToShelter) (schedule.Occurrence, error) {
+	return schedule.At(tripToShelter.Shelter, extractDate(tripToShelter.Date), dates.Location())
+}
+
+// getTripStart returns date and time when trip starts.
+func getTripStart(tripToShelter *models.TripToShelter) (time.Time, error) {
+	occurrence, err := getTripOccurrence(tripToShelter)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return occurrence.Start, nil
+}
+
+// getTripEnd returns date and time when trip ends. If end time is not set it returns zero time.
+func getTripEnd(tripToShelter *models.TripToShelter) time.Time {
+	occurrence, err := getTripOccurrence(tripToShelter)
+	if err != nil {
+		return time.Time{}
+	}
+	return occurrence.End
+}
+
+// tripEvent returns calendar event of trip to shelter.
+func tripEvent(occurrence schedule.Occurrence, uid string) ics.Event {
+	shelter := occurrence.Shelter
+	description := shelter.Link
+	if shelter.Guide != "" {
+		description += "\nПамятка волонтера: " + shelter.Guide
+	}
+
+	return ics.Event{
+		UID:         uid,
+		Summary:     "Выезд в приют " + shelter.Title,
+		Description: description,
+		Location:    shelter.Address,
+		URL:         shelter.Link,
+		Start:       occurrence.Start,
+		End:         occurrence.End,
+	}
+}
+
+// tripCalendar returns calendar with user's trip to shelter.
+func tripCalendar(tripToShelter *models.TripToShelter, now time.Time) ([]byte, error) {
+	occurrence, err := getTripOccurrence(tripToShelter)
+	if err != nil {
+		return nil, err
+	}
+	uid := fmt.Sprintf("%s-%d@walkthedog.ru", getTripKey(tripToShelter.Shelter, tripToShelter.Date), tripToShelter.ChatId)
+	return ics.Calendar("", []ics.Event{tripEvent(occurrence, uid)}, now), nil
+}
+
+// shelterCalendar returns calendar with all upcoming trips to shelter including trips with closed registration.
+func shelterCalendar(shelter *models.Shelter, now time.Time) []byte {
+	var events []ics.Event
+	for _, occurrence := range schedule.Upcoming(shelter, now.In(dates.Location())) {
+		uid := getTripKey(shelter, occurrence.Date()) + "@walkthedog.ru"
+		events = append(events, tripEvent(occurrence, uid))
+	}
+	return ics.Calendar("Выезды в приют "+shelter.Title, events, now)
+}
+
+// sendTripCalendar sends ics file with trip to shelter, so user can add it to his calendar.
+func (app *AppConfig) sendTripCalendar(chatId int64, tripToShelter *models.TripToShelter) {
+	calendar, err := tripCalendar(tripToShelter, time.Now())
+	if err != nil {
+		log.Printf("Unable to create calendar for trip %s: %v", tripToShelter.ID, err)
+		return
+	}
+	msgObj := tgbotapi.NewDocument(chatId, tgbotapi.FileBytes{
+		Name:  "walkthedog_" + extractDate(tripToShelter.Date) + ".ics",
+		Bytes: calendar,
+	})
+	msgObj.Caption = "📅 Добавьте выезд в свой календарь"
+	_, err = app.Bot.Send(msgObj)
+	if err != nil {
+		log.Printf("Unable to send calendar: %v", err)
+	}
+}
+
+// calendarHandler returns http handler which serves ics feed of shelter by path /calendar/{shelter id}.ics.
+func calendarHandler(shelters *SheltersList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileName := strings.TrimPrefix(r.URL.Path, calendarPath)
+		if !strings.HasSuffix(fileName, ".ics") {
+			http.NotFound(w, r)
+			return
+		}
+		shelterId, err := strconv.Atoi(strings.TrimSuffix(fileName, ".ics"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		sheltersMutex.RLock()
+		shelter, ok := (*shelters)[shelterId]
+		sheltersMutex.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Write(shelterCalendar(shelter, time.Now()))
+	}
+}
+
+// startCalendarServer starts http server with ics feeds of shelters.
+func startCalendarServer(address string, shelters *SheltersList) {
+	mux := http.NewServeMux()
+	mux.Handle(calendarPath, calendarHandler(shelters))
+
+	log.Printf("Calendar server is listening on %s", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		log.Printf("Calendar server stopped: %v", err)
+	}
+}
+
+// scheduleReminders saves reminders about trip which should be sent in the future.
+func (app *AppConfig) scheduleReminders(tripToShelter *models.TripToShelter) {
+	if app.Reminders == nil {
+		return
+	}
+	tripStart, err := getTripStart(tripToShelter)
+	if err != nil {
+		log.Printf("Unable to schedule reminders for trip %s: %v", tripToShelter.ID, err)
+		return
+	}
+
+	now := dates.Now()
+	var reminders []*models.Reminder
+	for _, daysBefore := range app.ReminderDaysBefore {
+		sendAt := tripStart.AddDate(0, 0, -daysBefore)
+		if sendAt.Before(now) {
+			continue
+		}
+		reminders = append(reminders, &models.Reminder{
+			TripToShelter: *tripToShelter,
+			DaysBefore:    daysBefore,
+			SendAt:        sendAt,
+		})
+	}
+	if len(reminders) == 0 {
+		return
+	}
+	err = app.Reminders.Add(reminders...)
+	if err != nil {
+		log.Printf("Unable to save reminders: %v", err)
+	}
+}
+
+// startReminderWorker periodically sends reminders which time has come.
+func (app *AppConfig) startReminderWorker() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWorkerTask("reminders", func() {
+			app.sendDueReminders(dates.Now())
+		})
+	}
+}
+
+// sendDueReminders sends reminders which time has come and removes them from store.
+// Reminders about trips that already started are removed without sending.
+func (app *AppConfig) sendDueReminders(now time.Time) {
+	for _, tripReminder := range app.Reminders.Due(now) {
+		tripStart, err := getTripStart(&tripReminder.TripToShelter)
+		if err == nil && tripStart.After(now) {
+			_, err = app.Bot.Send(reminderMessage(tripReminder))
+			if err != nil {
+				// try again on next tick.
+				log.Printf("Unable to send reminder to chat %d: %v", tripReminder.TripToShelter.ChatId, err)
+				continue
+			}
+		}
+		err = app.Reminders.Remove(tripReminder)
+		if err != nil {
+			log.Printf("Unable to remove reminder: %v", err)
+		}
+	}
+}
+
+// initCache init cache based on file or creates new.
+func initCache() (*cache.Cache, error) {
+	c := cache.New(5*time.Hour, 10*time.Hour)
+
+	// types of cached values must be registered to be decoded from file.
+	gob.Register(models.TripToShelter{})
+	gob.Register(map[int64][]string{})
+
+	// Create cache directory if it doesn't exist
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		log.Printf("Unable to create cache directory: %v", err)
+		return c, err
+	}
+
+	err = c.LoadFile(cacheDir + cacheFileName)
+	if err != nil {
+		if err.Error() == "EOF" {
+			log.Println("Cache file is empty.")
+		} else {
+			log.Println(err.Error())
+		}
+	} else {
+		log.Println("cache from file")
+	}
+
+	return c, nil
+}
+
+// startCleanupWorker runs periodic cleanup to prevent memory leaks
+func startCleanupWorker() {
+	ticker := time.NewTicker(30 * time.Minute) // Run every 30 minutes
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWorkerTask("cleanup", func() {
+			now := dates.Now()
+			app.cleanupOldStates(now)
+			cleanupOldPolls(now)
+			app.saveSessions()
+		})
+	}
+}
+
+// runWorkerTask runs one tick of background worker and recovers from panic, so worker keeps running after it.
+func runWorkerTask(worker string, task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Task of %s worker panicked: %v\n%s", worker, r, debug.Stack())
+		}
+	}()
+	task()
+}
+
+// stopOnSignal waits for one of signals, stops receiving updates from telegram and closes stopped channel.
+func (app *AppConfig) stopOnSignal(stopped chan<- struct{}, signals ...os.Signal) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, signals...)
+	defer signal.Stop(signalChan)
+
+	sig := <-signalChan
+	log.Printf("[walkthedog_bot]: Got %s, stop receiving updates", sig)
+	app.Bot.StopReceivingUpdates()
+	close(stopped)
+}
+
+// shutdown waits for write to google sheet in progress and saves cache, chat states and outbox before exit.
+func (app *AppConfig) shutdown() {
+	shutdownOnce.Do(func() {
+		log.Println("[walkthedog_bot]: Shutting down")
+
+		// outbox is saved on every change, so it's enough to wait for writes in progress.
+		outboxMutex.Lock()
+		defer outboxMutex.Unlock()
+		for len(writingOutboxEntries) > 0 {
+			outboxWritten.Wait()
+		}
+		if app.Outbox != nil {
+			log.Printf("%d writes to G.Sheet are left in outbox", app.Outbox.Len())
+		}
+
+		app.saveSessions()
+
+		if app.Cache != nil {
+			err := saveCacheToFile(app.Cache)
+			if err != nil {
+				log.Printf("Unable to save cache to file: %v", err)
+			}
+		}
+		log.Println("[walkthedog_bot]: Stopped")
+	})
+}
+
+// startSessionsWorker periodically saves chat states and polls if they were changed.
+func (app *AppConfig) startSessionsWorker() {
+	ticker := time.NewTicker(sessionsSaveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		runWorkerTask("sessions", app.saveChangedSessions)
+	}
+}
+
+// markSessionsChanged marks chat states and polls to be saved by sessions worker.
+func markSessionsChanged() {
+	sessionsChangedMutex.Lock()
+	sessionsChanged = true
+	sessionsChangedMutex.Unlock()
+}
+
+// saveChangedSessions saves chat states and polls if they were changed since last save.
+func (app *AppConfig) saveChangedSessions() {
+	sessionsChangedMutex.Lock()
+	changed := sessionsChanged
+	sessionsChanged = false
+	sessionsChangedMutex.Unlock()
+
+	if changed {
+		app.saveSessions()
+	}
+}
+
+// saveSessions saves chat states and polls to file, so conversations can be continued after restart.
+func (app *AppConfig) saveSessions() {
+	if app.Sessions == nil {
+		return
+	}
+
+	saveSessionsMutex.Lock()
+	defer saveSessionsMutex.Unlock()
+
+	// states and polls are not changed after they are put to pool, so snapshot keeps pointers to them.
+	snapshot := &session.Snapshot{
+		States: make(map[int64]*models.State),
+		Polls:  make(map[string]*models.Poll),
+	}
+	statePoolMutex.RLock()
+	for chatId, state := range statePool {
+		snapshot.States[chatId] = state
+	}
+	statePoolMutex.RUnlock()
+	pollsMutex.RLock()
+	for pollId, poll := range polls {
+		snapshot.Polls[pollId] = poll
+	}
+	pollsMutex.RUnlock()
+
+	err := app.Sessions.Save(snapshot)
+	if err != nil {
+		log.Printf("Unable to save sessions: %v", err)
+	}
+}
+
+// restoreSessions loads chat states and polls saved before restart.
+// Shelters of restored trips are replaced by shelters from the current list.
+func (app *AppConfig) restoreSessions(shelters SheltersList) error {
+	if app.Sessions == nil {
+		return nil
+	}
+
+	snapshot, err := app.Sessions.Load()
+	if err != nil {
+		return err
+	}
+	now := dates.Now()
+	for _, state := range snapshot.States {
+		// states saved without activity time are expired in sessionTimeout from restart.
+		if state.LastActivityAt.IsZero() {
+			state.CreatedAt = now
+			state.LastActivityAt = now
+		}
+		if state.TripToShelter == nil || state.TripToShelter.Shelter == nil {
+			continue
+		}
+		id, err := strconv.Atoi(state.TripToShelter.Shelter.ID)
+		if err != nil {
+			continue
+		}
+		if shelter, ok := shelters[id]; ok {
+			state.TripToShelter.Shelter = shelter
+		}
+	}
+
+	statePoolMutex.Lock()
+	statePool = snapshot.States
+	statePoolMutex.Unlock()
+
+	pollsMutex.Lock()
+	polls = snapshot.Polls
+	pollsMutex.Unlock()
+
+	log.Printf("Restored %d chat states and %d polls", len(snapshot.States), len(snapshot.Polls))
+	return nil
+}
+
+// addPoll remembers chat where poll was sent, so answer to the poll can be linked to the chat.
+func addPoll(pollId string, chatId int64) {
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	polls[pollId] = &models.Poll{
+		ChatId:    chatId,
+		CreatedAt: dates.Now(),
+	}
+}
+
+// getPollChatId returns chat where poll was sent. It returns false if poll is unknown.
+func getPollChatId(pollId string) (int64, bool) {
+	pollsMutex.RLock()
+	defer pollsMutex.RUnlock()
+	poll, ok := polls[pollId]
+	if !ok {
+		return 0, false
+	}
+	return poll.ChatId, true
+}
+
+// isSessionExpired checks if user didn't answer longer than session timeout.
+func isSessionExpired(state *models.State, now time.Time) bool {
+	if state.LastActivityAt.IsZero() {
+		return false
+	}
+	return now.Sub(state.LastActivityAt) > sessionTimeout
+}
+
+// isRegistrationStep checks if user is in the middle of registration after given command.
+func isRegistrationStep(lastMessage string) bool {
+	for _, v := range registrationSteps {
+		if v == lastMessage {
+			return true
+		}
+	}
+	return false
+}
+
+// expireSession removes chat state with its polls and tells user that registration was interrupted.
+func (app *AppConfig) expireSession(state *models.State) {
+	statePoolMutex.Lock()
+	delete(statePool, state.ChatId)
+	statePoolMutex.Unlock()
+
+	pollsMutex.Lock()
+	for pollId, poll := range polls {
+		if poll.ChatId == state.ChatId {
+			delete(polls, pollId)
+		}
+	}
+	pollsMutex.Unlock()
+
+	if isRegistrationStep(state.LastMessage) {
+		app.sendTextMessage(state.ChatId, messageSessionExpired)
+	}
+	log.Printf("[walkthedog_bot]: Session of chat %d expired after %s", state.ChatId, state.LastMessage)
+}
+
+// cleanupOldStates removes abandoned chat states and expires conversations without answers longer than session timeout.
+func (app *AppConfig) cleanupOldStates(now time.Time) {
+	var expired []*models.State
+	removedCount := 0
+
+	statePoolMutex.Lock()
+	for chatId, state := range statePool {
+		// Remove states with empty LastMessage (abandoned sessions)
+		if len(state.LastMessage) == 0 {
+			delete(statePool, chatId)
+			removedCount++
+		} else if isSessionExpired(state, now) {
+			expired = append(expired, state)
+		}
+	}
+	statePoolMutex.Unlock()
+
+	// users are notified without holding the lock.
+	for _, state := range expired {
+		app.expireSession(state)
+		removedCount++
+	}
+
+	statePoolMutex.RLock()
+	log.Printf("Cleaned up %d abandoned states, current count: %d", removedCount, len(statePool))
+	statePoolMutex.RUnlock()
+}
+
+// cleanupOldPolls removes polls older than session timeout and polls of chats without state.
+func cleanupOldPolls(now time.Time) {
+	statePoolMutex.RLock()
+	defer statePoolMutex.RUnlock()
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+
+	removedCount := 0
+	for pollId, poll := range polls {
+		_, hasState := statePool[poll.ChatId]
+		if !hasState || now.Sub(poll.CreatedAt) > sessionTimeout {
+			delete(polls, pollId)
+			removedCount++
+		}
+	}
+	log.Printf("Cleaned up %d old polls, current count: %d", removedCount, len(polls))
+}
+
+// saveCacheToFile saves cache to file.
+func saveCacheToFile(cache *cache.Cache) error {
+	/* f, err := ioutil.TempFile(cacheDir, cacheFileName)
+	if err != nil {
+		return err
+		//t.Fatal("Couldn't create cache file:", err)
+	}
+	fname := f.Name()
+	tempCacheFileName = fname
+	f.Close()
+	err = cache.SaveFile(fname) */
+	err := cache.SaveFile(cacheDir + cacheFileName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// removeTripFromCache removes trip from cache.
+func (app *AppConfig) removeTripFromCache(newTripToShelterId string, chatId int64) {
+	//delete newTripToShelter from cache by chatId
+	app.Cache.Delete(newTripToShelterId)
+
+	/* // take all trips registrations that were not save to G.Sheets from cache
+	var tripIds []int64
+	var tripIdsResult []string
+
+	tripIdsFromCache, found := app.Cache.Get("chats_have_trips")
+	if found {
+		tripIds = tripIdsFromCache.([]int64)
+	} */
+
+	var tripIdsResult []string
+	// remove trips from array
+	chatsWithTripsID := make(map[int64][]string)
+	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
+	if found {
+		if typedMap, ok := chatsWithTripsIDFromCache.(map[int64][]string); ok {
+			chatsWithTripsID = typedMap
+		} else {
+			log.Printf("Invalid type in cache for chats_have_trips, expected map[int64][]string")
+			return
+		}
+	}
+	tripsByChatId, ok := chatsWithTripsID[chatId]
+	// exit if don't have such a key in array
+	if !ok {
+		return
+	}
+	for i, v := range tripsByChatId {
+		if v == newTripToShelterId {
+			if len(tripsByChatId) == 1 {
+				// we need to delete trip from array by chat id and for this chat id only one trip exist. So remove chat id from map and underlying value.
+				delete(chatsWithTripsID, chatId)
+			} else {
+				tripIdsResult = append(tripIdsResult, tripsByChatId[:i]...)
+				tripIdsResult = append(tripIdsResult, tripsByChatId[i+1:]...)
+				chatsWithTripsID[chatId] = tripIdsResult
+			}
+			break
+		}
+	}
+	// save to the cache
+	app.Cache.Set("chats_have_trips", chatsWithTripsID, cache.NoExpiration)
+}
+
+// sendTextMessage sends message
+func (app *AppConfig) sendTextMessage(chatId int64, message string) (tgbotapi.Message, error) {
+	msgObj := tgbotapi.NewMessage(chatId, message)
+	return app.Bot.Send(msgObj)
+}
+
+// sendCachedTripsToGSheet saves trips which were not saved to google sheet by one request per tab and removes saved trips from cache.
+// Trips which failed are left in cache.
+func (app *AppConfig) sendCachedTripsToGSheet() {
+	chatsWithTripsID := make(map[int64][]string)
+	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
+	if found {
+		if typedMap, ok := chatsWithTripsIDFromCache.(map[int64][]string); ok {
+			chatsWithTripsID = typedMap
+		} else {
+			log.Printf("Invalid type in cache for chats_have_trips, expected map[int64][]string")
+			return
+		}
+	}
+
+	var entries []*models.OutboxEntry
+	var chatIds []int64
+	for chatId, TripsIDs := range chatsWithTripsID {
+		for _, v := range TripsIDs {
+			tripFromCache, found := app.Cache.Get(v)
+			if !found {
+				continue
+			}
+			tripToShelter, ok := tripFromCache.(models.TripToShelter)
+			if !ok {
+				log.Printf("Invalid type in cache for trip %s, expected models.TripToShelter", v)
+				continue
+			}
+			entries = append(entries, &models.OutboxEntry{Kind: outbox.KindAppend, TripToShelter: tripToShelter})
+			chatIds = append(chatIds, chatId)
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	errs := app.writeOutboxEntries(entries)
+	for i, entry := range entries {
+		app.updateTripSheetRange(entry)
+		if err := errs[entry]; err != nil {
+			log.Printf("Can't send trip %s from cache to G.Sheet: %v", entry.TripToShelter.ID, err)
+			continue
+		}
+		log.Printf("Trip %s from cache sent to G.Sheet", entry.TripToShelter.ID)
+		app.removeTripFromCache(entry.TripToShelter.ID, chatIds[i])
 	}
 }
@@ -1,144 +1,134 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"walkthedog/internal/dates"
+	"walkthedog/internal/dispatcher"
+	"walkthedog/internal/flow"
+	sheet "walkthedog/internal/google/sheet"
 	"walkthedog/internal/mocks"
 	"walkthedog/internal/models"
+	"walkthedog/internal/outbox"
+	"walkthedog/internal/reminder"
+	"walkthedog/internal/repository"
+	"walkthedog/internal/schedule"
+	"walkthedog/internal/session"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
 )
 
-// TestSavingOneTripToCache save one trip to cache and then get it from cache. Test succeed if values are same.
-func TestSavingOneTripToCache(t *testing.T) {
-	c, err := initCache()
-	if err != nil {
-		log.Panic(err)
-	}
-	app.Cache = c
-	var chatId int64 = 5656565656
+// TestSavingOneTripToOutbox saves trip which can't be written to google sheet to outbox and then gets it from outbox. Test succeed if values are same.
+func TestSavingOneTripToOutbox(t *testing.T) {
+	app := setupTestApp(t)
+	app.Outbox = newTestOutbox(t)
+	app.SheetsService.(*mocks.MockGoogleSheetsService).SetSaveError(errors.New("mock sheets error"))
 
 	tripsList := getTripsToSheltersList()
-
 	newTripToShelter := tripsList[0]
 
-	app.saveTripToCache(newTripToShelter, chatId)
+	if app.exportTrip(newTripToShelter) {
+		t.Fatal("Expected trip not to be written to google sheet")
+	}
 
-	chatsWithTripsID := make(map[int64][]string)
-	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
-	if found {
-		chatsWithTripsID = chatsWithTripsIDFromCache.(map[int64][]string)
+	entries := app.Outbox.All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry in outbox, got %d", len(entries))
 	}
-	for _, v := range chatsWithTripsID[chatId] {
-		var trip models.TripToShelter
-		tripFromCache, found := app.Cache.Get(v)
-		if found {
-			trip = tripFromCache.(models.TripToShelter)
-		}
-		//newTripToShelter.Date = ""
-		err := equalTripsToShelters(newTripToShelter, &trip)
-		if err != "" {
-			t.Error(err)
-		}
+	err := equalTripsToShelters(newTripToShelter, &entries[0].TripToShelter)
+	if err != "" {
+		t.Error(err)
 	}
 }
 
-// TestSavingOneTripToCache save one trip to cache and then get it from cache. Test succeed if values are same.
-func TestSavingTwoTripsFromOneChatToCache(t *testing.T) {
-	c, err := initCache()
-	if err != nil {
-		log.Panic(err)
-	}
-	app.Cache = c
-	var chatId int64 = 5656565656
+// TestSavingTwoTripsFromOneChatToOutbox saves two trips to outbox and then gets them from outbox in the same order.
+func TestSavingTwoTripsFromOneChatToOutbox(t *testing.T) {
+	app := setupTestApp(t)
+	app.Outbox = newTestOutbox(t)
+	app.SheetsService.(*mocks.MockGoogleSheetsService).SetSaveError(errors.New("mock sheets error"))
+
 	tripsList := getTripsToSheltersList()
 	newTripToShelter1 := tripsList[0]
-
-	app.saveTripToCache(newTripToShelter1, chatId)
-
+	app.exportTrip(newTripToShelter1)
 	newTripToShelter2 := tripsList[1]
+	app.exportTrip(newTripToShelter2)
 
-	app.saveTripToCache(newTripToShelter2, chatId)
-
-	chatsWithTripsID := make(map[int64][]string)
-	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
-	if found {
-		chatsWithTripsID = chatsWithTripsIDFromCache.(map[int64][]string)
-	}
-
-	if len(chatsWithTripsID[chatId]) != 2 {
-		t.Error("Expected only 2 elements in cache")
+	entries := app.Outbox.All()
+	if len(entries) != 2 {
+		t.Fatalf("Expected only 2 entries in outbox, got %d", len(entries))
 	}
 
-	// take first trip from cache and compare
-	var trip models.TripToShelter
-	tripFromCache, found := app.Cache.Get(chatsWithTripsID[chatId][0])
-	if found {
-		trip = tripFromCache.(models.TripToShelter)
-	}
-	//newTripToShelter.Date = ""
-	errorMes := equalTripsToShelters(newTripToShelter1, &trip)
+	errorMes := equalTripsToShelters(newTripToShelter1, &entries[0].TripToShelter)
 	if errorMes != "" {
 		t.Error(errorMes)
 	}
-
-	// take first trip from cache and compare
-	tripFromCache, found = app.Cache.Get(chatsWithTripsID[chatId][1])
-	if found {
-		trip = tripFromCache.(models.TripToShelter)
-	}
-	//newTripToShelter.Date = ""
-	errorMes = equalTripsToShelters(newTripToShelter2, &trip)
+	errorMes = equalTripsToShelters(newTripToShelter2, &entries[1].TripToShelter)
 	if errorMes != "" {
 		t.Error(errorMes)
 	}
 }
 
-func TestSavingTwoTripsFromOneChatToCacheAndRemoveOne(t *testing.T) {
-	c, err := initCache()
-	if err != nil {
-		log.Panic(err)
-	}
-	app.Cache = c
-	var chatId int64 = 5656565656
+// TestSavingTwoTripsFromOneChatToOutboxAndRemoveOne tests that only trip written by retry is removed from outbox.
+func TestSavingTwoTripsFromOneChatToOutboxAndRemoveOne(t *testing.T) {
+	app := setupTestApp(t)
+	app.Outbox = newTestOutbox(t)
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	mockSheets.SetSaveError(errors.New("mock sheets error"))
+
 	tripsList := getTripsToSheltersList()
 	newTripToShelter1 := tripsList[0]
-
-	app.saveTripToCache(newTripToShelter1, chatId)
-
+	app.exportTrip(newTripToShelter1)
+	// second trip is saved to another tab which is still unavailable on retry
 	newTripToShelter2 := tripsList[1]
+	shelter := *newTripToShelter2.Shelter
+	shelter.ShortTitle = "e"
+	newTripToShelter2.Shelter = &shelter
+	app.exportTrip(newTripToShelter2)
 
-	app.saveTripToCache(newTripToShelter2, chatId)
-
-	// remove from cache first added trip
-	app.removeTripFromCache(newTripToShelter1.ID, chatId)
-
-	chatsWithTripsID := make(map[int64][]string)
-	chatsWithTripsIDFromCache, found := app.Cache.Get("chats_have_trips")
-	if found {
-		chatsWithTripsID = chatsWithTripsIDFromCache.(map[int64][]string)
-	}
-
-	if len(chatsWithTripsID[chatId]) != 1 {
-		t.Error("Expected only 1 element in cache")
-	}
+	mockSheets.SetSaveError(nil)
+	mockSheets.SheetSaveErrors["e"] = errors.New("mock sheets error")
+	app.processOutbox(dates.Now(), true)
 
-	var trip models.TripToShelter
-	// take trip from cache and compare
-	tripFromCache, found := app.Cache.Get(chatsWithTripsID[chatId][0])
-	if found {
-		trip = tripFromCache.(models.TripToShelter)
+	entries := app.Outbox.All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected only 1 entry in outbox, got %d", len(entries))
 	}
-	//newTripToShelter.Date = ""
-	errorMes := equalTripsToShelters(newTripToShelter2, &trip)
+	errorMes := equalTripsToShelters(newTripToShelter2, &entries[0].TripToShelter)
 	if errorMes != "" {
 		t.Error(errorMes)
 	}
 }
 
+// newTestOutbox creates outbox in temporary directory of the test.
+func newTestOutbox(t *testing.T) *outbox.Store {
+	t.Helper()
+	store, err := outbox.NewStore(t.TempDir() + "/outbox.json")
+	if err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	return store
+}
+
 // equalTripsToShelters compares two TripToShelter.
 func equalTripsToShelters(trip1 *models.TripToShelter, trip2 *models.TripToShelter) string {
 	error := ""
@@ -294,20 +284,204 @@ func TestIsTripDateValid(t *testing.T) {
 // TestCalculateDay tests date calculation logic
 func TestCalculateDay(t *testing.T) {
 	// Test first Saturday of January 2024
-	result := calculateDay(6, 1, time.January) // Saturday, first week
+	result := schedule.DayOfMonth(2024, time.January, 1, 6, time.UTC) // Saturday, first week
 
 	// Verify it's a Saturday
 	if result.Weekday() != time.Saturday {
 		t.Errorf("Expected Saturday, got %v", result.Weekday())
 	}
+	if result.Format("02.01.2006") != "06.01.2024" {
+		t.Errorf("Expected 06.01.2024, got %s", result.Format("02.01.2006"))
+	}
 
 	// Test second Sunday of February
-	result = calculateDay(7, 2, time.February) // Sunday, second week
+	result = schedule.DayOfMonth(2024, time.February, 2, 7, time.UTC) // Sunday, second week
 	if result.Weekday() != time.Sunday {
 		t.Errorf("Expected Sunday, got %v", result.Weekday())
 	}
 }
 
+// TestCalculateLastWeekDay tests the last day of week in month and months without 5th week
+func TestCalculateLastWeekDay(t *testing.T) {
+	for month := time.January; month <= time.December; month++ {
+		result := schedule.DayOfMonth(2023, month, schedule.LastWeek, 7, time.UTC)
+		if result.Weekday() != time.Sunday {
+			t.Errorf("Expected Sunday, got %v", result.Weekday())
+		}
+		if result.Month() != month || result.AddDate(0, 0, 7).Month() == month {
+			t.Errorf("Expected the last Sunday of %v, got %v", month, result)
+		}
+
+		fifth := schedule.DayOfMonth(2023, month, 5, 7, time.UTC)
+		if !fifth.IsZero() && fifth.Month() != month {
+			t.Errorf("Expected 5th Sunday not to spill into the next month, got %v", fifth)
+		}
+		if fifth.IsZero() && result.Day() > 28 {
+			t.Errorf("Expected 5th Sunday of %v to be %v", month, result)
+		}
+	}
+}
+
+// TestWeeklySchedule tests "weekly" schedule type
+func TestWeeklySchedule(t *testing.T) {
+	now := time.Now()
+	startDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -14)
+	shelter := &models.Shelter{
+		Schedule: models.ShelterSchedule{
+			Type:      "weekly",
+			StartDate: startDate.Format("02.01.2006"),
+			Every:     2,
+			DaysAhead: 42,
+		},
+	}
+
+	days := schedule.Upcoming(shelter, now.In(time.UTC))
+	if len(days) != 3 {
+		t.Fatalf("Expected 3 days, got %v", days)
+	}
+	for i, day := range days {
+		expected := startDate.AddDate(0, 0, 14*(i+1))
+		if !day.Start.Equal(expected) {
+			t.Errorf("Expected %v, got %v", expected, day.Start)
+		}
+	}
+}
+
+// TestScheduleOccurrences tests typed trips returned by schedule package
+func TestScheduleOccurrences(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatalf("Failed to load timezone: %v", err)
+	}
+	shelter := &models.Shelter{
+		ID:          "1",
+		PeopleLimit: 30,
+		Schedule: models.ShelterSchedule{
+			Type:      "regularly",
+			Details:   [][]int{{1, 6}},
+			TimeStart: "11:00",
+			TimeEnd:   "13:00",
+		},
+	}
+
+	// trips after new year belong to the next year.
+	from := time.Date(2022, time.December, 10, 15, 0, 0, 0, moscow)
+	to := time.Date(2023, time.March, 1, 0, 0, 0, 0, moscow)
+	occurrences := schedule.Occurrences(shelter, from, to)
+	expected := []string{"07.01.2023", "04.02.2023"}
+	if len(occurrences) != len(expected) {
+		t.Fatalf("Expected %d trips, got %v", len(expected), occurrences)
+	}
+	for i, occurrence := range occurrences {
+		if occurrence.Date() != expected[i] {
+			t.Errorf("Expected trip on %s, got %s", expected[i], occurrence.Date())
+		}
+		if occurrence.Shelter != shelter || occurrence.Capacity != 30 {
+			t.Errorf("Expected trip to shelter with capacity 30, got %+v", occurrence)
+		}
+		if occurrence.Start.Hour() != 11 || occurrence.End.Hour() != 13 || occurrence.Start.Location() != moscow {
+			t.Errorf("Expected trip from 11:00 till 13:00 in Moscow, got %v - %v", occurrence.Start, occurrence.End)
+		}
+	}
+
+	if horizon := schedule.Horizon(&shelter.Schedule, from); horizon.Format("02.01.2006") != "01.06.2023" {
+		t.Errorf("Expected horizon 01.06.2023, got %v", horizon)
+	}
+
+	// one-off date overrides time and capacity.
+	shelter.Schedule = models.ShelterSchedule{
+		Type:  "dates",
+		Dates: []models.ShelterDate{{Date: "20.12.2022", TimeStart: "12:00", PeopleLimit: 5}},
+	}
+	occurrences = schedule.Upcoming(shelter, from)
+	if len(occurrences) != 1 || occurrences[0].Capacity != 5 || occurrences[0].Start.Hour() != 12 || !occurrences[0].End.IsZero() {
+		t.Errorf("Expected one trip at 12:00 for 5 people, got %+v", occurrences)
+	}
+}
+
+// TestScheduleValidPeriod tests valid_from and valid_to of schedule
+func TestScheduleValidPeriod(t *testing.T) {
+	shelter := &models.Shelter{
+		Schedule: models.ShelterSchedule{ValidFrom: "01.05", ValidTo: "30.09"},
+	}
+	if !schedule.IsInValidPeriod(&shelter.Schedule, time.Date(2023, time.July, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected July to be in period from May till September")
+	}
+	if schedule.IsInValidPeriod(&shelter.Schedule, time.Date(2023, time.October, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected October not to be in period from May till September")
+	}
+
+	// period through new year
+	shelter.Schedule.ValidFrom, shelter.Schedule.ValidTo = "01.11", "28.02"
+	if !schedule.IsInValidPeriod(&shelter.Schedule, time.Date(2023, time.January, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected January to be in period from November till February")
+	}
+	if schedule.IsInValidPeriod(&shelter.Schedule, time.Date(2023, time.June, 15, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected June not to be in period from November till February")
+	}
+
+	// absolute period
+	shelter.Schedule.ValidFrom, shelter.Schedule.ValidTo = "01.05.2023", ""
+	if schedule.IsInValidPeriod(&shelter.Schedule, time.Date(2023, time.April, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected date before valid from to be out of period")
+	}
+	if !schedule.IsInValidPeriod(&shelter.Schedule, time.Date(2024, time.April, 30, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Expected date after valid from to be in period")
+	}
+
+	// everyday shelter outside of period has no dates
+	now := time.Now()
+	everyday := &models.Shelter{
+		Schedule: models.ShelterSchedule{
+			Type:      "everyday",
+			DaysAhead: 10,
+			ValidFrom: now.AddDate(0, 0, 5).Format("02.01.2006"),
+		},
+	}
+	if days := getShelterDays(everyday, now); len(days) != 5 {
+		t.Errorf("Expected 5 days in valid period, got %d", len(days))
+	}
+}
+
+// TestValidateSchedule tests that wrong schedules are rejected
+func TestValidateSchedule(t *testing.T) {
+	validSchedules := []models.ShelterSchedule{
+		{Type: "regularly", Details: [][]int{{1, 6}, {schedule.LastWeek, 7}}, TimeStart: "11:00", TimeEnd: "13:00"},
+		{Type: "everyday", Weekdays: []int{6, 7}, DaysAhead: 14},
+		{Type: "weekly", StartDate: "05.11.2022", Every: 2},
+		{Type: "dates", Dates: []models.ShelterDate{{Date: "05.11.2022", TimeStart: "12:00"}}},
+		{Type: "regularly", Details: [][]int{{1, 6}}, ValidFrom: "01.11", ValidTo: "28.02"},
+		{Type: "none"},
+	}
+	for _, shelterSchedule := range validSchedules {
+		if err := schedule.Validate(&shelterSchedule); err != nil {
+			t.Errorf("Expected schedule %+v to be valid, got %v", shelterSchedule, err)
+		}
+	}
+
+	invalidSchedules := []models.ShelterSchedule{
+		{Type: "unknown"},
+		{Type: "regularly"},
+		{Type: "regularly", Details: [][]int{{}}},
+		{Type: "regularly", Details: [][]int{{6, 6}}},
+		{Type: "regularly", Details: [][]int{{1, 8}}},
+		{Type: "everyday", Weekdays: []int{0}},
+		{Type: "weekly", StartDate: "2022-11-05", Every: 1},
+		{Type: "weekly", StartDate: "05.11.2022"},
+		{Type: "dates"},
+		{Type: "dates", Dates: []models.ShelterDate{{Date: "05.11.2022", TimeStart: "15:00", TimeEnd: "12:00"}}},
+		{Type: "everyday", DatesExceptions: []string{"5 ноября"}},
+		{Type: "everyday", TimeStart: "11"},
+		{Type: "everyday", ValidFrom: "01.10.2023", ValidTo: "01.05.2023"},
+		{Type: "everyday", ValidFrom: "01.05", ValidTo: "30.09.2023"},
+	}
+	for _, shelterSchedule := range invalidSchedules {
+		if err := schedule.Validate(&shelterSchedule); err == nil {
+			t.Errorf("Expected schedule %+v to be invalid", shelterSchedule)
+		}
+	}
+}
+
 // TestIsShelterHasTripDates tests shelter availability
 func TestIsShelterHasTripDates(t *testing.T) {
 	// Test shelter with regular schedule
@@ -347,8 +521,8 @@ func TestInitCacheWithMissingDirectory(t *testing.T) {
 	}
 }
 
-// TestSendTripToGSheetErrorHandling tests our error handling with mocks
-func TestSendTripToGSheetErrorHandling(t *testing.T) {
+// TestExportTripErrorHandling tests our error handling with mocks
+func TestExportTripErrorHandling(t *testing.T) {
 	// Initialize app config for testing
 	c, err := initCache()
 	if err != nil {
@@ -366,6 +540,8 @@ func TestSendTripToGSheetErrorHandling(t *testing.T) {
 	app.Bot = mockBot
 	app.SheetsService = mockSheets
 	app.Google = &models.Google{SpreadsheetID: "test-id"}
+	app.Outbox = newTestOutbox(t)
+	defer func() { app.Outbox = nil }()
 
 	// Create test trip
 	trip := &models.TripToShelter{
@@ -378,33 +554,25 @@ func TestSendTripToGSheetErrorHandling(t *testing.T) {
 	}
 
 	// This should handle errors gracefully and not panic
-	result := app.sendTripToGSheet(12345, trip)
+	result := app.exportTrip(trip)
 
 	// Should return false due to Google Sheets error, but not crash
 	if result {
 		t.Error("Expected false result due to mock Google Sheets error")
 	}
 
-	// Verify trip was cached due to failure
-	app.saveTripToCache(trip, 12345)
-	cachedTrip, found := app.Cache.Get(trip.ID)
-	if !found {
-		t.Error("Expected trip to be cached after Google Sheets failure")
-		return
-	}
-
-	retrievedTrip, ok := cachedTrip.(models.TripToShelter)
-	if !ok {
-		t.Error("Cached trip has invalid type, expected models.TripToShelter")
-		return
+	// Verify trip was left in outbox due to failure
+	entries := app.Outbox.All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected trip to be left in outbox after Google Sheets failure, got %d entries", len(entries))
 	}
-	if retrievedTrip.ID != trip.ID {
-		t.Errorf("Expected cached trip ID %s, got %s", trip.ID, retrievedTrip.ID)
+	if entries[0].TripToShelter.ID != trip.ID {
+		t.Errorf("Expected trip ID %s in outbox, got %s", trip.ID, entries[0].TripToShelter.ID)
 	}
 }
 
-// TestSendTripToGSheetSuccess tests successful Google Sheets operation with mocks
-func TestSendTripToGSheetSuccess(t *testing.T) {
+// TestExportTripSuccess tests successful Google Sheets operation with mocks
+func TestExportTripSuccess(t *testing.T) {
 	// Initialize app config for testing
 	c, err := initCache()
 	if err != nil {
@@ -431,7 +599,7 @@ func TestSendTripToGSheetSuccess(t *testing.T) {
 	}
 
 	// This should succeed
-	result := app.sendTripToGSheet(12345, trip)
+	result := app.exportTrip(trip)
 
 	// Should return true on success
 	if !result {
@@ -778,7 +946,9 @@ func TestAdminClearCacheCommand(t *testing.T) {
 		Shelter:  &models.Shelter{ShortTitle: "Test"},
 		Date:     "01.01.2024",
 	}
-	app.saveTripToCache(trip, 12345)
+	// trip cached by previous version of bot
+	app.Cache.Set(trip.ID, *trip, cache.NoExpiration)
+	app.Cache.Set("chats_have_trips", map[int64][]string{12345: {trip.ID}}, cache.NoExpiration)
 
 	// Verify cache has data
 	_, found := app.Cache.Get(trip.ID)
@@ -898,8 +1068,31 @@ func cleanupTestState() {
 	statePoolMutex.Unlock()
 
 	pollsMutex.Lock()
-	polls = make(map[string]int64)
+	polls = make(map[string]*models.Poll)
 	pollsMutex.Unlock()
+
+	tripSeatsMutex.Lock()
+	tripSeats = make(map[string]int)
+	tripSeatsMutex.Unlock()
+
+	waitlistMutex.Lock()
+	waitlist = make(map[string][]*models.TripToShelter)
+	waitlistMutex.Unlock()
+
+	registrationsMutex.Lock()
+	registrations = make(map[int64][]*models.TripToShelter)
+	registrationsMutex.Unlock()
+
+	preparedSheetsMutex.Lock()
+	preparedSheets = make(map[string]bool)
+	preparedSheetsMutex.Unlock()
+
+	googleAuthWarningMutex.Lock()
+	googleAuthWarningMutex.Unlock()
+
+	sessionsChangedMutex.Lock()
+	sessionsChanged = false
+	sessionsChangedMutex.Unlock()
 }
 
 // createTestUpdate creates a test Telegram update
@@ -952,9 +1145,7 @@ func processTestUpdate(app *AppConfig, update tgbotapi.Update) {
 	if update.Message != nil {
 		chatId = update.Message.Chat.ID
 	} else if update.PollAnswer != nil {
-		pollsMutex.RLock()
-		chatId = polls[update.PollAnswer.PollID]
-		pollsMutex.RUnlock()
+		chatId, _ = getPollChatId(update.PollAnswer.PollID)
 	}
 
 	// Get or create state
@@ -1020,9 +1211,7 @@ func TestPollAnswerTripPurpose(t *testing.T) {
 	pollId := "test-poll-123"
 
 	// Set up poll mapping
-	pollsMutex.Lock()
-	polls[pollId] = chatId
-	pollsMutex.Unlock()
+	addPoll(pollId, chatId)
 
 	// Set up state
 	state := &models.State{
@@ -1063,9 +1252,7 @@ func TestPollAnswerTripBy(t *testing.T) {
 	pollId := "test-poll-456"
 
 	// Set up poll mapping
-	pollsMutex.Lock()
-	polls[pollId] = chatId
-	pollsMutex.Unlock()
+	addPoll(pollId, chatId)
 
 	// Set up state
 	state := &models.State{
@@ -1098,6 +1285,49 @@ func TestPollAnswerTripBy(t *testing.T) {
 	}
 }
 
+// TestPollAnswerWhenNextPollIsNotSent tests that registration stays on the step if next poll isn't sent and user can vote again
+func TestPollAnswerWhenNextPollIsNotSent(t *testing.T) {
+	app := setupTestApp(t)
+	chatId := int64(12345)
+	pollId := "test-poll-789"
+	addPoll(pollId, chatId)
+
+	statePoolMutex.Lock()
+	statePool[chatId] = &models.State{
+		ChatId:        chatId,
+		LastMessage:   commandTripPurpose,
+		TripToShelter: &models.TripToShelter{Username: "testuser", Shelter: &models.Shelter{ShortTitle: "Test"}, Date: "01.01.2024"},
+	}
+	statePoolMutex.Unlock()
+
+	config := &models.ConfigFile{Administration: &models.Administration{Admin: "99999"}}
+	shelters := getSheltersListForTest()
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	mockBot.SendError = errors.New("telegram is unavailable")
+	app.handleUpdate(createTestPollUpdate(t, chatId, pollId, []int{0, 1}), chatId, config, &shelters)
+
+	statePoolMutex.RLock()
+	state := statePool[chatId]
+	statePoolMutex.RUnlock()
+	if state.LastMessage != commandTripPurpose {
+		t.Fatalf("Expected registration to stay on step %s, got %s", commandTripPurpose, state.LastMessage)
+	}
+
+	// user votes again when telegram is available
+	mockBot.SendError = nil
+	app.handleUpdate(createTestPollUpdate(t, chatId, pollId, []int{0}), chatId, config, &shelters)
+
+	statePoolMutex.RLock()
+	state = statePool[chatId]
+	statePoolMutex.RUnlock()
+	if state.LastMessage != commandTripBy {
+		t.Errorf("Expected next step %s, got %s", commandTripBy, state.LastMessage)
+	}
+	if !reflect.DeepEqual(state.TripToShelter.Purpose, []string{purposes[0]}) {
+		t.Errorf("Expected purposes of the last vote, got %v", state.TripToShelter.Purpose)
+	}
+}
+
 // =================== TRIP REGISTRATION WORKFLOW TESTS ===================
 
 // TestCompleteUserRegistrationFlow tests the complete user registration workflow
@@ -1164,7 +1394,7 @@ func TestTripCreationAndStorage(t *testing.T) {
 	}
 
 	// Test successful storage
-	result := app.sendTripToGSheet(12345, trip)
+	result := app.exportTrip(trip)
 	if !result {
 		t.Error("Expected successful trip storage")
 	}
@@ -1242,7 +1472,7 @@ func TestNilPointerHandling(t *testing.T) {
 	app := setupTestApp(t)
 
 	// Test sending nil trip to sheets
-	result := app.sendTripToGSheet(12345, nil)
+	result := app.exportTrip(nil)
 	if result {
 		t.Error("Expected false result for nil trip")
 	}
@@ -1296,7 +1526,7 @@ func TestConcurrentStateAccess(t *testing.T) {
 
 // TestMemoryCleanup tests the memory cleanup functionality
 func TestMemoryCleanup(t *testing.T) {
-	setupTestApp(t)
+	app := setupTestApp(t)
 
 	// Add some states
 	for i := int64(1); i <= 5; i++ {
@@ -1319,7 +1549,7 @@ func TestMemoryCleanup(t *testing.T) {
 	}
 
 	// Run cleanup
-	cleanupOldStates()
+	app.cleanupOldStates(time.Now())
 
 	// Verify empty states were cleaned up
 	statePoolMutex.RLock()
@@ -1347,7 +1577,7 @@ func TestErrorRecovery(t *testing.T) {
 	}
 
 	// Attempt to save trip
-	result := app.sendTripToGSheet(12345, trip)
+	result := app.exportTrip(trip)
 
 	// Should handle error gracefully
 	if result {
@@ -1357,7 +1587,7 @@ func TestErrorRecovery(t *testing.T) {
 	// Application should continue functioning
 	// Clear the error and try again
 	mockSheets.SetSaveError(nil)
-	result = app.sendTripToGSheet(12345, trip)
+	result = app.exportTrip(trip)
 
 	if !result {
 		t.Error("Expected successful recovery after error cleared")
@@ -1370,9 +1600,7 @@ func processTestPollUpdate(app *AppConfig, update tgbotapi.Update) {
 		return
 	}
 
-	pollsMutex.RLock()
-	chatId := polls[update.PollAnswer.PollID]
-	pollsMutex.RUnlock()
+	chatId, _ := getPollChatId(update.PollAnswer.PollID)
 
 	statePoolMutex.RLock()
 	state := statePool[chatId]
@@ -1454,273 +1682,2488 @@ func TestShelterScheduleTypes(t *testing.T) {
 	_ = dates // Just ensure it doesn't crash
 }
 
-// TestCacheInitialization tests cache initialization
-func TestCacheInitialization(t *testing.T) {
-	cache, err := initCache()
-	if err != nil {
-		t.Errorf("Expected no error initializing cache, got %v", err)
+// TestGetDatesByShelterEveryday tests "everyday" schedule with weekdays, booking horizon and exceptions
+func TestGetDatesByShelterEveryday(t *testing.T) {
+	shelter := &models.Shelter{
+		Schedule: models.ShelterSchedule{
+			Type:      "everyday",
+			DaysAhead: 15,
+		},
 	}
-	if cache == nil {
-		t.Error("Expected cache to be initialized")
+
+	// trip without start time starts at midnight, so registration for today's trip is already closed.
+	shelterDates := getDatesByShelter(shelter)
+	if len(shelterDates) != 14 {
+		t.Fatalf("Expected 14 dates, got %d", len(shelterDates))
+	}
+	tomorrow := dates.Now().AddDate(0, 0, 1).Format("02.01.2006")
+	if !strings.Contains(shelterDates[0], tomorrow) {
+		t.Errorf("Expected first date to be tomorrow %s, got %s", tomorrow, shelterDates[0])
 	}
-}
 
-// TestNewTripToShelter tests trip creation helper
-func TestNewTripToShelter(t *testing.T) {
-	username := "testuser"
-	trip := NewTripToShelter(username)
+	// only weekends
+	shelter.Schedule.Weekdays = []int{6, 7}
+	shelterDates = getDatesByShelter(shelter)
+	if len(shelterDates) != 4 {
+		t.Fatalf("Expected 4 weekend dates, got %d: %v", len(shelterDates), shelterDates)
+	}
+	for _, v := range shelterDates {
+		if !strings.HasPrefix(v, "Сб") && !strings.HasPrefix(v, "Вс") {
+			t.Errorf("Expected only weekend dates, got %s", v)
+		}
+	}
 
-	if trip == nil {
-		t.Error("Expected trip to be created")
+	// exclude first date
+	excludedDate := shelterDates[0]
+	exception := strings.Split(excludedDate, " ")[1]
+	shelter.Schedule.DatesExceptions = []string{exception}
+	shelterDates = getDatesByShelter(shelter)
+	if len(shelterDates) != 3 {
+		t.Errorf("Expected 3 dates after exception, got %d", len(shelterDates))
 	}
-	if trip.Username != username {
-		t.Errorf("Expected username %s, got %s", username, trip.Username)
+	if isTripDateValid(excludedDate, &models.TripToShelter{Shelter: shelter}) {
+		t.Error("Expected exception date to be invalid")
+	}
+	if !isTripDateValid(shelterDates[0], &models.TripToShelter{Shelter: shelter}) {
+		t.Errorf("Expected date %s to be valid", shelterDates[0])
 	}
-	// Note: ID is not automatically generated in NewTripToShelter
-	// IDs are typically set elsewhere in the application flow
 }
 
-// =================== INTEGRATION TESTS ===================
+// TestGetDatesByMonthEveryday tests that "everyday" shelters are listed by month
+func TestGetDatesByMonthEveryday(t *testing.T) {
+	now := time.Now()
+	shelters := SheltersList{
+		1: &models.Shelter{
+			ID:    "1",
+			Title: "Everyday Shelter",
+			Schedule: models.ShelterSchedule{
+				Type:      "everyday",
+				DaysAhead: 60,
+			},
+		},
+	}
 
-// TestEndToEndUserFlow tests a complete user interaction flow
-func TestEndToEndUserFlow(t *testing.T) {
-	app := setupTestApp(t)
-	chatId := int64(12345)
+	// registration for today's trip without start time is already closed.
+	shelterDates := getDatesByMonth(int(now.Month())-1, &shelters)
+	expected := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day() - now.Day()
+	if len(shelterDates) != expected {
+		t.Errorf("Expected %d dates in current month, got %d", expected, len(shelterDates))
+	}
+	for _, v := range shelterDates {
+		if !strings.HasSuffix(v, ", Everyday Shelter") {
+			t.Errorf("Expected date with shelter title, got %s", v)
+		}
+	}
+}
 
-	// Step 1: User starts interaction
-	update := createTestUpdate(t, chatId, "/start")
-	processTestUpdate(app, update)
+// TestRegistrationCutoff tests that registration closes before start of the trip
+func TestRegistrationCutoff(t *testing.T) {
+	defer func(cutoff time.Duration) { registrationCutoff = cutoff }(registrationCutoff)
+	registrationCutoff = 24 * time.Hour
 
-	// Step 2: User chooses to go to shelter
-	update = createTestUpdate(t, chatId, "/go_shelter")
-	processTestUpdate(app, update)
+	shelter := &models.Shelter{
+		Schedule: models.ShelterSchedule{
+			Type:      "everyday",
+			DaysAhead: 5,
+			TimeStart: "11:00",
+		},
+	}
 
-	// Step 3: User selects shelter by choice
-	update = createTestUpdate(t, chatId, "/choose_shelter")
-	processTestUpdate(app, update)
+	now := time.Date(2023, time.May, 10, 12, 0, 0, 0, dates.Location())
+	days := getShelterDays(shelter, now)
+	if len(days) != 3 || days[0].Date() != "12.05.2023" {
+		t.Errorf("Expected dates from 12.05.2023 with global cut-off, got %v", days)
+	}
 
-	// Verify the flow completed without errors
-	mockBot := app.Bot.(*mocks.MockTelegramBot)
-	if mockBot.GetSentMessageCount() < 3 {
-		t.Errorf("Expected at least 3 messages in flow, got %d", mockBot.GetSentMessageCount())
+	shelter.Schedule.RegistrationCutoff = "1h"
+	days = getShelterDays(shelter, now)
+	if len(days) != 4 || days[0].Date() != "11.05.2023" {
+		t.Errorf("Expected dates from 11.05.2023 with shelter cut-off, got %v", days)
+	}
+	if days := schedule.Upcoming(shelter, now); len(days) != 5 {
+		t.Errorf("Expected 5 scheduled days, got %d", len(days))
 	}
 
-	// Verify final state
-	statePoolMutex.RLock()
-	state := statePool[chatId]
-	statePoolMutex.RUnlock()
+	// tomorrow's trip is closed with 2 days cut-off.
+	shelter.Schedule.RegistrationCutoff = "48h"
+	occurrence, err := schedule.At(shelter, dates.Now().AddDate(0, 0, 1).Format("02.01.2006"), dates.Location())
+	if err != nil {
+		t.Fatalf("Failed to get trip: %v", err)
+	}
+	tomorrow := formatTripDate(occurrence)
+	if isTripDateValid(tomorrow, &models.TripToShelter{Shelter: shelter}) {
+		t.Errorf("Expected date %s to be invalid", tomorrow)
+	}
+	if !isRegistrationClosed(tomorrow, shelter) {
+		t.Errorf("Expected registration for %s to be closed", tomorrow)
+	}
+	if isRegistrationClosed("Пн 01.01.2001 11:00", shelter) {
+		t.Error("Expected unknown date not to be reported as closed")
+	}
+	expectedMessage := "Запись на этот выезд уже закрыта ⏰ Регистрация закрывается за 48 ч. до начала выезда. Пожалуйста, выберите другую дату."
+	if message := registrationClosedMessage(shelter); message != expectedMessage {
+		t.Errorf("Unexpected message: %s", message)
+	}
+	if formatted := formatCutoff(90 * time.Minute); formatted != "1 ч. 30 мин." {
+		t.Errorf("Expected 1 ч. 30 мин., got %s", formatted)
+	}
 
-	if state.LastMessage != commandChooseShelter {
-		t.Errorf("Expected final state %s, got %s", commandChooseShelter, state.LastMessage)
+	for _, cutoff := range []string{"abc", "-1h"} {
+		shelter.Schedule.RegistrationCutoff = cutoff
+		if err := schedule.Validate(&shelter.Schedule); err == nil {
+			t.Errorf("Expected error for registration cut-off %q", cutoff)
+		}
 	}
 }
 
-// TestMultipleUsersInteraction tests concurrent users
-func TestMultipleUsersInteraction(t *testing.T) {
-	app := setupTestApp(t)
+// TestOrganisationTimezone tests that dates and trip times are calculated in organisation's timezone
+func TestOrganisationTimezone(t *testing.T) {
+	if err := dates.SetLocation("Europe/Moscow"); err != nil {
+		t.Fatalf("Failed to set timezone: %v", err)
+	}
+	defer dates.SetLocation("")
 
-	users := []int64{12345, 54321, 67890}
+	if err := dates.SetLocation("Mars/Olympus"); err == nil {
+		t.Error("Expected error for unknown timezone")
+	}
+	if dates.Location().String() != "Europe/Moscow" {
+		t.Errorf("Expected timezone to stay Europe/Moscow, got %s", dates.Location())
+	}
 
-	// All users start interaction simultaneously
-	for _, chatId := range users {
-		update := createTestUpdate(t, chatId, "/start")
-		processTestUpdate(app, update)
+	shelter := &models.Shelter{
+		Schedule: models.ShelterSchedule{
+			Type:      "everyday",
+			DaysAhead: 3,
+			TimeStart: "11:00",
+			TimeEnd:   "13:00",
+		},
 	}
 
-	// Verify each user has their own state
-	for _, chatId := range users {
-		statePoolMutex.RLock()
-		state, exists := statePool[chatId]
-		statePoolMutex.RUnlock()
+	// 22:00 UTC is already the next day in Moscow
+	now := time.Date(2023, time.May, 10, 22, 0, 0, 0, time.UTC).In(dates.Location())
+	days := getShelterDays(shelter, now)
+	if len(days) == 0 || days[0].Date() != "11.05.2023" {
+		t.Fatalf("Expected first date 11.05.2023, got %v", days)
+	}
 
-		if !exists {
-			t.Errorf("Expected state to exist for user %d", chatId)
-		}
-		if state.ChatId != chatId {
-			t.Errorf("Expected chat ID %d, got %d", chatId, state.ChatId)
-		}
-		if state.LastMessage != commandStart {
-			t.Errorf("Expected state %s for user %d, got %s", commandStart, chatId, state.LastMessage)
-		}
+	tripStart, err := getTripStart(&models.TripToShelter{Shelter: shelter, Date: "Чт 11.05.2023 11:00"})
+	if err != nil {
+		t.Fatalf("Failed to get trip start: %v", err)
+	}
+	if !tripStart.Equal(time.Date(2023, time.May, 11, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected trip to start at 08:00 UTC, got %s", tripStart.UTC())
 	}
+}
 
-	// Verify correct number of states
-	statePoolMutex.RLock()
-	stateCount := len(statePool)
-	statePoolMutex.RUnlock()
+// TestPeopleLimit tests counting of free seats on the trip
+func TestPeopleLimit(t *testing.T) {
+	setupTestApp(t)
+	date := "Сб 05.11.2022 11:00"
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", PeopleLimit: 2}
 
-	if stateCount != len(users) {
-		t.Errorf("Expected %d states, got %d", len(users), stateCount)
+	if seats := getFreeSeats(shelter, date); seats != 2 {
+		t.Errorf("Expected 2 free seats, got %d", seats)
+	}
+	if !reserveSeat(shelter, date) || !reserveSeat(shelter, date) {
+		t.Fatal("Expected to reserve 2 seats")
+	}
+	if reserveSeat(shelter, date) {
+		t.Error("Expected reservation to fail when trip is full")
+	}
+	if hasFreeSeats(shelter, date) {
+		t.Error("Expected no free seats")
+	}
+	if info := seatsInfo(shelter, date); info != seatsInfoSeparator+"мест нет, лист ожидания" {
+		t.Errorf("Expected full trip info, got %q", info)
+	}
+	if trimSeatsInfo(date+seatsInfo(shelter, date)) != date {
+		t.Error("Expected seats info to be trimmed")
+	}
+
+	// other date of same shelter is not affected
+	if seats := getFreeSeats(shelter, "Вс 06.11.2022 11:00"); seats != 2 {
+		t.Errorf("Expected 2 free seats on other date, got %d", seats)
+	}
+
+	// shelter without limit
+	unlimited := &models.Shelter{ID: "2", PeopleLimit: 0}
+	for i := 0; i < 5; i++ {
+		if !reserveSeat(unlimited, date) {
+			t.Fatal("Expected unlimited shelter to accept registration")
+		}
+	}
+	if info := seatsInfo(unlimited, date); info != "" {
+		t.Errorf("Expected no seats info for unlimited shelter, got %q", info)
 	}
 }
 
-// TestErrorRecoveryInFlow tests error recovery during user flow
-func TestErrorRecoveryInFlow(t *testing.T) {
+// TestRegistrationFinishedWhenTripIsFull tests that user is put to the waitlist if trip filled up
+func TestRegistrationFinishedWhenTripIsFull(t *testing.T) {
 	app := setupTestApp(t)
-	chatId := int64(12345)
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test", PeopleLimit: 1}
+	date := "Сб 05.11.2022 11:00"
 
-	// Start normal flow
-	update := createTestUpdate(t, chatId, "/start")
-	processTestUpdate(app, update)
+	reserveSeat(shelter, date)
 
-	// Inject error in sheets service
-	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
-	mockSheets.SetSaveError(errors.New("temporary error"))
+	trip := &models.TripToShelter{Username: "testuser", Shelter: shelter, Date: date}
+	app.registrationFinished(12345, trip)
 
-	// Try to save a trip (should handle error gracefully)
-	trip := &models.TripToShelter{
-		ID:       "test-error-flow",
-		Username: "testuser",
-		Shelter:  &models.Shelter{ShortTitle: "Test"},
-		Date:     "01.01.2024",
+	if trip.Status != tripStatusWaitlist {
+		t.Errorf("Expected status %q, got %q", tripStatusWaitlist, trip.Status)
+	}
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	if mockSheets.GetSavedTripsCount() != 2 {
+		t.Errorf("Expected waitlisted trip to be saved, got %d saved", mockSheets.GetSavedTripsCount())
+	}
+	if trip.RegisteredAt.IsZero() || !mockSheets.SavedTrips[0].RegisteredAt.Equal(trip.RegisteredAt) {
+		t.Errorf("Expected time of registration to be saved with trip, got %v", mockSheets.SavedTrips[0].RegisteredAt)
+	}
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	if mockBot.GetSentMessageCount() != 1 {
+		t.Fatalf("Expected 1 message, got %d", mockBot.GetSentMessageCount())
+	}
+	if msg := mockBot.SentMessages[0].(tgbotapi.MessageConfig); msg.Text != messageWaitlisted {
+		t.Errorf("Expected waitlist message, got %q", msg.Text)
 	}
 
-	result := app.sendTripToGSheet(chatId, trip)
-	if result {
-		t.Error("Expected false result due to error")
+	waitlistMutex.Lock()
+	waitlistLength := len(waitlist[getTripKey(shelter, date)])
+	waitlistMutex.Unlock()
+	if waitlistLength != 1 {
+		t.Errorf("Expected 1 trip in waitlist, got %d", waitlistLength)
 	}
+}
 
-	// Clear error and continue
-	mockSheets.SetSaveError(nil)
+// TestPromoteFromWaitlist tests that the first user from the waitlist takes freed seat
+func TestPromoteFromWaitlist(t *testing.T) {
+	app := setupTestApp(t)
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test", PeopleLimit: 1}
+	date := "Сб 05.11.2022 11:00"
 
-	// Continue with normal flow
-	update = createTestUpdate(t, chatId, "/go_shelter")
-	processTestUpdate(app, update)
+	app.registrationFinished(111, &models.TripToShelter{Username: "first", Shelter: shelter, Date: date})
+	app.registrationFinished(222, &models.TripToShelter{Username: "second", Shelter: shelter, Date: date})
+	app.registrationFinished(333, &models.TripToShelter{Username: "third", Shelter: shelter, Date: date})
 
-	// Verify state is still valid
-	statePoolMutex.RLock()
-	state := statePool[chatId]
-	statePoolMutex.RUnlock()
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	sentBefore := mockBot.GetSentMessageCount()
 
-	if state.LastMessage != commandGoShelter {
-		t.Errorf("Expected state %s after error recovery, got %s", commandGoShelter, state.LastMessage)
+	app.freeSeat(shelter, date)
+
+	if hasFreeSeats(shelter, date) {
+		t.Error("Expected freed seat to be taken by waitlisted user")
+	}
+	messages := mockBot.SentMessages[sentBefore:]
+	if len(messages) == 0 {
+		t.Fatal("Expected promoted user to be notified")
+	}
+	for _, message := range messages {
+		if msg, ok := message.(tgbotapi.MessageConfig); ok && msg.ChatID != 222 {
+			t.Errorf("Expected messages only to chat 222, got %d", msg.ChatID)
+		}
+	}
+
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	// second trip was saved to the second row after the first trip and system sheet row.
+	status, ok := mockSheets.UpdatedStatuses["Test!A4:I4"]
+	if !ok {
+		t.Fatalf("Expected status of second trip row to be updated, got %v", mockSheets.UpdatedStatuses)
+	}
+	if !strings.HasPrefix(status, tripStatusPromoted) {
+		t.Errorf("Expected promoted status, got %q", status)
+	}
+
+	waitlistMutex.Lock()
+	waitlistLength := len(waitlist[getTripKey(shelter, date)])
+	waitlistMutex.Unlock()
+	if waitlistLength != 1 {
+		t.Errorf("Expected 1 trip left in waitlist, got %d", waitlistLength)
 	}
 }
 
-// TestBotMessageHandling tests various message types
-func TestBotMessageHandling(t *testing.T) {
+// TestMyTripsCommand tests listing of user's upcoming trips
+func TestMyTripsCommand(t *testing.T) {
 	app := setupTestApp(t)
+	chatId := int64(12345)
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test", Link: "https://walkthedog.ru/test"}
+	tomorrow := time.Now().AddDate(0, 0, 1)
+	nextWeek := time.Now().AddDate(0, 0, 7)
+	yesterday := time.Now().AddDate(0, 0, -1)
+
+	app.myTripsCommand(chatId)
 	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	if msg := mockBot.SentMessages[0].(tgbotapi.MessageConfig); msg.Text != messageNoTrips {
+		t.Errorf("Expected no trips message, got %q", msg.Text)
+	}
 
-	// Test different message types
-	testCases := []struct {
-		command  string
-		expected string
-	}{
-		{"/start", commandStart},
-		{"/go_shelter", commandGoShelter},
-		{"/donation", commandDonation},
-		{"/masterclass", commandMasterclass},
+	app.registrationFinished(chatId, &models.TripToShelter{Shelter: shelter, Date: "Сб " + nextWeek.Format("02.01.2006") + " 11:00"})
+	app.registrationFinished(chatId, &models.TripToShelter{Shelter: shelter, Date: "Сб " + tomorrow.Format("02.01.2006") + " 11:00"})
+	app.registrationFinished(chatId, &models.TripToShelter{Shelter: shelter, Date: "Сб " + yesterday.Format("02.01.2006") + " 11:00"})
+	app.registrationFinished(54321, &models.TripToShelter{Shelter: shelter, Date: "Сб " + tomorrow.Format("02.01.2006") + " 11:00"})
+
+	trips := getUpcomingRegistrations(chatId, time.Now())
+	if len(trips) != 2 {
+		t.Fatalf("Expected 2 upcoming trips, got %d", len(trips))
+	}
+	if !strings.Contains(trips[0].Date, tomorrow.Format("02.01.2006")) {
+		t.Errorf("Expected trips to be sorted by date, got %s first", trips[0].Date)
 	}
 
-	for _, tc := range testCases {
-		// Reset state for each test
-		cleanupTestState()
+	sentBefore := mockBot.GetSentMessageCount()
+	app.myTripsCommand(chatId)
+	msg := mockBot.SentMessages[sentBefore].(tgbotapi.MessageConfig)
+	if !strings.Contains(msg.Text, shelter.Link) || !strings.Contains(msg.Text, trips[1].Date) {
+		t.Errorf("Expected message with trips, got %q", msg.Text)
+	}
+	keyboard, ok := msg.ReplyMarkup.(tgbotapi.ReplyKeyboardMarkup)
+	if !ok || len(keyboard.Keyboard) != 2 {
+		t.Errorf("Expected 2 cancel buttons, got %+v", msg.ReplyMarkup)
+	}
+}
 
-		update := createTestUpdate(t, 12345, tc.command)
-		processTestUpdate(app, update)
+// TestCancelTrip tests cancellation of trip which frees seat for waitlisted user
+func TestCancelTrip(t *testing.T) {
+	app := setupTestApp(t)
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test", PeopleLimit: 1}
+	shelters := SheltersList{1: shelter}
+	date := "Сб " + time.Now().AddDate(0, 0, 3).Format("02.01.2006") + " 11:00"
 
-		statePoolMutex.RLock()
-		state := statePool[12345]
-		statePoolMutex.RUnlock()
+	app.registrationFinished(111, &models.TripToShelter{Username: "first", Shelter: shelter, Date: date})
+	app.registrationFinished(222, &models.TripToShelter{Username: "second", Shelter: shelter, Date: date})
 
-		if state.LastMessage != tc.expected {
-			t.Errorf("Command %s: expected state %s, got %s", tc.command, tc.expected, state.LastMessage)
-		}
+	// wrong button
+	update := createTestUpdate(t, 111, "Сб 01.01.2000 11:00, Test Shelter")
+	if lastMessage := app.cancelTripCommand(&update, &shelters); lastMessage != commandMyTrips {
+		t.Errorf("Expected %s after wrong button, got %s", commandMyTrips, lastMessage)
 	}
 
-	// Verify messages were sent for each command
-	if mockBot.GetSentMessageCount() < len(testCases) {
-		t.Errorf("Expected at least %d messages sent, got %d", len(testCases), mockBot.GetSentMessageCount())
+	update = createTestUpdate(t, 111, cancelTripPrefix+date+", Test Shelter")
+	app.cancelTripCommand(&update, &shelters)
+
+	if len(getUpcomingRegistrations(111, time.Now())) != 0 {
+		t.Error("Expected cancelled trip to be removed from user's trips")
+	}
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	if status := mockSheets.UpdatedStatuses["Test!A2:I2"]; !strings.HasPrefix(status, tripStatusCancelled) {
+		t.Errorf("Expected cancelled status in the first trip row, got %q", status)
+	}
+	if status := mockSheets.UpdatedStatuses["Test!A4:I4"]; !strings.HasPrefix(status, tripStatusPromoted) {
+		t.Errorf("Expected promoted status in the second trip row, got %q", status)
+	}
+	trips := getUpcomingRegistrations(222, time.Now())
+	if len(trips) != 1 || !strings.HasPrefix(trips[0].Status, tripStatusPromoted) {
+		t.Errorf("Expected waitlisted user to be promoted, got %+v", trips)
+	}
+
+	// waitlisted user cancels trip, seat stays taken by promoted user
+	app.registrationFinished(333, &models.TripToShelter{Username: "third", Shelter: shelter, Date: date})
+	update = createTestUpdate(t, 333, cancelTripPrefix+date+", Test Shelter")
+	app.cancelTripCommand(&update, &shelters)
+	waitlistMutex.Lock()
+	waitlistLength := len(waitlist[getTripKey(shelter, date)])
+	waitlistMutex.Unlock()
+	if waitlistLength != 0 {
+		t.Errorf("Expected empty waitlist, got %d", waitlistLength)
+	}
+	if hasFreeSeats(shelter, date) {
+		t.Error("Expected seat to be still taken by promoted user")
 	}
 }
 
-// =================== SPECIFIC BUG REGRESSION TESTS ===================
+// TestRemoveRegistrationMovedToSheetDate tests that registration moved to date written by coordinators is removed by date of schedule
+func TestRemoveRegistrationMovedToSheetDate(t *testing.T) {
+	setupTestApp(t)
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test"}
+	addRegistration(&models.TripToShelter{ID: "trip-1", ChatId: 111, Shelter: shelter, Date: "05.11.2022"})
 
-// TestOriginalNilPointerBug tests the specific bug from the error log:
-// panic: runtime error: invalid memory address or nil pointer dereference
-// at main.(*AppConfig).sendTripToGSheet when Google Sheets returns 403 error
-func TestOriginalNilPointerBug(t *testing.T) {
+	if removed := removeRegistration(111, shelter, "Сб 05.11.2022 11:00"); removed == nil || removed.ID != "trip-1" {
+		t.Fatalf("Expected registration to be removed, got %+v", removed)
+	}
+	if findRegistration(111, shelter, "05.11.2022") != nil {
+		t.Error("Expected no registration after removal")
+	}
+}
+
+// TestTripRepository tests that registrations and their changes are stored in the repository and restored after restart
+func TestTripRepository(t *testing.T) {
 	app := setupTestApp(t)
+	tripsPath := t.TempDir() + "/trips.jsonl"
+	trips, err := repository.NewFileTripRepository(tripsPath)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	app.Trips = trips
 
-	// Simulate the exact error from the log: Google Sheets 403 permission error
-	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
-	mockSheets.SetSaveError(errors.New("googleapi: Error 403: The caller does not have permission, forbidden"))
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test", PeopleLimit: 1}
+	shelters := SheltersList{1: shelter}
+	date := "Сб " + time.Now().AddDate(0, 0, 3).Format("02.01.2006") + " 11:00"
 
-	// Test 1: Valid trip with Google Sheets error (should handle gracefully)
-	trip := &models.TripToShelter{
-		ID:       "test-403-error",
-		Username: "testuser",
-		Shelter:  &models.Shelter{ShortTitle: "TestShelter"},
-		Date:     "01.01.2024",
+	app.registrationFinished(111, &models.TripToShelter{Username: "first", Shelter: shelter, Date: date})
+	app.registrationFinished(222, &models.TripToShelter{Username: "second", Shelter: shelter, Date: date})
+	app.registrationFinished(333, &models.TripToShelter{Username: "third", Shelter: shelter, Date: date})
+	update := createTestUpdate(t, 333, cancelTripPrefix+date+", Test Shelter")
+	app.cancelTripCommand(&update, &shelters)
+
+	cancelled, _ := app.Trips.ListByChat(333)
+	if len(cancelled) != 1 {
+		t.Fatalf("Expected one trip of chat 333, got %+v", cancelled)
+	}
+	history, err := app.Trips.History(cancelled[0])
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	var types []string
+	for _, event := range history {
+		types = append(types, event.Type)
+	}
+	expectedTypes := []string{repository.EventRegistered, repository.EventUpdated, repository.EventStatusChanged}
+	if strings.Join(types, ",") != strings.Join(expectedTypes, ",") {
+		t.Errorf("Expected history %v, got %v", expectedTypes, types)
+	}
+	if !strings.HasPrefix(history[2].Trip.Status, tripStatusCancelled) {
+		t.Errorf("Expected cancelled status in history, got %q", history[2].Trip.Status)
 	}
 
-	result := app.sendTripToGSheet(12345, trip)
-	if result {
-		t.Error("Expected false result due to Google Sheets 403 error")
+	// new registration to the same trip doesn't overwrite cancelled one
+	app.registrationFinished(333, &models.TripToShelter{Username: "third", Shelter: shelter, Date: date})
+
+	// restart
+	cleanupTestState()
+	app.Trips, err = repository.NewFileTripRepository(tripsPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen repository: %v", err)
+	}
+	stored, _ := app.Trips.List()
+	if len(stored) != 4 || stored[0].Username != "first" || stored[1].Status != tripStatusWaitlist ||
+		!strings.HasPrefix(stored[2].Status, tripStatusCancelled) || stored[3].Status != tripStatusWaitlist {
+		t.Fatalf("Expected 4 stored trips in order of registration, got %+v", stored)
+	}
+	if byChat, _ := app.Trips.ListByChat(222); len(byChat) != 1 || byChat[0].SheetRange == "" {
+		t.Errorf("Expected trip of chat 222 with sheet row, got %+v", byChat)
 	}
 
-	// Test 2: Nil trip (original crash scenario)
-	result = app.sendTripToGSheet(12345, nil)
-	if result {
-		t.Error("Expected false result for nil trip")
+	if err := app.restoreTrips(shelters); err != nil {
+		t.Fatalf("Failed to restore trips: %v", err)
+	}
+	if hasFreeSeats(shelter, date) {
+		t.Error("Expected seat to be taken after restart")
+	}
+	if trips := getUpcomingRegistrations(333, time.Now()); len(trips) != 1 || trips[0].ID != stored[3].ID {
+		t.Errorf("Expected only new trip of chat 333 to be restored, got %+v", trips)
+	}
+	restored := getUpcomingRegistrations(222, time.Now())
+	if len(restored) != 1 || restored[0].Shelter != shelter {
+		t.Fatalf("Expected waitlisted trip with shelter from current list, got %+v", restored)
 	}
 
-	// Test 3: Trip with nil shelter (would cause original crash at line 1416)
-	tripWithNilShelter := &models.TripToShelter{
-		ID:       "test-nil-shelter",
-		Username: "testuser",
-		Shelter:  nil, // This would cause newTripToShelter.Shelter.ShortTitle panic
-		Date:     "01.01.2024",
+	// waitlist is restored too, so the first user's cancellation promotes the second one.
+	update = createTestUpdate(t, 111, cancelTripPrefix+date+", Test Shelter")
+	app.cancelTripCommand(&update, &shelters)
+	if trips := getUpcomingRegistrations(222, time.Now()); len(trips) != 1 || !strings.HasPrefix(trips[0].Status, tripStatusPromoted) {
+		t.Errorf("Expected waitlisted user to be promoted after restart, got %+v", trips)
 	}
+}
 
-	result = app.sendTripToGSheet(12345, tripWithNilShelter)
-	if result {
-		t.Error("Expected false result for trip with nil shelter")
+// TestTripReminders tests scheduling, sending and persisting reminders about upcoming trips
+func TestTripReminders(t *testing.T) {
+	app := setupTestApp(t)
+	remindersPath := t.TempDir() + "/reminders.json"
+	store, err := reminder.NewStore(remindersPath)
+	if err != nil {
+		t.Fatalf("Failed to create reminders store: %v", err)
 	}
+	app.Reminders = store
+	app.ReminderDaysBefore = []int{5, 1}
 
-	// If we reach here without panicking, the bug is fixed!
+	shelter := &models.Shelter{
+		ID:         "1",
+		Title:      "Test Shelter",
+		ShortTitle: "Test",
+		Address:    "Test address",
+		Guide:      "https://docs.google.com/document/d/test",
+		Schedule:   models.ShelterSchedule{TimeStart: "11:00"},
+	}
+	tripDay := time.Now().AddDate(0, 0, 10)
+	date := "Сб " + tripDay.Format("02.01.2006") + " 11:00"
+	app.registrationFinished(12345, &models.TripToShelter{Username: "testuser", Shelter: shelter, Date: date})
+
+	if store.Len() != 2 {
+		t.Fatalf("Expected 2 reminders, got %d", store.Len())
+	}
+
+	// reminders survive restart
+	store, err = reminder.NewStore(remindersPath)
+	if err != nil {
+		t.Fatalf("Failed to reload reminders store: %v", err)
+	}
+	app.Reminders = store
+	if store.Len() != 2 {
+		t.Fatalf("Expected 2 reminders after reload, got %d", store.Len())
+	}
+
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	sentBefore := mockBot.GetSentMessageCount()
+
+	// nothing to send yet
+	app.sendDueReminders(time.Now())
+	if mockBot.GetSentMessageCount() != sentBefore {
+		t.Error("Expected no reminders to be sent before time")
+	}
+
+	// 5 days before trip
+	app.sendDueReminders(time.Now().AddDate(0, 0, 6))
+	if mockBot.GetSentMessageCount() != sentBefore+1 {
+		t.Fatalf("Expected 1 reminder to be sent, got %d", mockBot.GetSentMessageCount()-sentBefore)
+	}
+	msg := mockBot.SentMessages[sentBefore].(tgbotapi.MessageConfig)
+	if msg.ChatID != 12345 || !strings.Contains(msg.Text, shelter.Address) || !strings.Contains(msg.Text, shelter.Guide) || !strings.Contains(msg.Text, "11:00") {
+		t.Errorf("Unexpected reminder message: %+v", msg)
+	}
+
+	// same reminder is not sent twice
+	app.sendDueReminders(time.Now().AddDate(0, 0, 6))
+	if mockBot.GetSentMessageCount() != sentBefore+1 {
+		t.Error("Expected reminder not to be sent twice")
+	}
+
+	// cancelled trip has no reminders
+	cancelUpdate := createTestUpdate(t, 12345, cancelTripPrefix+date+", Test Shelter")
+	shelters := SheltersList{1: shelter}
+	app.cancelTripCommand(&cancelUpdate, &shelters)
+	if store.Len() != 0 {
+		t.Errorf("Expected reminders of cancelled trip to be removed, got %d", store.Len())
+	}
 }
 
-// TestGoogleSheetsErrorScenarios tests various Google Sheets API error scenarios
-func TestGoogleSheetsErrorScenarios(t *testing.T) {
+// TestTripCalendar tests ics file which is sent to user after registration
+func TestTripCalendar(t *testing.T) {
 	app := setupTestApp(t)
-	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	shelter := &models.Shelter{
+		ID:         "1",
+		Title:      "Хаски Хелп (Истра)",
+		ShortTitle: "Хаски",
+		Address:    "Московская область, деревня Карцево",
+		Link:       "https://walkthedog.ru/huskyhelp",
+		Schedule:   models.ShelterSchedule{TimeStart: "11:00", TimeEnd: "13:00"},
+	}
+	trip := &models.TripToShelter{ChatId: 12345, Shelter: shelter, Date: "Сб 05.11.2022 11:00"}
 
-	trip := &models.TripToShelter{
-		ID:       "test-error-scenarios",
-		Username: "testuser",
-		Shelter:  &models.Shelter{ShortTitle: "TestShelter"},
-		Date:     "01.01.2024",
+	calendar, err := tripCalendar(trip, time.Now())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// unfold long lines
+	content := strings.ReplaceAll(string(calendar), "\r\n ", "")
+	tripStart := time.Date(2022, time.November, 5, 11, 0, 0, 0, time.Local).UTC().Format("20060102T150405Z")
+	tripEnd := time.Date(2022, time.November, 5, 13, 0, 0, 0, time.Local).UTC().Format("20060102T150405Z")
+	for _, expected := range []string{"BEGIN:VCALENDAR\r\n", "DTSTART:" + tripStart, "DTEND:" + tripEnd, `LOCATION:Московская область\, деревня Карцево`, "URL:" + shelter.Link, "END:VCALENDAR\r\n"} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Expected calendar to contain %q, got:\n%s", expected, content)
+		}
+	}
+	for _, line := range strings.Split(string(calendar), "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("Expected line to be folded, got %d octets: %q", len(line), line)
+		}
 	}
 
-	errorScenarios := []struct {
-		name  string
-		error string
-	}{
-		{"403 Permission Error", "googleapi: Error 403: The caller does not have permission, forbidden"},
-		{"401 Authentication Error", "googleapi: Error 401: Request had invalid authentication credentials"},
-		{"429 Rate Limit Error", "googleapi: Error 429: Quota exceeded"},
-		{"500 Server Error", "googleapi: Error 500: Internal error encountered"},
-		{"Network Error", "network error: connection timeout"},
-		{"503 Service Unavailable", "googleapi: Error 503: The service is currently unavailable., backendError"},
+	app.sendTripCalendar(12345, trip)
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	document, ok := mockBot.SentMessages[0].(tgbotapi.DocumentConfig)
+	if !ok {
+		t.Fatalf("Expected document to be sent, got %T", mockBot.SentMessages[0])
+	}
+	if file, ok := document.File.(tgbotapi.FileBytes); !ok || file.Name != "walkthedog_05.11.2022.ics" {
+		t.Errorf("Expected ics file, got %+v", document.File)
 	}
+}
 
-	for _, scenario := range errorScenarios {
-		t.Run(scenario.name, func(t *testing.T) {
-			mockSheets.SetSaveError(errors.New(scenario.error))
+// TestShelterCalendarFeed tests ics feed of shelter's upcoming trips
+func TestShelterCalendarFeed(t *testing.T) {
+	shelters := SheltersList{
+		1: &models.Shelter{
+			ID:    "1",
+			Title: "Everyday Shelter",
+			Schedule: models.ShelterSchedule{
+				Type:      "everyday",
+				DaysAhead: 7,
+				TimeStart: "10:00",
+				TimeEnd:   "18:00",
+			},
+		},
+	}
 
-			result := app.sendTripToGSheet(12345, trip)
-			if result {
-				t.Errorf("Expected false result for %s", scenario.name)
-			}
+	server := httptest.NewServer(calendarHandler(&shelters))
+	defer server.Close()
 
-			// Verify app continues to function after error
-			mockSheets.SetSaveError(nil)
-			result = app.sendTripToGSheet(12345, trip)
-			if !result {
-				t.Errorf("Expected recovery after %s was cleared", scenario.name)
-			}
-		})
+	resp, err := http.Get(server.URL + calendarPath + "1.ics")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/calendar") {
+		t.Errorf("Expected calendar content type, got %s", contentType)
+	}
+	if count := strings.Count(string(body), "BEGIN:VEVENT"); count != 7 {
+		t.Errorf("Expected 7 events, got %d", count)
+	}
+
+	resp, err = http.Get(server.URL + calendarPath + "999.ics")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown shelter, got %d", resp.StatusCode)
+	}
+}
+
+// TestGetDateAndShelter tests parsing of date button chosen by month
+func TestGetDateAndShelter(t *testing.T) {
+	shelters := getSheltersListForTest()
+
+	date, shelter, err := shelters.getDateAndShelter("Сб 05.11.2022 11:00, Test Shelter" + seatsInfoSeparator + "осталось мест: 3")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if date != "Сб 05.11.2022 11:00" {
+		t.Errorf("Expected date without seats info, got %q", date)
+	}
+	if shelter.ID != "1" {
+		t.Errorf("Expected shelter 1, got %s", shelter.ID)
+	}
+
+	if _, _, err := shelters.getDateAndShelter("Сб 05.11.2022 11:00"); err == nil {
+		t.Error("Expected error for text without shelter")
+	}
+	if _, _, err := shelters.getDateAndShelter("Сб 05.11.2022 11:00, Unknown"); err == nil {
+		t.Error("Expected error for unknown shelter")
+	}
+}
+
+// TestOneOffDates tests "dates" schedule with per-date time and people limit
+func TestOneOffDates(t *testing.T) {
+	setupTestApp(t)
+	now := time.Now()
+	nextWeek := now.AddDate(0, 0, 7)
+	nextMonth := now.AddDate(0, 1, 0)
+	shelter := &models.Shelter{
+		ID:          "1",
+		Title:       "Dates Shelter",
+		PeopleLimit: 20,
+		Schedule: models.ShelterSchedule{
+			Type: "dates",
+			Dates: []models.ShelterDate{
+				{Date: nextMonth.Format("02.01.2006")},
+				{Date: nextWeek.Format("02.01.2006"), TimeStart: "12:00", TimeEnd: "15:00", PeopleLimit: 2},
+				{Date: now.AddDate(0, 0, -1).Format("02.01.2006")},
+				{Date: "wrong date"},
+			},
+			TimeStart: "11:00",
+			TimeEnd:   "13:00",
+		},
+	}
+
+	shelterDates := getDatesByShelter(shelter)
+	if len(shelterDates) != 2 {
+		t.Fatalf("Expected 2 upcoming dates, got %d: %v", len(shelterDates), shelterDates)
+	}
+	expected := dates.WeekDaysRu[nextWeek.Weekday()] + " " + nextWeek.Format("02.01.2006") + " 12:00"
+	if shelterDates[0] != expected {
+		t.Errorf("Expected first date %q, got %q", expected, shelterDates[0])
+	}
+	if !strings.HasSuffix(shelterDates[1], " 11:00") {
+		t.Errorf("Expected default start time, got %q", shelterDates[1])
+	}
+
+	trip := &models.TripToShelter{Shelter: shelter, Date: shelterDates[0]}
+	if !isTripDateValid(shelterDates[0], trip) {
+		t.Errorf("Expected date %s to be valid", shelterDates[0])
 	}
+	if tripEnd := getTripEnd(trip); tripEnd.Hour() != 15 {
+		t.Errorf("Expected trip to end at 15:00, got %v", tripEnd)
+	}
+	if seats := getFreeSeats(shelter, shelterDates[0]); seats != 2 {
+		t.Errorf("Expected people limit of date, got %d seats", seats)
+	}
+	if seats := getFreeSeats(shelter, shelterDates[1]); seats != 20 {
+		t.Errorf("Expected people limit of shelter, got %d seats", seats)
+	}
+
+	shelter.Schedule.DatesExceptions = []string{nextWeek.Format("02.01.2006")}
+	if isTripDateValid(expected, trip) {
+		t.Error("Expected exception date to be invalid")
+	}
+
+	shelters := SheltersList{1: shelter}
+	byMonth := getDatesByMonth(int(nextMonth.Month())-1, &shelters)
+	if len(byMonth) != 1 || !strings.HasSuffix(byMonth[0], ", Dates Shelter") {
+		t.Errorf("Expected 1 date in next month, got %v", byMonth)
+	}
+}
+
+// TestSessionPersistence tests that conversations in progress are restored after restart
+func TestSessionPersistence(t *testing.T) {
+	app := setupTestApp(t)
+	app.Sessions = session.NewStore(t.TempDir() + "/sessions.json")
+
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter"}
+	shelters := SheltersList{1: shelter}
+
+	statePoolMutex.Lock()
+	statePool[12345] = &models.State{
+		ChatId:      12345,
+		LastMessage: commandTripPurpose,
+		TripToShelter: &models.TripToShelter{
+			Username:    "testuser",
+			Shelter:     &models.Shelter{ID: "1", Title: "Old Title"},
+			Date:        "Сб 05.11.2022 11:00",
+			IsFirstTrip: true,
+		},
+	}
+	statePoolMutex.Unlock()
+	addPoll("poll-1", 12345)
+
+	app.saveSessions()
+	cleanupTestState()
+
+	if err := app.restoreSessions(shelters); err != nil {
+		t.Fatalf("Failed to restore sessions: %v", err)
+	}
+
+	statePoolMutex.RLock()
+	state, ok := statePool[12345]
+	statePoolMutex.RUnlock()
+	if !ok {
+		t.Fatal("Expected state to be restored")
+	}
+	if state.LastMessage != commandTripPurpose || state.TripToShelter.Username != "testuser" || !state.TripToShelter.IsFirstTrip {
+		t.Errorf("Unexpected restored state: %+v", state)
+	}
+	if state.TripToShelter.Shelter != shelter {
+		t.Error("Expected restored trip to use shelter from current list")
+	}
+
+	chatId, _ := getPollChatId("poll-1")
+	if chatId != 12345 {
+		t.Errorf("Expected poll to be mapped to chat 12345, got %d", chatId)
+	}
+
+	// nothing saved yet
+	app.Sessions = session.NewStore(t.TempDir() + "/sessions.json")
+	if err := app.restoreSessions(shelters); err != nil {
+		t.Fatalf("Failed to restore empty sessions: %v", err)
+	}
+	statePoolMutex.RLock()
+	count := len(statePool)
+	statePoolMutex.RUnlock()
+	if count != 0 {
+		t.Errorf("Expected no states, got %d", count)
+	}
+}
+
+// TestCacheInitialization tests cache initialization
+func TestCacheInitialization(t *testing.T) {
+	cache, err := initCache()
+	if err != nil {
+		t.Errorf("Expected no error initializing cache, got %v", err)
+	}
+	if cache == nil {
+		t.Error("Expected cache to be initialized")
+	}
+}
+
+// TestNewTripToShelter tests trip creation helper
+func TestNewTripToShelter(t *testing.T) {
+	username := "testuser"
+	trip := NewTripToShelter(username)
+
+	if trip == nil {
+		t.Error("Expected trip to be created")
+	}
+	if trip.Username != username {
+		t.Errorf("Expected username %s, got %s", username, trip.Username)
+	}
+	// Note: ID is not automatically generated in NewTripToShelter
+	// IDs are typically set elsewhere in the application flow
+}
+
+// =================== INTEGRATION TESTS ===================
+
+// TestEndToEndUserFlow tests a complete user interaction flow
+func TestEndToEndUserFlow(t *testing.T) {
+	app := setupTestApp(t)
+	chatId := int64(12345)
+
+	// Step 1: User starts interaction
+	update := createTestUpdate(t, chatId, "/start")
+	processTestUpdate(app, update)
+
+	// Step 2: User chooses to go to shelter
+	update = createTestUpdate(t, chatId, "/go_shelter")
+	processTestUpdate(app, update)
+
+	// Step 3: User selects shelter by choice
+	update = createTestUpdate(t, chatId, "/choose_shelter")
+	processTestUpdate(app, update)
+
+	// Verify the flow completed without errors
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	if mockBot.GetSentMessageCount() < 3 {
+		t.Errorf("Expected at least 3 messages in flow, got %d", mockBot.GetSentMessageCount())
+	}
+
+	// Verify final state
+	statePoolMutex.RLock()
+	state := statePool[chatId]
+	statePoolMutex.RUnlock()
+
+	if state.LastMessage != commandChooseShelter {
+		t.Errorf("Expected final state %s, got %s", commandChooseShelter, state.LastMessage)
+	}
+}
+
+// TestMultipleUsersInteraction tests concurrent users
+func TestMultipleUsersInteraction(t *testing.T) {
+	app := setupTestApp(t)
+
+	users := []int64{12345, 54321, 67890}
+
+	// All users start interaction simultaneously
+	for _, chatId := range users {
+		update := createTestUpdate(t, chatId, "/start")
+		processTestUpdate(app, update)
+	}
+
+	// Verify each user has their own state
+	for _, chatId := range users {
+		statePoolMutex.RLock()
+		state, exists := statePool[chatId]
+		statePoolMutex.RUnlock()
+
+		if !exists {
+			t.Errorf("Expected state to exist for user %d", chatId)
+		}
+		if state.ChatId != chatId {
+			t.Errorf("Expected chat ID %d, got %d", chatId, state.ChatId)
+		}
+		if state.LastMessage != commandStart {
+			t.Errorf("Expected state %s for user %d, got %s", commandStart, chatId, state.LastMessage)
+		}
+	}
+
+	// Verify correct number of states
+	statePoolMutex.RLock()
+	stateCount := len(statePool)
+	statePoolMutex.RUnlock()
+
+	if stateCount != len(users) {
+		t.Errorf("Expected %d states, got %d", len(users), stateCount)
+	}
+}
+
+// TestErrorRecoveryInFlow tests error recovery during user flow
+func TestErrorRecoveryInFlow(t *testing.T) {
+	app := setupTestApp(t)
+	chatId := int64(12345)
+
+	// Start normal flow
+	update := createTestUpdate(t, chatId, "/start")
+	processTestUpdate(app, update)
+
+	// Inject error in sheets service
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	mockSheets.SetSaveError(errors.New("temporary error"))
+
+	// Try to save a trip (should handle error gracefully)
+	trip := &models.TripToShelter{
+		ID:       "test-error-flow",
+		Username: "testuser",
+		Shelter:  &models.Shelter{ShortTitle: "Test"},
+		Date:     "01.01.2024",
+	}
+
+	result := app.exportTrip(trip)
+	if result {
+		t.Error("Expected false result due to error")
+	}
+
+	// Clear error and continue
+	mockSheets.SetSaveError(nil)
+
+	// Continue with normal flow
+	update = createTestUpdate(t, chatId, "/go_shelter")
+	processTestUpdate(app, update)
+
+	// Verify state is still valid
+	statePoolMutex.RLock()
+	state := statePool[chatId]
+	statePoolMutex.RUnlock()
+
+	if state.LastMessage != commandGoShelter {
+		t.Errorf("Expected state %s after error recovery, got %s", commandGoShelter, state.LastMessage)
+	}
+}
+
+// TestBotMessageHandling tests various message types
+func TestBotMessageHandling(t *testing.T) {
+	app := setupTestApp(t)
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+
+	// Test different message types
+	testCases := []struct {
+		command  string
+		expected string
+	}{
+		{"/start", commandStart},
+		{"/go_shelter", commandGoShelter},
+		{"/donation", commandDonation},
+		{"/masterclass", commandMasterclass},
+	}
+
+	for _, tc := range testCases {
+		// Reset state for each test
+		cleanupTestState()
+
+		update := createTestUpdate(t, 12345, tc.command)
+		processTestUpdate(app, update)
+
+		statePoolMutex.RLock()
+		state := statePool[12345]
+		statePoolMutex.RUnlock()
+
+		if state.LastMessage != tc.expected {
+			t.Errorf("Command %s: expected state %s, got %s", tc.command, tc.expected, state.LastMessage)
+		}
+	}
+
+	// Verify messages were sent for each command
+	if mockBot.GetSentMessageCount() < len(testCases) {
+		t.Errorf("Expected at least %d messages sent, got %d", len(testCases), mockBot.GetSentMessageCount())
+	}
+}
+
+// =================== SPECIFIC BUG REGRESSION TESTS ===================
+
+// TestOriginalNilPointerBug tests the specific bug from the error log:
+// panic: runtime error: invalid memory address or nil pointer dereference
+// at main.(*AppConfig).sendTripToGSheet when Google Sheets returns 403 error
+func TestOriginalNilPointerBug(t *testing.T) {
+	app := setupTestApp(t)
+
+	// Simulate the exact error from the log: Google Sheets 403 permission error
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	mockSheets.SetSaveError(errors.New("googleapi: Error 403: The caller does not have permission, forbidden"))
+
+	// Test 1: Valid trip with Google Sheets error (should handle gracefully)
+	trip := &models.TripToShelter{
+		ID:       "test-403-error",
+		Username: "testuser",
+		Shelter:  &models.Shelter{ShortTitle: "TestShelter"},
+		Date:     "01.01.2024",
+	}
+
+	result := app.exportTrip(trip)
+	if result {
+		t.Error("Expected false result due to Google Sheets 403 error")
+	}
+
+	// Test 2: Nil trip (original crash scenario)
+	result = app.exportTrip(nil)
+	if result {
+		t.Error("Expected false result for nil trip")
+	}
+
+	// Test 3: Trip with nil shelter (would cause original crash at line 1416)
+	tripWithNilShelter := &models.TripToShelter{
+		ID:       "test-nil-shelter",
+		Username: "testuser",
+		Shelter:  nil, // This would cause newTripToShelter.Shelter.ShortTitle panic
+		Date:     "01.01.2024",
+	}
+
+	result = app.exportTrip(tripWithNilShelter)
+	if result {
+		t.Error("Expected false result for trip with nil shelter")
+	}
+
+	// If we reach here without panicking, the bug is fixed!
+}
+
+// TestGoogleSheetsErrorScenarios tests various Google Sheets API error scenarios
+func TestGoogleSheetsErrorScenarios(t *testing.T) {
+	app := setupTestApp(t)
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+
+	trip := &models.TripToShelter{
+		ID:       "test-error-scenarios",
+		Username: "testuser",
+		Shelter:  &models.Shelter{ShortTitle: "TestShelter"},
+		Date:     "01.01.2024",
+	}
+
+	errorScenarios := []struct {
+		name  string
+		error string
+	}{
+		{"403 Permission Error", "googleapi: Error 403: The caller does not have permission, forbidden"},
+		{"401 Authentication Error", "googleapi: Error 401: Request had invalid authentication credentials"},
+		{"429 Rate Limit Error", "googleapi: Error 429: Quota exceeded"},
+		{"500 Server Error", "googleapi: Error 500: Internal error encountered"},
+		{"Network Error", "network error: connection timeout"},
+		{"503 Service Unavailable", "googleapi: Error 503: The service is currently unavailable., backendError"},
+	}
+
+	for _, scenario := range errorScenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			mockSheets.SetSaveError(errors.New(scenario.error))
+
+			result := app.exportTrip(trip)
+			if result {
+				t.Errorf("Expected false result for %s", scenario.name)
+			}
+
+			// Verify app continues to function after error
+			mockSheets.SetSaveError(nil)
+			result = app.exportTrip(trip)
+			if !result {
+				t.Errorf("Expected recovery after %s was cleared", scenario.name)
+			}
+		})
+	}
+}
+
+// TestOutbox tests that failed writes to google sheet are kept in outbox and retried without duplicating saved rows
+func TestOutbox(t *testing.T) {
+	app := setupTestApp(t)
+	outboxPath := t.TempDir() + "/outbox.json"
+	store, err := outbox.NewStore(outboxPath)
+	if err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	app.Outbox = store
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test"}
+	trip := &models.TripToShelter{ID: "trip-1", ChatId: 12345, Username: "testuser", Shelter: shelter, Date: "Сб 05.11.2022 11:00"}
+
+	// main tab is saved, system tab fails
+	mockSheets.SetSystemSaveError(errors.New("system tab error"))
+	if app.exportTrip(trip) {
+		t.Fatal("Expected export to fail")
+	}
+	if mockSheets.GetSavedTripsCount() != 1 {
+		t.Fatalf("Expected trip to be saved to main tab only, got %d saves", mockSheets.GetSavedTripsCount())
+	}
+	if trip.SheetRange == "" {
+		t.Error("Expected row of saved trip to be remembered")
+	}
+	if app.Outbox.Len() != 1 {
+		t.Fatalf("Expected 1 entry in outbox, got %d", app.Outbox.Len())
+	}
+	if summary := app.outboxSummary(); !strings.Contains(summary, "1") || !strings.Contains(summary, "system tab error") {
+		t.Errorf("Expected summary with queue length and last error, got %q", summary)
+	}
+
+	// next attempt is postponed
+	now := dates.Now()
+	mockSheets.SetSystemSaveError(nil)
+	app.processOutbox(now, false)
+	if mockSheets.GetSavedTripsCount() != 1 || app.Outbox.Len() != 1 {
+		t.Fatal("Expected entry not to be retried before backoff")
+	}
+
+	// restart
+	app.Outbox, err = outbox.NewStore(outboxPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen outbox: %v", err)
+	}
+	entries := app.Outbox.All()
+	if len(entries) != 1 || !entries[0].MainSaved || entries[0].SystemSaved || entries[0].Attempts != 1 {
+		t.Fatalf("Unexpected restored outbox: %+v", entries)
+	}
+
+	app.processOutbox(now.Add(outbox.Backoff(1)), false)
+	if mockSheets.GetSavedTripsCount() != 2 {
+		t.Errorf("Expected only system tab to be saved on retry, got %d saves", mockSheets.GetSavedTripsCount())
+	}
+	if app.Outbox.Len() != 0 {
+		t.Errorf("Expected outbox to be empty, got %d entries", app.Outbox.Len())
+	}
+
+	backoffs := map[int]time.Duration{1: time.Minute, 2: 2 * time.Minute, 4: 8 * time.Minute, 7: time.Hour, 20: time.Hour}
+	for attempts, expected := range backoffs {
+		if backoff := outbox.Backoff(attempts); backoff != expected {
+			t.Errorf("Expected backoff %v after %d attempts, got %v", expected, attempts, backoff)
+		}
+	}
+}
+
+// TestOutboxSummaryWhileWriting tests that summary of outbox is built while worker retries entries, run with -race flag
+func TestOutboxSummaryWhileWriting(t *testing.T) {
+	app := setupTestApp(t)
+	store, err := outbox.NewStore(t.TempDir() + "/outbox.json")
+	if err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	app.Outbox = store
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	mockSheets.SetSaveError(errors.New("sheets are unavailable"))
+
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test"}
+	trip := models.TripToShelter{ID: "trip-1", ChatId: 12345, Username: "testuser", Shelter: shelter, Date: "Сб 05.11.2022 11:00"}
+	if err := app.Outbox.Add(&models.OutboxEntry{Kind: outbox.KindAppend, TripToShelter: trip}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			app.processOutbox(dates.Now(), true)
+		}
+		close(done)
+	}()
+	for i := 0; i < 20; i++ {
+		if summary := app.outboxSummary(); !strings.Contains(summary, "1") {
+			t.Errorf("Expected summary with queue length, got %q", summary)
+		}
+	}
+	<-done
+
+	if summary := app.outboxSummary(); !strings.Contains(summary, "sheets are unavailable") {
+		t.Errorf("Expected summary with last error, got %q", summary)
+	}
+}
+
+// TestWriteToDeletedSheet tests that tab deleted after it was checked is created again by the next write
+func TestWriteToDeletedSheet(t *testing.T) {
+	app := setupTestApp(t)
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test"}
+	trip := models.TripToShelter{ID: "trip-1", ChatId: 12345, Username: "testuser", Shelter: shelter, Date: "Сб 05.11.2022 11:00"}
+
+	if err := app.writeOutboxEntry(&models.OutboxEntry{Kind: outbox.KindAppend, TripToShelter: trip}); err != nil {
+		t.Fatalf("Failed to write trip: %v", err)
+	}
+
+	// coordinators deleted the tab
+	mockSheets.SetHasSheetResponse(false)
+	mockSheets.SheetSaveErrors["Test"] = &googleapi.Error{Code: http.StatusBadRequest, Message: "Unable to parse range: 'Test'!A2:I"}
+	if err := app.writeOutboxEntry(&models.OutboxEntry{Kind: outbox.KindAppend, TripToShelter: trip}); err == nil {
+		t.Fatal("Expected write to deleted tab to fail")
+	}
+	if mockSheets.GetCreatedSheetsCount() != 0 {
+		t.Fatalf("Expected tab not to be created before it's known to be deleted, got %v", mockSheets.CreatedSheets)
+	}
+
+	delete(mockSheets.SheetSaveErrors, "Test")
+	if err := app.writeOutboxEntry(&models.OutboxEntry{Kind: outbox.KindAppend, TripToShelter: trip}); err != nil {
+		t.Fatalf("Failed to write trip: %v", err)
+	}
+	if !reflect.DeepEqual(mockSheets.CreatedSheets, []string{"Test"}) {
+		t.Errorf("Expected deleted tab to be created again, got %v", mockSheets.CreatedSheets)
+	}
+}
+
+// TestOutboxWriteInProgress tests that user's update doesn't wait for write of outbox to google sheet and status changed meanwhile is written later
+func TestOutboxWriteInProgress(t *testing.T) {
+	app := setupTestApp(t)
+	store, err := outbox.NewStore(t.TempDir() + "/outbox.json")
+	if err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	app.Outbox = store
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	mockSheets.SaveGate = make(chan struct{})
+
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test"}
+	trip := &models.TripToShelter{ID: "trip-1", ChatId: 12345, Username: "testuser", Shelter: shelter, Date: "Сб 05.11.2022 11:00"}
+	if err := app.Outbox.Add(&models.OutboxEntry{Kind: outbox.KindAppend, TripToShelter: *trip}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		app.processOutbox(dates.Now(), false)
+		close(written)
+	}()
+	for started := false; !started; {
+		time.Sleep(time.Millisecond)
+		outboxMutex.Lock()
+		started = len(writingOutboxEntries) == 1
+		outboxMutex.Unlock()
+	}
+
+	// trip is cancelled while it's written
+	cancelled := *trip
+	cancelled.Status = tripStatusCancelled
+	updated := make(chan struct{})
+	go func() {
+		app.updateTripStatusInGSheet(&cancelled)
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("Expected status update not to wait for write to google sheet")
+	}
+
+	close(mockSheets.SaveGate)
+	<-written
+	entries := app.Outbox.All()
+	if len(entries) != 1 || entries[0].Kind != outbox.KindStatus || entries[0].TripToShelter.SheetRange == "" {
+		t.Fatalf("Expected status of saved trip to be left in outbox, got %+v", entries)
+	}
+
+	app.processOutbox(dates.Now(), false)
+	if status := mockSheets.UpdatedStatuses[entries[0].TripToShelter.SheetRange]; status != tripStatusCancelled {
+		t.Errorf("Expected status %q to be written, got %q", tripStatusCancelled, status)
+	}
+	if app.Outbox.Len() != 0 {
+		t.Errorf("Expected outbox to be empty, got %d entries", app.Outbox.Len())
+	}
+}
+
+// TestWorkerTaskPanic tests that panic in one tick of background worker doesn't stop the worker
+func TestWorkerTaskPanic(t *testing.T) {
+	runs := 0
+	for i := 0; i < 2; i++ {
+		runWorkerTask("test", func() {
+			runs++
+			var trip *models.TripToShelter
+			_ = trip.Status
+		})
+	}
+	if runs != 2 {
+		t.Errorf("Expected worker to run task after panic, got %d runs", runs)
+	}
+}
+
+// TestGracefulShutdown tests that shutdown waits for write to google sheet in progress and saves chat states
+func TestGracefulShutdown(t *testing.T) {
+	app := setupTestApp(t)
+	app.Cache = nil
+	sessionsPath := t.TempDir() + "/sessions.json"
+	app.Sessions = session.NewStore(sessionsPath)
+
+	statePoolMutex.Lock()
+	statePool[12345] = &models.State{ChatId: 12345, LastMessage: commandTripBy}
+	statePoolMutex.Unlock()
+
+	// write to google sheet is in progress
+	outboxMutex.Lock()
+	done := make(chan struct{})
+	go func() {
+		app.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected shutdown to wait for write to google sheet")
+	case <-time.After(50 * time.Millisecond):
+	}
+	outboxMutex.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected shutdown to finish")
+	}
+
+	snapshot, err := session.NewStore(sessionsPath).Load()
+	if err != nil {
+		t.Fatalf("Failed to load sessions: %v", err)
+	}
+	if state, ok := snapshot.States[12345]; !ok || state.LastMessage != commandTripBy {
+		t.Errorf("Expected chat state to be saved on shutdown, got %+v", snapshot.States)
+	}
+
+	// updates channel is closed when bot stops receiving updates
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	updates := mockBot.GetUpdatesChan(tgbotapi.NewUpdate(0))
+	app.Bot.StopReceivingUpdates()
+	if _, ok := <-updates; ok {
+		t.Error("Expected updates channel to be closed")
+	}
+}
+
+// TestNextUpdateAfterStop tests that updates loop finishes after stop signal without waiting for long poll
+func TestNextUpdateAfterStop(t *testing.T) {
+	updates := make(chan tgbotapi.Update, 1)
+	stopped := make(chan struct{})
+
+	updates <- createTestUpdate(t, 12345, commandStart)
+	if update, ok := nextUpdate(updates, stopped); !ok || update.Message.Text != commandStart {
+		t.Errorf("Expected update to be received, got %+v, %v", update, ok)
+	}
+
+	// long poll is in progress, so nothing comes from updates channel
+	close(stopped)
+	done := make(chan bool)
+	go func() {
+		_, ok := nextUpdate(updates, stopped)
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Expected no update after stop signal")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected updates loop to finish after stop signal")
+	}
+
+	close(updates)
+	if _, ok := nextUpdate(updates, make(chan struct{})); ok {
+		t.Error("Expected no update from closed channel")
+	}
+}
+
+// TestSessionExpiry tests that idle conversations expire with message to user and only stale polls are removed
+func TestSessionExpiry(t *testing.T) {
+	app := setupTestApp(t)
+	now := time.Now()
+	idle := now.Add(-sessionTimeout - time.Minute)
+
+	statePoolMutex.Lock()
+	statePool[1] = &models.State{ChatId: 1, LastMessage: commandTripBy, CreatedAt: now, LastActivityAt: now}
+	statePool[2] = &models.State{ChatId: 2, LastMessage: commandTripPurpose, CreatedAt: idle, LastActivityAt: idle}
+	statePool[3] = &models.State{ChatId: 3, LastMessage: commandDonation, CreatedAt: idle, LastActivityAt: idle}
+	statePoolMutex.Unlock()
+	pollsMutex.Lock()
+	polls["active"] = &models.Poll{ChatId: 1, CreatedAt: now}
+	polls["old"] = &models.Poll{ChatId: 1, CreatedAt: idle}
+	polls["expired-chat"] = &models.Poll{ChatId: 2, CreatedAt: idle.Add(time.Minute)}
+	pollsMutex.Unlock()
+
+	app.cleanupOldStates(now)
+	cleanupOldPolls(now)
+
+	statePoolMutex.RLock()
+	_, hasActive := statePool[1]
+	stateCount := len(statePool)
+	statePoolMutex.RUnlock()
+	if !hasActive || stateCount != 1 {
+		t.Errorf("Expected only active state to be kept, got %d states", stateCount)
+	}
+	if _, ok := getPollChatId("active"); !ok {
+		t.Error("Expected poll of active conversation to be kept")
+	}
+	if _, ok := getPollChatId("old"); ok {
+		t.Error("Expected poll older than session timeout to be removed")
+	}
+	if _, ok := getPollChatId("expired-chat"); ok {
+		t.Error("Expected poll of expired conversation to be removed")
+	}
+
+	// only user in the middle of registration is notified
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	if len(mockBot.SentMessages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(mockBot.SentMessages))
+	}
+	msg := mockBot.SentMessages[0].(tgbotapi.MessageConfig)
+	if msg.ChatID != 2 || msg.Text != messageSessionExpired {
+		t.Errorf("Expected session expired message to chat 2, got %d: %q", msg.ChatID, msg.Text)
+	}
+	if !strings.Contains(messageSessionExpired, commandStart) {
+		t.Error("Expected session expired message to contain restart hint")
+	}
+}
+
+// TestDuplicateRegistration tests that registrations get unique IDs and second registration to the same trip keeps or replaces earlier answers
+func TestDuplicateRegistration(t *testing.T) {
+	app := setupTestApp(t)
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test", PeopleLimit: 3}
+	date := "Сб " + time.Now().AddDate(0, 0, 3).Format("02.01.2006") + " 11:00"
+
+	app.registrationFinished(111, &models.TripToShelter{Username: "first", Shelter: shelter, Date: date, TripBy: "Пешком"})
+	app.registrationFinished(222, &models.TripToShelter{Username: "second", Shelter: shelter, Date: date})
+	first := findRegistration(111, shelter, date)
+	second := findRegistration(222, shelter, date)
+	if first == nil || second == nil {
+		t.Fatal("Expected both chats to be registered")
+	}
+	if first.ID == second.ID {
+		t.Errorf("Expected unique IDs of registrations, got %q", first.ID)
+	}
+	if first.TripKey != second.TripKey || first.TripKey != getTripKey(shelter, date) {
+		t.Errorf("Expected same trip key, got %q and %q", first.TripKey, second.TripKey)
+	}
+	firstID := first.ID
+	firstRange := first.SheetRange
+	savedCount := mockSheets.GetSavedTripsCount()
+
+	// same user registers again
+	newTrip := &models.TripToShelter{Username: "first", Shelter: shelter, Date: date, TripBy: "На машине"}
+	if lastMessage := app.registrationFinished(111, newTrip); lastMessage != commandDuplicateRegistration {
+		t.Fatalf("Expected duplicate registration question, got %s", lastMessage)
+	}
+	if mockSheets.GetSavedTripsCount() != savedCount || getFreeSeats(shelter, date) != 1 {
+		t.Error("Expected duplicate registration not to be saved and not to take seat")
+	}
+
+	// keep earlier answers
+	update := createTestUpdate(t, 111, keepEarlierAnswers)
+	app.duplicateRegistrationCommand(&update, newTrip)
+	if registered := findRegistration(111, shelter, date); registered.TripBy != "Пешком" || registered.ID != firstID {
+		t.Errorf("Expected earlier answers to be kept, got %+v", registered)
+	}
+
+	// replace earlier answers
+	update = createTestUpdate(t, 111, replaceEarlierAnswers)
+	if lastMessage := app.duplicateRegistrationCommand(&update, newTrip); lastMessage != commandSummaryShelterTrip {
+		t.Errorf("Expected summary after replacing answers, got %s", lastMessage)
+	}
+	registered := findRegistration(111, shelter, date)
+	if registered.TripBy != "На машине" || registered.ID == firstID {
+		t.Errorf("Expected answers to be replaced with new ID, got %+v", registered)
+	}
+	if registered.SheetRange == "" || registered.SheetRange == firstRange {
+		t.Errorf("Expected new row of replaced answers, got %q", registered.SheetRange)
+	}
+	if !strings.HasPrefix(mockSheets.UpdatedStatuses[firstRange], tripStatusReplaced) {
+		t.Errorf("Expected earlier row to be marked as replaced, got %q", mockSheets.UpdatedStatuses[firstRange])
+	}
+	if getFreeSeats(shelter, date) != 1 || len(getUpcomingRegistrations(111, time.Now())) != 1 {
+		t.Error("Expected replaced registration to keep its seat")
+	}
+}
+
+// TestUpdatesDispatcher tests that jobs of different chats run in parallel by bounded pool and jobs of one chat run in order
+func TestUpdatesDispatcher(t *testing.T) {
+	updatesDispatcher := dispatcher.New(2)
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	handled := make(map[int64][]int)
+	for i := 0; i < 5; i++ {
+		for chatId := int64(1); chatId <= 4; chatId++ {
+			chatId, i := chatId, i
+			updatesDispatcher.Dispatch(chatId, func() {
+				mutex.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mutex.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mutex.Lock()
+				running--
+				handled[chatId] = append(handled[chatId], i)
+				mutex.Unlock()
+			})
+		}
+	}
+	// broken handler doesn't stop next updates of the chat
+	updatesDispatcher.Dispatch(1, func() { panic("broken handler") })
+	updatesDispatcher.Dispatch(1, func() {
+		mutex.Lock()
+		handled[1] = append(handled[1], 5)
+		mutex.Unlock()
+	})
+	updatesDispatcher.Wait()
+
+	if maxRunning != 2 {
+		t.Errorf("Expected 2 jobs running at the same time, got %d", maxRunning)
+	}
+	for chatId := int64(1); chatId <= 4; chatId++ {
+		expected := []int{0, 1, 2, 3, 4}
+		if chatId == 1 {
+			expected = append(expected, 5)
+		}
+		if fmt.Sprint(handled[chatId]) != fmt.Sprint(expected) {
+			t.Errorf("Expected jobs of chat %d to run in order %v, got %v", chatId, expected, handled[chatId])
+		}
+	}
+}
+
+// TestHandleUpdatesInParallel tests that updates of different chats handled at the same time keep their own states
+func TestHandleUpdatesInParallel(t *testing.T) {
+	app := setupTestApp(t)
+	config := &models.ConfigFile{Administration: &models.Administration{Admin: "99999"}}
+	shelters := getSheltersListForTest()
+	// handlers only mark sessions as changed, they are saved by sessions worker
+	app.Sessions = session.NewStore(t.TempDir() + "/sessions.json")
+
+	updatesDispatcher := dispatcher.New(4)
+	for chatId := int64(1); chatId <= 10; chatId++ {
+		chatId := chatId
+		for _, text := range []string{commandStart, commandGoShelter} {
+			update := createTestUpdate(t, chatId, text)
+			updatesDispatcher.Dispatch(chatId, func() {
+				app.handleUpdate(update, chatId, config, &shelters)
+			})
+		}
+	}
+	updatesDispatcher.Wait()
+
+	statePoolMutex.RLock()
+	defer statePoolMutex.RUnlock()
+	for chatId := int64(1); chatId <= 10; chatId++ {
+		state, ok := statePool[chatId]
+		if !ok || state.LastMessage != commandGoShelter {
+			t.Errorf("Expected last message %s of chat %d, got %+v", commandGoShelter, chatId, state)
+		}
+	}
+	snapshot, err := app.Sessions.Load()
+	if err != nil || len(snapshot.States) != 0 {
+		t.Errorf("Expected states not to be saved on every update, got %v, %v", snapshot, err)
+	}
+
+	app.saveChangedSessions()
+	snapshot, err = app.Sessions.Load()
+	if err != nil || len(snapshot.States) != 10 {
+		t.Errorf("Expected states of all chats to be saved, got %v, %v", snapshot, err)
+	}
+}
+
+// TestRegistrationFlow tests registration to shelter step by step without running bot
+func TestRegistrationFlow(t *testing.T) {
+	app := setupTestApp(t)
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	shelters := getSheltersListForTest()
+	shelters[1].Schedule.TimeStart = "11:00"
+	var chatId int64 = 12345
+	addPoll("poll-1", chatId)
+
+	conversation := &registration{app: app, chatId: chatId, shelters: &shelters}
+	sendText := func(current string, text string) string {
+		update := createTestUpdate(t, chatId, text)
+		conversation.update = &update
+		next, ok := registrationFlow.Handle(conversation, current, flow.Input{Text: text})
+		if !ok {
+			t.Fatalf("Expected step %s to handle %q", current, text)
+		}
+		return next
+	}
+	sendPollAnswer := func(current string, options []int) string {
+		update := createTestPollUpdate(t, chatId, "poll-1", options)
+		conversation.update = &update
+		next, ok := registrationFlow.Handle(conversation, current, flow.Input{PollOptions: options, IsPollAnswer: true})
+		if !ok {
+			t.Fatalf("Expected step %s to handle poll answer %v", current, options)
+		}
+		return next
+	}
+	steps := []struct {
+		name     string
+		current  string
+		text     string
+		options  []int
+		expected string
+		// errorText is error shown to user, no error is expected if it's empty.
+		errorText string
+	}{
+		{"wrong month", commandGoShelter, "Брумбрь", nil, commandGoShelter, "Кажется вы ошиблись с месяцем 🤔 Давайте попробуем заново"},
+		{"choose by shelter", commandGoShelter, chooseByShelter, nil, commandChooseShelter, ""},
+		{"unknown shelter", commandChooseShelter, "999. Non-existent Shelter", nil, commandChooseShelter, errorWrongShelterName},
+		{"shelter", commandChooseShelter, "1. Test Shelter", nil, commandChooseDateAfterShelter, ""},
+		{"wrong date", commandChooseDateAfterShelter, "32.13.2000", nil, commandChooseDateAfterShelter, "Кажется вы ошиблись с датой 🤔"},
+		{"date", commandChooseDateAfterShelter, "", nil, commandIsFirstTrip, ""},
+		{"poll answer instead of text", commandIsFirstTrip, "", []int{0}, commandIsFirstTrip, ""},
+		{"wrong answer", commandIsFirstTrip, "Может быть", nil, commandIsFirstTrip, "доступные ответы \"Да\" и \"Нет\""},
+		{"first trip", commandIsFirstTrip, "Да", nil, commandTripPurpose, ""},
+		{"text instead of poll answer", commandTripPurpose, "Погулять", nil, commandTripPurpose, "Выберите цели поездки и нажмите кнопку голосовать"},
+		{"purpose", commandTripPurpose, "", []int{0}, commandTripBy, ""},
+		{"trip by", commandTripBy, "", []int{0}, commandHowYouKnowAboutUs, ""},
+	}
+	for _, step := range steps {
+		if step.name == "date" {
+			// the first date can be closed for registration already
+			shelterDates := getDatesByShelter(conversation.trip.Shelter)
+			step.text = shelterDates[len(shelterDates)-1]
+		}
+		sentCount := mockBot.GetSentMessageCount()
+		var next string
+		if step.options != nil {
+			next = sendPollAnswer(step.current, step.options)
+		} else {
+			next = sendText(step.current, step.text)
+		}
+		if next != step.expected {
+			t.Errorf("%s: expected step %s, got %s", step.name, step.expected, next)
+		}
+		sent := mockBot.SentMessages[sentCount:]
+		if step.options != nil && step.current == step.expected && len(sent) != 0 {
+			t.Errorf("%s: expected input to be ignored, got %d messages", step.name, len(sent))
+		}
+		errorShown := false
+		for _, message := range sent {
+			if msgObj, ok := message.(tgbotapi.MessageConfig); ok && msgObj.Text == step.errorText {
+				errorShown = true
+			}
+		}
+		if step.errorText != "" && !errorShown {
+			t.Errorf("%s: expected error %q to be shown", step.name, step.errorText)
+		}
+	}
+	if conversation.trip == nil || conversation.trip.Shelter.ID != "1" || !conversation.trip.IsFirstTrip || len(conversation.trip.Purpose) != 1 || conversation.trip.TripBy == "" {
+		t.Fatalf("Expected answers to be saved to trip, got %+v", conversation.trip)
+	}
+
+	// registration is finished after the last poll
+	next := sendPollAnswer(commandHowYouKnowAboutUs, []int{0})
+	if next != commandDonation && next != commandSummaryShelterTrip {
+		t.Errorf("Expected registration to be finished, got %s", next)
+	}
+	if findRegistration(chatId, conversation.trip.Shelter, conversation.trip.Date) == nil {
+		t.Error("Expected trip to be registered")
+	}
+	if _, ok := registrationFlow.Handle(conversation, next, flow.Input{Text: "Привет"}); ok {
+		t.Errorf("Expected final step %s not to handle input", next)
+	}
+	if _, ok := registrationFlow.Handle(conversation, commandMyTrips, flow.Input{Text: "Привет"}); ok {
+		t.Error("Expected step which is not part of registration not to handle input")
+	}
+
+	// flow can't lead to undeclared step
+	_, err := flow.New(func(*registration, string) {},
+		&flow.Step[*registration]{Name: "first", Next: []string{"second"}},
+	)
+	if err == nil {
+		t.Error("Expected error for transition to unknown step")
+	}
+	_, err = flow.New(func(*registration, string) {},
+		&flow.Step[*registration]{Name: "first"},
+		&flow.Step[*registration]{Name: "first"},
+	)
+	if err == nil {
+		t.Error("Expected error for step declared twice")
+	}
+}
+
+// TestSyncTripStatuses tests that statuses and dates changed by coordinators are read from google sheet served by local fake server
+func TestSyncTripStatuses(t *testing.T) {
+	app := setupTestApp(t)
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	var err error
+	app.Trips, err = repository.NewFileTripRepository(t.TempDir() + "/trips.jsonl")
+	if err != nil {
+		t.Fatalf("Failed to create trip repository: %v", err)
+	}
+	app.Outbox, err = outbox.NewStore(t.TempDir() + "/outbox.json")
+	if err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+
+	shelter := &models.Shelter{
+		ID:          "1",
+		Title:       "Test Shelter",
+		PeopleLimit: 4,
+		Schedule: models.ShelterSchedule{
+			Type:      "everyday",
+			TimeStart: "11:00",
+		},
+	}
+	shelterDates := getDatesByShelter(shelter)
+	date, newDate := shelterDates[1], shelterDates[2]
+
+	// rows of google sheet by ranges of trips, the last column is status
+	var mutex sync.Mutex
+	rows := make(map[string][]interface{})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/spreadsheets/test-id/values:batchGet" {
+			t.Errorf("Unexpected request %s", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+
+		var valueRanges []map[string]interface{}
+		for _, tripRange := range r.URL.Query()["ranges"] {
+			// google returns ranges with quoted sheet names
+			valueRange := map[string]interface{}{"range": "'" + strings.Replace(tripRange, "!", "'!", 1)}
+			if row, ok := rows[tripRange]; ok {
+				valueRange["values"] = [][]interface{}{row}
+			}
+			valueRanges = append(valueRanges, valueRange)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"spreadsheetId": "test-id", "valueRanges": valueRanges})
+	}))
+	defer server.Close()
+
+	srv, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatalf("Failed to create sheets service: %v", err)
+	}
+	app.SheetsService = sheet.NewGoogleSpreadsheetWithService(models.Google{SpreadsheetID: "test-id"}, srv)
+
+	// chat 1 is confirmed, chat 2 is confirmed from the waitlist, chat 3 is moved to the new date,
+	// chat 4 is cancelled but status isn't written to google sheet yet, chat 5 is rejected, chat 6 has no changes
+	statuses := map[int64]string{1: "Подтвержден", 2: "Подтверждено", 3: "", 4: "", 5: "отклонена", 6: ""}
+	for chatId := int64(1); chatId <= 6; chatId++ {
+		tripToShelter := &models.TripToShelter{ChatId: chatId, Username: fmt.Sprintf("user%d", chatId), Shelter: shelter, Date: date}
+		tripToShelter.TripKey = getTripKey(shelter, date)
+		tripToShelter.ID = newTripID(tripToShelter)
+		tripToShelter.SheetRange = fmt.Sprintf("Test Shelter!A%d:I%d", chatId+1, chatId+1)
+		switch chatId {
+		case 2:
+			tripToShelter.Status = tripStatusWaitlist
+			tripToShelter.Waitlisted = true
+			addToWaitlist(tripToShelter)
+		case 4:
+			tripToShelter.Status = tripStatusCancelled
+			app.Outbox.Add(&models.OutboxEntry{Kind: outbox.KindStatus, TripToShelter: *tripToShelter})
+		default:
+			reserveSeat(shelter, date)
+		}
+		addRegistration(tripToShelter)
+		app.saveTrip(tripToShelter)
+
+		rowDate := date
+		if chatId == 3 {
+			rowDate = extractDate(newDate)
+		}
+		rows[tripToShelter.SheetRange] = []interface{}{tripToShelter.Username, shelter.Title, rowDate, "true", "", "", "", "", statuses[chatId]}
+	}
+
+	if err := app.syncTripStatuses(time.Now()); err != nil {
+		t.Fatalf("Failed to sync trip statuses: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected statuses to be read by one request, got %d", requests)
+	}
+
+	expectedMessages := map[int64]string{
+		1: fmt.Sprintf(messageTripConfirmed, shelter.Title, date),
+		2: fmt.Sprintf(messageTripConfirmed, shelter.Title, date),
+		3: fmt.Sprintf(messageTripMoved, shelter.Title, date, newDate),
+		5: fmt.Sprintf(messageTripRejected, shelter.Title, date),
+	}
+	messages := make(map[int64][]string)
+	for _, message := range mockBot.SentMessages {
+		if msgObj, ok := message.(tgbotapi.MessageConfig); ok {
+			messages[msgObj.ChatID] = append(messages[msgObj.ChatID], msgObj.Text)
+		}
+	}
+	for chatId := int64(1); chatId <= 6; chatId++ {
+		expected, ok := expectedMessages[chatId]
+		if ok && (len(messages[chatId]) != 1 || messages[chatId][0] != expected) {
+			t.Errorf("Expected chat %d to be notified %q, got %v", chatId, expected, messages[chatId])
+		}
+		if !ok && len(messages[chatId]) != 0 {
+			t.Errorf("Expected chat %d not to be notified, got %v", chatId, messages[chatId])
+		}
+	}
+
+	if confirmed := findRegistration(2, shelter, date); confirmed == nil || confirmed.Status != "Подтверждено" {
+		t.Errorf("Expected trip from the waitlist to be confirmed, got %+v", confirmed)
+	}
+	if moved := findRegistration(3, shelter, newDate); moved == nil || moved.Date != newDate {
+		t.Errorf("Expected trip to be moved to %s, got %+v", newDate, moved)
+	}
+	if findRegistration(5, shelter, date) != nil {
+		t.Error("Expected rejected registration to be removed")
+	}
+	// chats 1, 2 and 6 are left on the date, chat 3 is moved to the new date
+	if getFreeSeats(shelter, date) != 1 || getFreeSeats(shelter, newDate) != 3 {
+		t.Errorf("Expected seats to be moved, got %d and %d free seats", getFreeSeats(shelter, date), getFreeSeats(shelter, newDate))
+	}
+
+	// nothing is changed since the last sync
+	sentCount := mockBot.GetSentMessageCount()
+	if err := app.syncTripStatuses(time.Now()); err != nil {
+		t.Fatalf("Failed to sync trip statuses: %v", err)
+	}
+	if mockBot.GetSentMessageCount() != sentCount {
+		t.Error("Expected volunteers to be notified only once")
+	}
+
+	// rejected and moved registrations don't take seats after restart
+	cleanupTestState()
+	if err := app.restoreTrips(SheltersList{1: shelter}); err != nil {
+		t.Fatalf("Failed to restore trips: %v", err)
+	}
+	if findRegistration(3, shelter, date) != nil || findRegistration(5, shelter, date) != nil {
+		t.Error("Expected moved and rejected registrations not to be restored")
+	}
+	if findRegistration(3, shelter, newDate) == nil || getFreeSeats(shelter, date) != 1 {
+		t.Error("Expected moved and confirmed registrations to be restored")
+	}
+}
+
+// TestWaitlistedTripStatusNote tests that waitlisted trip stays in the waitlist when coordinator writes note to its status
+func TestWaitlistedTripStatusNote(t *testing.T) {
+	app := setupTestApp(t)
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	trips, err := repository.NewFileTripRepository(t.TempDir() + "/trips.jsonl")
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	app.Trips = trips
+
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test", PeopleLimit: 1}
+	shelters := SheltersList{1: shelter}
+	date := "Сб " + time.Now().AddDate(0, 0, 3).Format("02.01.2006") + " 11:00"
+	app.registrationFinished(111, &models.TripToShelter{Username: "first", Shelter: shelter, Date: date})
+	app.registrationFinished(222, &models.TripToShelter{Username: "second", Shelter: shelter, Date: date})
+
+	note := "Позвоним накануне"
+	registrationsMutex.RLock()
+	waitlistedTrip := lookupRegistration(222, shelter, date)
+	registrationsMutex.RUnlock()
+	app.applySheetStatus(waitlistedTrip, &models.TripSheetStatus{Status: note})
+
+	lastMessage := mockBot.SentMessages[len(mockBot.SentMessages)-1].(tgbotapi.MessageConfig)
+	if lastMessage.ChatID != 222 || lastMessage.Text != fmt.Sprintf(messageTripStatusChanged, shelter.Title, date, note) {
+		t.Errorf("Expected volunteer to be notified about note, got %+v", lastMessage)
+	}
+	if trip := findRegistration(222, shelter, date); trip == nil || trip.Status != note || !trip.Waitlisted {
+		t.Errorf("Expected trip with note to stay in the waitlist, got %+v", trip)
+	}
+
+	// restart
+	cleanupTestState()
+	if err := app.restoreTrips(shelters); err != nil {
+		t.Fatalf("Failed to restore trips: %v", err)
+	}
+	if seats := getFreeSeats(shelter, date); seats != 0 {
+		t.Errorf("Expected only seat of the first user to be taken, got %d free seats", seats)
+	}
+
+	// cancellation of the first user promotes waitlisted one
+	update := createTestUpdate(t, 111, cancelTripPrefix+date+", Test Shelter")
+	app.cancelTripCommand(&update, &shelters)
+	if trip := findRegistration(222, shelter, date); trip == nil || !strings.HasPrefix(trip.Status, tripStatusPromoted) || trip.Waitlisted {
+		t.Errorf("Expected trip with note to be promoted, got %+v", trip)
+	}
+	if seats := getFreeSeats(shelter, date); seats != 0 {
+		t.Errorf("Expected seat to be taken by promoted user, got %d free seats", seats)
+	}
+}
+
+// TestBatchedOutbox tests that queued trips are saved by one request per tab and only trips of failed tab are left in the outbox
+func TestBatchedOutbox(t *testing.T) {
+	app := setupTestApp(t)
+	var err error
+	app.Outbox, err = outbox.NewStore(t.TempDir() + "/outbox.json")
+	if err != nil {
+		t.Fatalf("Failed to create outbox: %v", err)
+	}
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+
+	shelters := []*models.Shelter{
+		{ID: "1", Title: "Test Shelter", ShortTitle: "Test"},
+		{ID: "2", Title: "Another Shelter", ShortTitle: "Another"},
+	}
+	date := "Сб 05.11.2022 11:00"
+
+	// google sheet is unavailable, so all trips are queued
+	mockSheets.SetSaveError(errors.New("quota exceeded"))
+	for chatId := int64(1); chatId <= 5; chatId++ {
+		trip := &models.TripToShelter{ChatId: chatId, Username: fmt.Sprintf("user%d", chatId), Shelter: shelters[chatId%2], Date: date}
+		trip.ID = newTripID(trip)
+		addRegistration(trip)
+		app.exportTrip(trip)
+	}
+	if app.Outbox.Len() != 5 {
+		t.Fatalf("Expected 5 entries in outbox, got %d", app.Outbox.Len())
+	}
+
+	// tab of the second shelter still fails
+	mockSheets.SetSaveError(nil)
+	mockSheets.SheetSaveErrors["Another"] = errors.New("sheet is protected")
+	mockSheets.AppendRequests = 0
+	app.processOutbox(dates.Now(), true)
+	// one request to tab of the first shelter and one to system tab, tab of the second shelter fails
+	if mockSheets.AppendRequests != 3 {
+		t.Errorf("Expected 3 append requests, got %d", mockSheets.AppendRequests)
+	}
+	if app.Outbox.Len() != 3 {
+		t.Fatalf("Expected trips of failed tab to be left in outbox, got %d entries", app.Outbox.Len())
+	}
+	for _, entry := range app.Outbox.All() {
+		if entry.TripToShelter.Shelter.ID != "2" || entry.Attempts != 2 || entry.LastError != "sheet is protected" {
+			t.Errorf("Unexpected entry left in outbox: %+v", entry)
+		}
+	}
+	rows := make(map[string]bool)
+	for _, chatId := range []int64{2, 4} {
+		registered := findRegistration(chatId, shelters[0], date)
+		if registered.SheetRange == "" || rows[registered.SheetRange] {
+			t.Errorf("Expected trip of chat %d to get its own row, got %q", chatId, registered.SheetRange)
+		}
+		rows[registered.SheetRange] = true
+	}
+
+	delete(mockSheets.SheetSaveErrors, "Another")
+	mockSheets.AppendRequests = 0
+	app.processOutbox(dates.Now(), true)
+	if mockSheets.AppendRequests != 2 || app.Outbox.Len() != 0 {
+		t.Errorf("Expected trips of the second shelter to be saved by 2 requests, got %d requests and %d entries left", mockSheets.AppendRequests, app.Outbox.Len())
+	}
+
+	ranges, err := sheet.SplitRowRanges("'Хаски'!A5:I7")
+	if err != nil || fmt.Sprint(ranges) != "['Хаски'!A5:I5 'Хаски'!A6:I6 'Хаски'!A7:I7]" {
+		t.Errorf("Unexpected rows of range: %v, %v", ranges, err)
+	}
+	if _, err := sheet.SplitRowRanges("A5:I7"); err == nil {
+		t.Error("Expected error for range without sheet name")
+	}
+}
+
+// TestGoogleSheetsAuth tests that google sheets are accessed by token of user or by service account chosen in app config
+func TestGoogleSheetsAuth(t *testing.T) {
+	dir := t.TempDir()
+	var mutex sync.Mutex
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/token" {
+			// service account exchanges signed JWT to access token
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || r.Form.Get("assertion") == "" {
+				t.Errorf("Unexpected token request: %v", r.Form)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "service-account-token", "token_type": "Bearer", "expires_in": 3600})
+			return
+		}
+		mutex.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		mutex.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"range": "Test!A1:B1"})
+	}))
+	defer server.Close()
+
+	writeFile := func(name string, content interface{}) string {
+		data, err := json.Marshal(content)
+		if err != nil {
+			t.Fatalf("Failed to marshal %s: %v", name, err)
+		}
+		path := dir + "/" + name
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return path
+	}
+
+	// OAuth uses token of user saved by /update_google_auth
+	oauth := models.Google{
+		Auth: sheet.AuthOAuth,
+		CredentialsFile: writeFile("credentials.json", map[string]interface{}{"installed": map[string]interface{}{
+			"client_id":     "client-id",
+			"client_secret": "client-secret",
+			"redirect_uris": []string{"http://localhost"},
+			"auth_uri":      server.URL + "/auth",
+			"token_uri":     server.URL + "/token",
+		}}),
+		TokenFile: writeFile("token.json", map[string]interface{}{"access_token": "user-token", "token_type": "Bearer", "expiry": time.Now().Add(time.Hour)}),
+	}
+	// service account signs requests for token by its private key
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	serviceAccount := models.Google{
+		Auth: sheet.AuthServiceAccount,
+		ServiceAccountKeyFile: writeFile("service_account.json", map[string]interface{}{
+			"type":           "service_account",
+			"client_email":   "walkthedog@test.iam.gserviceaccount.com",
+			"private_key_id": "key-id",
+			"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyDER})),
+			"token_uri":      server.URL + "/token",
+		}),
+	}
+
+	for expected, google := range map[string]models.Google{"Bearer user-token": oauth, "Bearer service-account-token": serviceAccount} {
+		srv, err := sheet.NewService(google, option.WithEndpoint(server.URL))
+		if err != nil {
+			t.Fatalf("Failed to create service with %s auth: %v", google.Auth, err)
+		}
+		if !sheet.NewGoogleSpreadsheetWithService(models.Google{SpreadsheetID: "test-id"}, srv).HasSheet("Test") {
+			t.Errorf("Expected sheet to be found with %s auth", google.Auth)
+		}
+		mutex.Lock()
+		if len(authorizations) == 0 || authorizations[len(authorizations)-1] != expected {
+			t.Errorf("Expected request with %q, got %v", expected, authorizations)
+		}
+		mutex.Unlock()
+	}
+
+	// authorization of user is requested only for OAuth
+	if authURL, err := sheet.RequestAuthCodeURL(oauth); err != nil || !strings.Contains(authURL, "client-id") {
+		t.Errorf("Expected url to authorize OAuth client, got %q, %v", authURL, err)
+	}
+	if _, err := sheet.RequestAuthCodeURL(serviceAccount); err == nil {
+		t.Error("Expected error of authorization of user with service account")
+	}
+
+	if _, err := sheet.NewService(models.Google{Auth: sheet.AuthServiceAccount}); err == nil {
+		t.Error("Expected error for service account without key file")
+	}
+	if _, err := sheet.NewService(models.Google{Auth: "password"}); err == nil {
+		t.Error("Expected error for unknown auth")
+	}
+}
+
+// TestGoogleAuthTokens tests that refreshed token of user is saved to file and admin is warned once when refresh token is revoked
+func TestGoogleAuthTokens(t *testing.T) {
+	dir := t.TempDir()
+	var mutex sync.Mutex
+	revoked := false
+	unavailable := false
+	refreshes := 0
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/token" {
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh-token" {
+				t.Errorf("Unexpected token request: %v", r.Form)
+			}
+			if unavailable {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error": "internal_failure"}`))
+				return
+			}
+			if revoked {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`))
+				return
+			}
+			refreshes++
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": fmt.Sprintf("refreshed-%d", refreshes), "token_type": "Bearer", "expires_in": 3600})
+			return
+		}
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(map[string]interface{}{"range": "Test!A1:B1"})
+	}))
+	defer server.Close()
+
+	credentials := `{"installed": {"client_id": "client-id", "client_secret": "client-secret", "redirect_uris": ["http://localhost"], "token_uri": "` + server.URL + `/token"}}`
+	google := models.Google{CredentialsFile: dir + "/credentials.json", TokenFile: dir + "/token.json"}
+	if err := os.WriteFile(google.CredentialsFile, []byte(credentials), 0600); err != nil {
+		t.Fatalf("Failed to write credentials: %v", err)
+	}
+	writeToken := func(token map[string]interface{}) {
+		data, _ := json.Marshal(token)
+		if err := os.WriteFile(google.TokenFile, data, 0600); err != nil {
+			t.Fatalf("Failed to write token: %v", err)
+		}
+	}
+	readToken := func() map[string]interface{} {
+		var token map[string]interface{}
+		data, err := os.ReadFile(google.TokenFile)
+		if err != nil || json.Unmarshal(data, &token) != nil {
+			t.Fatalf("Failed to read token: %v", err)
+		}
+		return token
+	}
+	writeToken(map[string]interface{}{"access_token": "expired-token", "refresh_token": "refresh-token", "expiry": time.Now().Add(-time.Hour)})
+
+	// expired token is refreshed before request and saved to file
+	sheetsService, err := sheet.NewGoogleSpreadsheet(google, option.WithEndpoint(server.URL))
+	if err != nil {
+		t.Fatalf("Failed to create sheets service: %v", err)
+	}
+	if !sheetsService.HasSheet("Test") || authorizations[len(authorizations)-1] != "Bearer refreshed-1" {
+		t.Errorf("Expected request with refreshed token, got %v", authorizations)
+	}
+	if token := readToken(); token["access_token"] != "refreshed-1" || token["refresh_token"] != "refresh-token" {
+		t.Errorf("Expected refreshed token to be saved with refresh token, got %v", token)
+	}
+	if _, err := os.Stat(google.TokenFile + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Expected temporary token file to be removed")
+	}
+
+	// check refreshes token even if it's not expired yet
+	if err := sheetsService.CheckAuth(); err != nil || readToken()["access_token"] != "refreshed-2" {
+		t.Errorf("Expected token to be refreshed by check, got %v, %v", readToken(), err)
+	}
+
+	// failure of google isn't taken as expired auth
+	mutex.Lock()
+	unavailable = true
+	mutex.Unlock()
+	if err := sheetsService.CheckAuth(); err == nil || sheet.IsAuthError(err) {
+		t.Errorf("Expected error which is not auth error when token endpoint fails, got %v", err)
+	}
+	mutex.Lock()
+	unavailable = false
+	mutex.Unlock()
+
+	// revoked refresh token is found by check
+	mutex.Lock()
+	revoked = true
+	mutex.Unlock()
+	if err := sheetsService.CheckAuth(); !sheet.IsAuthError(err) {
+		t.Errorf("Expected auth error for revoked refresh token, got %v", err)
+	}
+	writeToken(map[string]interface{}{"access_token": "expired-token", "expiry": time.Now().Add(-time.Hour)})
+	if err := sheetsService.CheckAuth(); !errors.Is(err, sheet.ErrTokenExpired) {
+		t.Errorf("Expected error for expired token without refresh token, got %v", err)
+	}
+
+	// admin is warned once until auth is updated
+	app := setupTestApp(t)
+	mockBot := app.Bot.(*mocks.MockTelegramBot)
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	adminMessages := func() []string {
+		var messages []string
+		for _, message := range mockBot.SentMessages {
+			if msgObj, ok := message.(tgbotapi.MessageConfig); ok && msgObj.ChatID == app.AdminChatId {
+				messages = append(messages, msgObj.Text)
+			}
+		}
+		return messages
+	}
+	mockSheets.AuthError = fmt.Errorf("unable to refresh token: %w", &oauth2.RetrieveError{Response: &http.Response{Status: "400 Bad Request", StatusCode: http.StatusBadRequest}})
+	app.checkGoogleAuth()
+	app.checkGoogleAuth()
+	messages := adminMessages()
+	if len(messages) != 1 || !strings.Contains(messages[0], commandUpdateGoogleAuth) {
+		t.Fatalf("Expected one warning with %s, got %v", commandUpdateGoogleAuth, messages)
+	}
+
+	// registration which isn't saved doesn't repeat warning
+	mockSheets.SetSaveError(errors.New("unauthorized"))
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Test"}
+	app.registrationFinished(12345, &models.TripToShelter{Username: "testuser", Shelter: shelter, Date: "Сб " + time.Now().AddDate(0, 0, 3).Format("02.01.2006") + " 11:00"})
+	mockSheets.AuthError = errors.New("network is unreachable")
+	app.checkGoogleAuth()
+	if len(adminMessages()) != 1 {
+		t.Errorf("Expected warning not to be repeated, got %v", adminMessages())
+	}
+
+	// auth is updated and then expired again
+	mockSheets.AuthError = nil
+	app.checkGoogleAuth()
+	mockSheets.AuthError = &oauth2.RetrieveError{Response: &http.Response{Status: "400 Bad Request", StatusCode: http.StatusBadRequest}}
+	app.checkGoogleAuth()
+	if len(adminMessages()) != 2 {
+		t.Errorf("Expected new warning after auth expired again, got %v", adminMessages())
+	}
+}
+
+// TestSheetLayouts tests that trips are saved to tabs of layout set in app config and missing tabs are created once
+func TestSheetLayouts(t *testing.T) {
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Хаски"}
+	tripToShelter := &models.TripToShelter{Username: "testuser", Shelter: shelter, Date: "Сб 13.08.2022 11:00"}
+	tests := []struct {
+		google    models.Google
+		sheetName string
+	}{
+		{models.Google{}, "Хаски"},
+		{models.Google{Layout: sheet.LayoutShelter}, "Хаски"},
+		{models.Google{Layout: sheet.LayoutSingle}, "Выезды"},
+		{models.Google{Layout: sheet.LayoutSingle, Sheet: "Все выезды"}, "Все выезды"},
+		{models.Google{Layout: sheet.LayoutTrip}, "13.08.2022Хаски"},
+		{models.Google{Layout: sheet.LayoutMonth}, "08.2022"},
+	}
+	for _, test := range tests {
+		sheetName, err := sheet.SheetName(test.google, tripToShelter)
+		if err != nil || sheetName != test.sheetName {
+			t.Errorf("Expected tab %s for layout %q, got %s, %v", test.sheetName, test.google.Layout, sheetName, err)
+		}
+	}
+	if err := sheet.CheckLayout(models.Google{Layout: "weekly"}); err == nil {
+		t.Error("Expected error for unknown layout")
+	}
+	if _, err := sheet.SheetName(models.Google{Layout: sheet.LayoutTrip}, &models.TripToShelter{Shelter: shelter, Date: "завтра"}); err == nil {
+		t.Error("Expected error for date without day")
+	}
+
+	app := setupTestApp(t)
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	mockSheets.SetHasSheetResponse(false)
+	app.Google.Layout = sheet.LayoutTrip
+
+	// tab of the trip is created with headers before first trip is saved to it
+	for i := 0; i < 2; i++ {
+		trip := *tripToShelter
+		trip.ChatId = int64(12345 + i)
+		if !app.exportTrip(&trip) {
+			t.Fatal("Expected trip to be saved")
+		}
+		if !strings.HasPrefix(trip.SheetRange, "13.08.2022Хаски!") {
+			t.Errorf("Expected trip to be saved to tab of the trip, got %s", trip.SheetRange)
+		}
+	}
+	if len(mockSheets.CreatedSheets) != 1 || mockSheets.CreatedSheets[0] != "13.08.2022Хаски" || len(mockSheets.SheetsWithHeaders) != 1 {
+		t.Errorf("Expected tab of the trip to be created once, got %v, %v", mockSheets.CreatedSheets, mockSheets.SheetsWithHeaders)
+	}
+
+	// trip isn't saved if its tab can't be created and creation is retried next time
+	app.Google.Layout = sheet.LayoutMonth
+	mockSheets.SetCreateSheetError(errors.New("quota exceeded"))
+	trip := *tripToShelter
+	if app.exportTrip(&trip) {
+		t.Error("Expected trip not to be saved when tab can't be created")
+	}
+	mockSheets.SetCreateSheetError(nil)
+	if !app.exportTrip(&trip) || !strings.HasPrefix(trip.SheetRange, "08.2022!") {
+		t.Errorf("Expected trip to be saved to tab of the month, got %s", trip.SheetRange)
+	}
+}
+
+// TestSpreadsheetColumns tests that trips are written to columns set in app config and missing columns are added to tabs
+func TestSpreadsheetColumns(t *testing.T) {
+	google := models.Google{
+		SpreadsheetID: "test-id",
+		Columns: []models.Column{
+			{Header: "Пользователь", Field: sheet.FieldUsername},
+			{Header: "Приют", Field: sheet.FieldShelterShortTitle},
+			{Header: "Дата", Field: sheet.FieldDate, Format: sheet.FormatDate},
+			{Header: "Первый раз", Field: sheet.FieldIsFirstTrip, Format: sheet.FormatBool},
+			{Header: "Цели", Field: sheet.FieldPurpose, Format: sheet.FormatList},
+			{Header: "Статус", Field: sheet.FieldStatus},
+		},
+		SystemColumns: []models.Column{
+			{Field: sheet.FieldUsername},
+			{Field: sheet.FieldDate},
+		},
+	}
+	if err := sheet.CheckColumns(google); err != nil {
+		t.Fatalf("Expected columns to be valid, got %v", err)
+	}
+	invalidColumns := [][]models.Column{
+		{{Header: "Дата", Field: sheet.FieldDate}, {Header: "Статус", Field: "phone"}},
+		{{Header: "Дата", Field: sheet.FieldDate}, {Header: "Статус", Field: sheet.FieldStatus, Format: "upper"}},
+		{{Header: "Дата", Field: sheet.FieldDate}, {Header: "Дата", Field: sheet.FieldStatus}},
+		{{Header: "Дата", Field: sheet.FieldDate}, {Field: sheet.FieldStatus}},
+		{{Header: "Дата", Field: sheet.FieldDate}},
+	}
+	for _, columns := range invalidColumns {
+		if err := sheet.CheckColumns(models.Google{Columns: columns}); err == nil {
+			t.Errorf("Expected error for columns %v", columns)
+		}
+	}
+
+	// header rows of tabs, coordinators have added notes to tab of Хаски and don't have some columns
+	var mutex sync.Mutex
+	headers := map[string][]interface{}{
+		"Хаски":  {"Дата", "Пользователь", "Заметки", "Статус"},
+		"System": {},
+		// tab created before columns were set in app config
+		"Шарик": {"User", "Приют", "Дата", "Первый раз", "Цели", "Как добирается", "Откуда узнал", "Дата регистрации на выезд (UTC +8)", "Статус"},
+	}
+	var createdSheets []string
+	var updates, appends []string
+	var appendedRows [][]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		path := strings.TrimPrefix(r.URL.Path, "/v4/spreadsheets/test-id")
+		switch {
+		case path == ":batchUpdate":
+			var request sheets.BatchUpdateSpreadsheetRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			sheetName := request.Requests[0].AddSheet.Properties.Title
+			createdSheets = append(createdSheets, sheetName)
+			headers[sheetName] = []interface{}{}
+			json.NewEncoder(w).Encode(map[string]interface{}{"spreadsheetId": "test-id"})
+		case path == "/values:batchGet":
+			// coordinators have moved status before date
+			values := map[string][]interface{}{
+				"Хаски!1:1":   {"Статус", "Дата", "Пользователь"},
+				"Хаски!A5:G5": {"Подтвержден", "14.08.2022", "testuser"},
+			}
+			var valueRanges []map[string]interface{}
+			for _, valueRange := range r.URL.Query()["ranges"] {
+				valueRanges = append(valueRanges, map[string]interface{}{"range": valueRange, "values": [][]interface{}{values[valueRange]}})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"valueRanges": valueRanges})
+		case strings.HasSuffix(path, ":append"):
+			var valueRange sheets.ValueRange
+			json.NewDecoder(r.Body).Decode(&valueRange)
+			appends = append(appends, strings.TrimSuffix(strings.TrimPrefix(path, "/values/"), ":append"))
+			appendedRows = append(appendedRows, valueRange.Values...)
+			json.NewEncoder(w).Encode(map[string]interface{}{"updates": map[string]interface{}{"updatedRange": "Хаски!A5:G5"}})
+		case r.Method == http.MethodPut:
+			updates = append(updates, strings.TrimPrefix(path, "/values/"))
+			json.NewEncoder(w).Encode(map[string]interface{}{})
+		default:
+			sheetName := strings.Trim(strings.TrimSuffix(strings.TrimPrefix(path, "/values/"), "!1:1"), "'")
+			header, ok := headers[sheetName]
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": {"code": 400, "message": "Unable to parse range"}}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"values": [][]interface{}{header}})
+		}
+	}))
+	defer server.Close()
+
+	srv, err := sheets.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatalf("Failed to create sheets service: %v", err)
+	}
+	sheetsService := sheet.NewGoogleSpreadsheetWithService(google, srv)
+
+	// missing columns are added after existing ones and new tab gets all columns
+	if err := sheetsService.PrepareSheetForSavingData("Хаски"); err != nil {
+		t.Fatalf("Failed to prepare tab: %v", err)
+	}
+	if err := sheetsService.PrepareSheetForSavingData("Шанс"); err != nil {
+		t.Fatalf("Failed to prepare tab: %v", err)
+	}
+	expectedUpdates := []string{"'Хаски'!E1:G1", "'Шанс'!A1:F1"}
+	if !reflect.DeepEqual(updates, expectedUpdates) || !reflect.DeepEqual(createdSheets, []string{"Шанс"}) {
+		t.Errorf("Expected headers to be written to %v and tab Шанс to be created, got %v, %v", expectedUpdates, updates, createdSheets)
+	}
+
+	// values are placed under their headers, notes of coordinators are skipped
+	shelter := &models.Shelter{ID: "1", Title: "Test Shelter", ShortTitle: "Хаски"}
+	tripToShelter := &models.TripToShelter{Username: "testuser", Shelter: shelter, Date: "Сб 13.08.2022 11:00", IsFirstTrip: true, Purpose: []string{"Гулять", "Помогать"}, Status: "Записан"}
+	if _, err := sheetsService.SaveTripsToShelter("Хаски", []*models.TripToShelter{tripToShelter}); err != nil {
+		t.Fatalf("Failed to save trip: %v", err)
+	}
+	if _, err := sheetsService.SaveTripsToShelterSystem("System", []*models.TripToShelter{tripToShelter}); err != nil {
+		t.Fatalf("Failed to save trip to system tab: %v", err)
+	}
+	expectedRows := [][]interface{}{
+		{"13.08.2022", "testuser", nil, "Записан", "Хаски", "Да", "Гулять, Помогать"},
+		{"testuser", "Сб 13.08.2022 11:00"},
+	}
+	if !reflect.DeepEqual(appends, []string{"'Хаски'!A2:G", "'System'!A1:B"}) || !reflect.DeepEqual(appendedRows, expectedRows) {
+		t.Errorf("Expected rows %v, got %v to %v", expectedRows, appendedRows, appends)
+	}
+
+	// status is written to its column and read from column where coordinators moved it
+	if _, err := sheetsService.UpdateTripStatus("Хаски!A5:G5", "Отменен"); err != nil || updates[len(updates)-1] != "Хаски!D5" {
+		t.Errorf("Expected status to be written to Хаски!D5, got %v, %v", updates, err)
+	}
+	statuses, err := sheetsService.GetTripStatuses([]string{"Хаски!A5:G5"})
+	if err != nil || statuses["Хаски!A5:G5"] == nil || *statuses["Хаски!A5:G5"] != (models.TripSheetStatus{Date: "14.08.2022", Status: "Подтвержден"}) {
+		t.Errorf("Expected status and date from moved columns, got %v, %v", statuses, err)
+	}
+	if _, err := sheetsService.UpdateTripStatus("Хаски!A5:G5", "Отменен"); err != nil || updates[len(updates)-1] != "Хаски!A5" {
+		t.Errorf("Expected status to be written to moved column Хаски!A5, got %v, %v", updates, err)
+	}
+
+	// default columns are found in tab created before columns were set in app config
+	defaultSheetsService := sheet.NewGoogleSpreadsheetWithService(models.Google{SpreadsheetID: "test-id"}, srv)
+	updatesCount := len(updates)
+	if err := defaultSheetsService.PrepareSheetForSavingData("Шарик"); err != nil || len(updates) != updatesCount {
+		t.Errorf("Expected no columns to be added to tab with legacy headers, got %v, %v", updates[updatesCount:], err)
+	}
+	// time of registration is written instead of time of writing
+	tripToShelter.RegisteredAt = time.Date(2022, 8, 1, 10, 30, 0, 0, dates.Location())
+	if _, err := defaultSheetsService.SaveTripsToShelter("Шарик", []*models.TripToShelter{tripToShelter}); err != nil {
+		t.Fatalf("Failed to save trip: %v", err)
+	}
+	row := appendedRows[len(appendedRows)-1]
+	if len(row) != 9 || row[7] != "01.08.2022 10:30:00" || row[8] != "Записан" {
+		t.Errorf("Expected registration time to be written to legacy column, got %v", row)
+	}
+}
+
+// TestSyncTripStatusesWhileHandlingUpdates tests that trips are changed by status sync while users read them, run with -race flag
+func TestSyncTripStatusesWhileHandlingUpdates(t *testing.T) {
+	app := setupTestApp(t)
+	mockSheets := app.SheetsService.(*mocks.MockGoogleSheetsService)
+	config := &models.ConfigFile{Administration: &models.Administration{Admin: "99999"}}
+	shelters := getSheltersListForTest()
+	shelter := shelters[1]
+	shelter.Schedule.TimeStart = "11:00"
+	shelterDates := getDatesByShelter(shelter)
+	date, newDate := shelterDates[1], shelterDates[2]
+
+	// odd chats are moved to the new date, even chats are confirmed
+	for chatId := int64(1); chatId <= 6; chatId++ {
+		tripToShelter := &models.TripToShelter{ChatId: chatId, Username: fmt.Sprintf("user%d", chatId), Shelter: shelter, Date: date}
+		tripToShelter.TripKey = getTripKey(shelter, date)
+		tripToShelter.ID = newTripID(tripToShelter)
+		tripToShelter.SheetRange = fmt.Sprintf("Test!A%d:I%d", chatId+1, chatId+1)
+		reserveSeat(shelter, date)
+		addRegistration(tripToShelter)
+
+		sheetStatus := &models.TripSheetStatus{Date: date, Status: sheetStatusConfirmed}
+		if chatId%2 == 1 {
+			sheetStatus = &models.TripSheetStatus{Date: newDate}
+		}
+		mockSheets.SheetStatuses[tripToShelter.SheetRange] = sheetStatus
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := app.syncTripStatuses(dates.Now()); err != nil {
+			t.Errorf("Failed to sync trip statuses: %v", err)
+		}
+	}()
+	updatesDispatcher := dispatcher.New(4)
+	for i := 0; i < 3; i++ {
+		for chatId := int64(1); chatId <= 6; chatId++ {
+			chatId := chatId
+			update := createTestUpdate(t, chatId, commandMyTrips)
+			updatesDispatcher.Dispatch(chatId, func() {
+				app.handleUpdate(update, chatId, config, &shelters)
+			})
+		}
+	}
+	updatesDispatcher.Wait()
+	wg.Wait()
+
+	for chatId := int64(1); chatId <= 6; chatId++ {
+		trips := getUpcomingRegistrations(chatId, dates.Now())
+		if len(trips) != 1 {
+			t.Fatalf("Expected one registration of chat %d, got %d", chatId, len(trips))
+		}
+		if chatId%2 == 1 && trips[0].Date != newDate {
+			t.Errorf("Expected trip of chat %d to be moved to %s, got %s", chatId, newDate, trips[0].Date)
+		}
+		if chatId%2 == 0 && trips[0].Status != sheetStatusConfirmed {
+			t.Errorf("Expected trip of chat %d to be confirmed, got %q", chatId, trips[0].Status)
+		}
+	}
+}
+
+// TestRegistrationsInOneSession tests that every registration in the same session starts without answers of the previous one
+func TestRegistrationsInOneSession(t *testing.T) {
+	app := setupTestApp(t)
+	config := &models.ConfigFile{Administration: &models.Administration{Admin: "99999"}}
+	shelters := getSheltersListForTest()
+	shelter := shelters[1]
+	shelter.Schedule.TimeStart = "11:00"
+	shelterDates := getDatesByShelter(shelter)
+	var chatId int64 = 12345
+
+	register := func(date string, isFirstTrip string, purpose []int, tripBy []int, source []int) {
+		for _, text := range []string{commandGoShelter, chooseByShelter, "1. Test Shelter", date, isFirstTrip} {
+			app.handleUpdate(createTestUpdate(t, chatId, text), chatId, config, &shelters)
+		}
+		for _, options := range [][]int{purpose, tripBy, source} {
+			app.handleUpdate(createTestPollUpdate(t, chatId, "poll-1", options), chatId, config, &shelters)
+		}
+	}
+	checkAnswers := func(date string, isFirstTrip bool, purpose []string, source []string) {
+		t.Helper()
+		registeredTrip := findRegistration(chatId, shelter, date)
+		if registeredTrip == nil {
+			t.Fatalf("Expected trip on %s to be registered", date)
+		}
+		if registeredTrip.IsFirstTrip != isFirstTrip || !reflect.DeepEqual(registeredTrip.Purpose, purpose) || !reflect.DeepEqual(registeredTrip.HowYouKnowAboutUs, source) {
+			t.Errorf("Expected answers %v, %v, %v on %s, got %v, %v, %v", isFirstTrip, purpose, source, date,
+				registeredTrip.IsFirstTrip, registeredTrip.Purpose, registeredTrip.HowYouKnowAboutUs)
+		}
+	}
+
+	register(shelterDates[1], "Да", []int{0}, []int{0}, []int{0})
+	register(shelterDates[2], "Нет", []int{1, 2}, []int{1}, []int{1})
+	checkAnswers(shelterDates[1], true, []string{purposes[0]}, []string{sources[0]})
+	checkAnswers(shelterDates[2], false, []string{purposes[1], purposes[2]}, []string{sources[1]})
+
+	// answers of the same trip are replaced by new answers only
+	register(shelterDates[1], "Нет", []int{2}, []int{2}, []int{2})
+	app.handleUpdate(createTestUpdate(t, chatId, replaceEarlierAnswers), chatId, config, &shelters)
+	checkAnswers(shelterDates[1], false, []string{purposes[2]}, []string{sources[2]})
 }